@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// benchmark is a -benchmark run, processing a random sample of the walked
+// images into a temporary directory and timing it
+type benchmark struct {
+	dir         string
+	walked      int
+	sampled     int
+	sampleBytes int64
+	start       time.Time
+
+	completed int
+	skipped   int
+	failed    int
+	imageTime time.Duration
+	stages    map[string]*stageTiming
+}
+
+// stageTiming totals the time one derivative stage took over the sample
+type stageTiming struct {
+	count int
+	total time.Duration
+}
+
+// startBenchmark sets up the temporary output directory derivatives go to
+// and times the run through the event hook
+func startBenchmark() (*benchmark, error) {
+	dir, err := os.MkdirTemp("", "gallery-benchmark-")
+	if err != nil {
+		return nil, err
+	}
+	config.benchmarkDir = dir
+
+	b := &benchmark{dir: dir, stages: map[string]*stageTiming{}}
+	events.subscribe(b.observe)
+	return b, nil
+}
+
+// sample passes on n of images picked at random, once all have been walked
+func (b *benchmark) sample(ctx context.Context, images <-chan *ImageData, n int) <-chan *ImageData {
+	sampled := make(chan *ImageData)
+	go func() {
+		defer close(sampled)
+
+		var reservoir []*ImageData
+		for imageData := range images {
+			b.walked++
+			if len(reservoir) < n {
+				reservoir = append(reservoir, imageData)
+			} else if i := rand.Intn(b.walked); i < n {
+				reservoir[i] = imageData
+			}
+		}
+
+		b.sampled = len(reservoir)
+		for _, imageData := range reservoir {
+			if imageData.source != nil {
+				b.sampleBytes += int64(len(imageData.source))
+			} else {
+				b.sampleBytes += fileSize(imageData.path)
+			}
+		}
+		logger.Infof("Benchmarking %d of %d images", b.sampled, b.walked)
+
+		// the clock starts once walking is done
+		b.start = time.Now()
+		for _, imageData := range reservoir {
+			select {
+			case sampled <- imageData:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return sampled
+}
+
+func (b *benchmark) observe(event Event) {
+	elapsed := time.Duration(event.Elapsed * float64(time.Second))
+	switch event.Type {
+	case eventImageCompleted:
+		b.completed++
+		b.imageTime += elapsed
+	case eventImageSkipped:
+		b.skipped++
+	case eventImageFailed:
+		b.failed++
+	case eventDerivativeWritten:
+		if _, exists := b.stages[event.Stage]; !exists {
+			b.stages[event.Stage] = &stageTiming{}
+		}
+		b.stages[event.Stage].count++
+		b.stages[event.Stage].total += elapsed
+	}
+}
+
+// finish waits out the results, then removes the temporary output and
+// reports
+func (b *benchmark) finish(results <-chan *ImageData) {
+	for range results {
+	}
+	wall := time.Since(b.start)
+
+	var vipsStats vips.MemoryStats
+	vips.ReadVipsMemStats(&vipsStats)
+	var goStats runtime.MemStats
+	runtime.ReadMemStats(&goStats)
+
+	if err := os.RemoveAll(b.dir); err != nil {
+		logger.Error(err)
+	}
+
+	fmt.Printf("sample:      %d of %d images, %d processed, %d skipped, %d failed\n", b.sampled, b.walked, b.completed, b.skipped, b.failed)
+	fmt.Printf("wall time:   %s\n", wall.Round(time.Millisecond))
+	fmt.Printf("throughput:  %.2f images/s, %.2f MiB/s of sources\n", float64(b.completed)/wall.Seconds(), float64(b.sampleBytes)/(1<<20)/wall.Seconds())
+	if b.completed > 0 {
+		fmt.Printf("per image:   %s\n", (b.imageTime / time.Duration(b.completed)).Round(time.Millisecond))
+	}
+
+	stages := make([]string, 0, len(b.stages))
+	for stage := range b.stages {
+		stages = append(stages, stage)
+	}
+	sort.Strings(stages)
+	for _, stage := range stages {
+		timing := b.stages[stage]
+		fmt.Printf("  %-16s %s over %d\n", stage, (timing.total / time.Duration(timing.count)).Round(time.Millisecond), timing.count)
+	}
+
+	fmt.Printf("peak memory: vips %.1f MiB, Go runtime %.1f MiB\n", float64(vipsStats.MemHigh)/(1<<20), float64(goStats.Sys)/(1<<20))
+}
+
+// benchmarkPath moves a derivative path under root into the -benchmark
+// directory, leaving it as is outside a benchmark
+func benchmarkPath(path string) string {
+	if config.benchmarkDir == "" {
+		return path
+	}
+	relPath, err := filepath.Rel(config.root, path)
+	if err != nil || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		relPath = filepath.Base(path)
+	}
+	return filepath.Join(config.benchmarkDir, relPath)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// thumbBackgrounds are what -thumb-background puts behind thumbnails: blur
+// fits -thumb-ratio ones over a blurred copy instead of cropping them, and
+// checker puts transparent ones over a checkerboard
+var thumbBackgrounds = map[string]bool{
+	"none":    true,
+	"blur":    true,
+	"checker": true,
+}
+
+// thumbBlurDivisor sizes the blur of a blur background, the box height over
+// this being its sigma
+const thumbBlurDivisor = 12
+
+// blurFilled makes a thumbnail fit in the -thumb-ratio box over a blurred
+// copy of itself covering the box. load resizes the image to the box,
+// cropping it with crop.
+func blurFilled(imageData *ImageData, load func(crop vips.Interesting) (*vips.ImageRef, error)) (*vips.ImageRef, error) {
+	background, err := load(vips.InterestingCentre)
+	if err != nil {
+		return nil, err
+	}
+	fit, err := load(vips.InterestingNone)
+	if err != nil {
+		background.Close()
+		return nil, err
+	}
+	defer fit.Close()
+
+	if err := background.GaussianBlur(float64(background.Height()) / thumbBlurDivisor); err != nil {
+		background.Close()
+		return nil, err
+	}
+	left, top := (background.Width()-fit.Width())/2, (background.Height()-fit.Height())/2
+	if err := background.Composite(fit, vips.BlendModeOver, left, top); err != nil {
+		background.Close()
+		return nil, err
+	}
+	// compositing adds an alpha channel an opaque source never had
+	if !imageData.HasAlpha && background.HasAlpha() {
+		if err := background.Flatten(&vips.Color{}); err != nil {
+			background.Close()
+			return nil, err
+		}
+	}
+	return background, nil
+}
+
+// shrunkCopy is a copy of larger resized to width by height, left untouched
+func shrunkCopy(larger *vips.ImageRef, width int, height int, crop vips.Interesting) (*vips.ImageRef, error) {
+	shrunk, err := larger.Copy()
+	if err != nil {
+		return nil, err
+	}
+	if config.LinearResize {
+		err = thumbnailLinear(shrunk, width, height, crop, vips.SizeBoth)
+	} else {
+		err = shrunk.ThumbnailWithSize(width, height, crop, vips.SizeBoth)
+	}
+	if err != nil {
+		shrunk.Close()
+		return nil, err
+	}
+	return shrunk, nil
+}
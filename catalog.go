@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// catalogColumns head the -catalog CSV. Source paths are relative to the
+// root, outputs recorded as in images.json and tags joined with ", ".
+var catalogColumns = []string{"path", "width", "height", "capture_date", "title", "caption", "tags", "full_path", "thumb_path", "display_path", "tiles"}
+
+// catalog collects a row per processed image for -catalog, written sorted
+// by source path once the run is done
+type catalog struct {
+	rows [][]string
+}
+
+func (c *catalog) add(imageData *ImageData) {
+	path := imageData.path
+	if relPath, err := filepath.Rel(config.root, path); err == nil {
+		path = filepath.ToSlash(relPath)
+	}
+	dir, _ := imageDataKey(imageData)
+
+	c.rows = append(c.rows, []string{
+		path,
+		strconv.Itoa(imageData.MaxWidth),
+		strconv.Itoa(imageData.MaxHeight),
+		imageData.CaptureDate,
+		imageData.Title,
+		imageData.Caption,
+		strings.Join(imageData.Tags, ", "),
+		recordedPath(imageData.FullPath),
+		recordedPath(imageData.ThumbPath),
+		recordedPath(imageData.DisplayPath),
+		tilesRef(dir, imageData),
+	})
+}
+
+// write saves the catalog to catalogPath, quoting fields as CSV needs
+func (c *catalog) write(catalogPath string) error {
+	sort.Slice(c.rows, func(i, j int) bool {
+		return c.rows[i][0] < c.rows[j][0]
+	})
+
+	var catalogCsv bytes.Buffer
+	writer := csv.NewWriter(&catalogCsv)
+	writer.Write(catalogColumns)
+	writer.WriteAll(c.rows)
+	if err := writer.Error(); err != nil {
+		return err
+	}
+	return writeFile(catalogPath, catalogCsv.Bytes())
+}
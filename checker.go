@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// checkerboard is a width by height pattern of -checker-size squares in the
+// two -checker-colors
+func checkerboard(width int, height int) (*vips.ImageRef, error) {
+	board := image.NewRGBA(image.Rect(0, 0, width, height))
+	var cells [2]color.RGBA
+	for i, cell := range config.checkerColors {
+		cells[i] = color.RGBA{R: cell.R, G: cell.G, B: cell.B, A: 0xff}
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			board.SetRGBA(x, y, cells[(x/config.CheckerSize+y/config.CheckerSize)%2])
+		}
+	}
+
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, board); err != nil {
+		return nil, err
+	}
+	return vips.NewImageFromBuffer(encoded.Bytes())
+}
+
+// checkerThumbnail puts a transparent thumbnail over a checkerboard with
+// -thumb-background checker, reporting whether it did
+func checkerThumbnail(thumbnail *vips.ImageRef) (bool, error) {
+	if config.ThumbBackground != "checker" || !thumbnail.HasAlpha() {
+		return false, nil
+	}
+
+	board, err := checkerboard(thumbnail.Width(), thumbnail.Height())
+	if err != nil {
+		return false, err
+	}
+	defer board.Close()
+
+	// dest-over puts the board beneath the thumbnail
+	if err := thumbnail.Composite(board, vips.BlendModeDestOver, 0, 0); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// checksumAlgorithms are the -checksum-algorithm hashes of derivatives'
+// contents
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha1":   sha1.New,
+	"sha512": sha512.New,
+	"md5":    md5.New,
+}
+
+// ChecksumManifest is the -checksum-manifest file, the hex content hash of
+// every derivative by its path as images.json records it
+type ChecksumManifest struct {
+	Algorithm string            `json:"algorithm"`
+	Files     map[string]string `json:"files"`
+}
+
+// checksumLog collects the hashes of the derivatives a run writes
+type checksumLog struct {
+	sync.Mutex
+	files map[string]string
+}
+
+var checksums checksumLog
+
+// record hashes data, just written to path
+func (c *checksumLog) record(path string, data []byte) {
+	if config.ChecksumManifest == "" {
+		return
+	}
+	hasher := checksumAlgorithms[config.ChecksumAlgorithm]()
+	hasher.Write(data)
+	c.set(path, hasher.Sum(nil))
+}
+
+// recordFile hashes the file at path, for what the vips command wrote
+func (c *checksumLog) recordFile(path string) {
+	if config.ChecksumManifest == "" {
+		return
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		logger.Errorf("-checksum-manifest %s: %s", path, err)
+		return
+	}
+	defer file.Close()
+
+	hasher := checksumAlgorithms[config.ChecksumAlgorithm]()
+	if _, err := io.Copy(hasher, file); err != nil {
+		logger.Errorf("-checksum-manifest %s: %s", path, err)
+		return
+	}
+	c.set(path, hasher.Sum(nil))
+}
+
+// recordDir hashes every file under dir, a tile pyramid
+func (c *checksumLog) recordDir(dir string) {
+	if config.ChecksumManifest == "" {
+		return
+	}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			c.recordFile(path)
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Errorf("-checksum-manifest %s: %s", dir, err)
+	}
+}
+
+func (c *checksumLog) set(path string, sum []byte) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.files == nil {
+		c.files = map[string]string{}
+	}
+	c.files[recordedPath(path)] = hex.EncodeToString(sum)
+}
+
+// checksumChanges are the keys a -checksum-manifest write replaced or
+// dropped, what a CDN has cached stale
+type checksumChanges struct {
+	added   int
+	changed []string
+	removed []string
+}
+
+// write saves the hashes to manifestPath over those already there that the
+// gallery still records, so the derivatives an incremental or resumed run
+// kept rather than rewrote keep theirs. Those of derivatives no images.json
+// under root records any more are dropped.
+func (c *checksumLog) write(manifestPath string, root string) (checksumChanges, error) {
+	var changes checksumChanges
+	prior := map[string]string{}
+	if priorJson, err := os.ReadFile(manifestPath); err == nil {
+		var existing ChecksumManifest
+		if err := json.Unmarshal(priorJson, &existing); err != nil {
+			logger.Warnf("Not merging unreadable %s: %s", manifestPath, err)
+		} else if existing.Algorithm != config.ChecksumAlgorithm {
+			logger.Warnf("Not merging %s, hashed with %s", manifestPath, existing.Algorithm)
+		} else if existing.Files != nil {
+			prior = existing.Files
+		}
+	} else if !os.IsNotExist(err) {
+		return changes, err
+	}
+
+	outputs, err := recordedOutputs(root)
+	if err != nil {
+		return changes, err
+	}
+
+	manifest := ChecksumManifest{Algorithm: config.ChecksumAlgorithm, Files: map[string]string{}}
+	c.Lock()
+	for path, sum := range c.files {
+		if _, exists := prior[path]; !exists {
+			changes.added++
+		}
+		manifest.Files[path] = sum
+	}
+	c.Unlock()
+	for path, sum := range prior {
+		written, rewritten := manifest.Files[path]
+		switch {
+		case !rewritten && outputs.records(path):
+			manifest.Files[path] = sum
+		case !rewritten:
+			changes.removed = append(changes.removed, path)
+		case written != sum:
+			changes.changed = append(changes.changed, path)
+		}
+	}
+	sort.Strings(changes.changed)
+	sort.Strings(changes.removed)
+
+	// map keys marshal sorted, so runs diff line by line
+	manifestJson, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return changes, err
+	}
+	return changes, writeFile(manifestPath, manifestJson)
+}
+
+// galleryOutputs are the derivatives the images.json files of a gallery
+// record, by -checksum-manifest key
+type galleryOutputs struct {
+	files    map[string]bool
+	tileDirs []string
+}
+
+// recordedOutputs reads what every images.json under root records
+func recordedOutputs(root string) (galleryOutputs, error) {
+	outputs := galleryOutputs{files: map[string]bool{}}
+	jsonPaths, err := findDirImageData(root)
+	if err != nil {
+		return outputs, err
+	}
+	for _, jsonPath := range jsonPaths {
+		dirImageData, err := readCleanedImageData(jsonPath)
+		if err != nil {
+			return outputs, fmt.Errorf("%s: %w", jsonPath, err)
+		}
+		for _, sheet := range dirImageData.ContactSheets {
+			outputs.files[recordedPath(localPath(sheet))] = true
+		}
+		for _, imageData := range dirImageData.Images {
+			for _, output := range entryOutputs(filepath.Dir(jsonPath), imageData) {
+				outputs.files[recordedPath(output)] = true
+			}
+			if tiles := entryTilesDir(filepath.Dir(jsonPath), imageData); tiles != "" {
+				outputs.tileDirs = append(outputs.tileDirs, recordedPath(tiles))
+			}
+		}
+	}
+	return outputs, nil
+}
+
+// records reports whether the gallery still has the derivative keyed path,
+// a file it records or a tile in a pyramid it does
+func (o galleryOutputs) records(path string) bool {
+	if o.files[path] {
+		return true
+	}
+	for _, dir := range o.tileDirs {
+		if strings.HasPrefix(path, dir+"/") || strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// writePurgeList saves the changed and removed keys to purgePath one per
+// line, for a CDN purge
+func writePurgeList(purgePath string, changes checksumChanges) error {
+	var list strings.Builder
+	for _, path := range append(append([]string{}, changes.changed...), changes.removed...) {
+		list.WriteString(path)
+		list.WriteByte('\n')
+	}
+	return writeFile(purgePath, []byte(list.String()))
+}
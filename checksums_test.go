@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestChecksumManifestMerge(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+	root := t.TempDir()
+	config.root = root
+	config.TilesRef = "path"
+	config.ChecksumAlgorithm = "sha256"
+	path := func(name string) string { return filepath.Join(root, name) }
+
+	// the gallery after this run: a kept from before, b rewritten, c new
+	dirImageData := DirImageData{Images: map[string]*ImageData{
+		"a": {FullPath: path("a.jpg"), ThumbPath: path("a-thumbnail.jpg"), Tiles: path("a_files")},
+		"b": {FullPath: path("b.jpg"), ThumbPath: path("b-thumbnail.jpg")},
+		"c": {FullPath: path("c.jpg"), ThumbPath: path("c-thumbnail.jpg")},
+	}}
+	jsonBytes, err := json.Marshal(dirImageData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path("images.json"), jsonBytes, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	manifestPath := filepath.Join(t.TempDir(), "checksums.json")
+	prior := ChecksumManifest{Algorithm: "sha256", Files: map[string]string{
+		path("a-thumbnail.jpg"):      "aa",
+		path("a_files/0/0_0.jpg"):    "a0",
+		path("b-thumbnail.jpg"):      "bb",
+		path("b-display.jpg"):        "bd",
+		path("gone-thumbnail.jpg"):   "gg",
+		path("gone_files/0/0_0.jpg"): "g0",
+	}}
+	priorJson, err := json.Marshal(prior)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(manifestPath, priorJson, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	log := checksumLog{files: map[string]string{
+		path("b-thumbnail.jpg"): "b2",
+		path("c-thumbnail.jpg"): "cc",
+	}}
+	changes, err := log.write(manifestPath, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	written, err := os.ReadFile(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest ChecksumManifest
+	if err := json.Unmarshal(written, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		path("a-thumbnail.jpg"):   "aa",
+		path("a_files/0/0_0.jpg"): "a0",
+		path("b-thumbnail.jpg"):   "b2",
+		path("c-thumbnail.jpg"):   "cc",
+	}
+	if !reflect.DeepEqual(manifest.Files, want) {
+		t.Errorf("manifest %v, want %v", manifest.Files, want)
+	}
+	if changes.added != 1 {
+		t.Errorf("%d added, want 1", changes.added)
+	}
+	if !reflect.DeepEqual(changes.changed, []string{path("b-thumbnail.jpg")}) {
+		t.Errorf("changed %v", changes.changed)
+	}
+	removed := []string{path("b-display.jpg"), path("gone-thumbnail.jpg"), path("gone_files/0/0_0.jpg")}
+	if !reflect.DeepEqual(changes.removed, removed) {
+		t.Errorf("removed %v, want %v", changes.removed, removed)
+	}
+
+	purgePath := filepath.Join(t.TempDir(), "purge.txt")
+	if err := writePurgeList(purgePath, changes); err != nil {
+		t.Fatal(err)
+	}
+	purge, err := os.ReadFile(purgePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantPurge := path("b-thumbnail.jpg") + "\n" + removed[0] + "\n" + removed[1] + "\n" + removed[2] + "\n"
+	if string(purge) != wantPurge {
+		t.Errorf("purge list %q, want %q", purge, wantPurge)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// cleaner removes what -clean finds orphaned, or only logs it with -dry-run.
+// Only what the images.json entries of missing sources record is removed,
+// never a file just because it's named like a derivative.
+type cleaner struct {
+	sources    map[string]bool
+	keys       map[string]map[string]bool
+	referenced map[string]bool
+	removed    int
+}
+
+// cleanOrphans removes the derivatives and images.json entries under root
+// of sources that no longer exist, going by the sources walked into images.
+// They must be walked with the flags the gallery was made with, since those
+// decide the images.json names.
+func cleanOrphans(root string, images <-chan *ImageData, errc <-chan error) error {
+	c := &cleaner{sources: map[string]bool{}, keys: map[string]map[string]bool{}, referenced: map[string]bool{}}
+	for imageData := range images {
+		imageData.outputBase = derivativeBase(imageData)
+		c.sources[imageData.path] = true
+		dir, name := imageDataKey(imageData)
+		dir = filepath.Clean(dir)
+		if _, exists := c.keys[dir]; !exists {
+			c.keys[dir] = map[string]bool{}
+		}
+		c.keys[dir][name] = true
+	}
+	// anything missed by a failed walk would look orphaned
+	if err := <-errc; err != nil {
+		return err
+	}
+
+	jsonPaths, err := findDirImageData(root)
+	if err != nil {
+		return err
+	}
+
+	// a -dedupe-derivatives link can make an orphan's output another
+	// image's too, so everything live entries record is kept
+	recorded := map[string]DirImageData{}
+	for _, jsonPath := range jsonPaths {
+		dirImageData, err := readCleanedImageData(jsonPath)
+		if err != nil {
+			logger.Errorf("-clean %s: %s", jsonPath, err)
+			continue
+		}
+		recorded[jsonPath] = dirImageData
+		live := c.keys[filepath.Dir(jsonPath)]
+		for name, imageData := range dirImageData.Images {
+			if live[name] {
+				for _, output := range entryOutputs(filepath.Dir(jsonPath), imageData) {
+					c.referenced[output] = true
+				}
+			}
+		}
+	}
+
+	for _, jsonPath := range jsonPaths {
+		if dirImageData, ok := recorded[jsonPath]; ok {
+			if err := c.cleanDirImageData(jsonPath, dirImageData); err != nil {
+				logger.Errorf("-clean %s: %s", jsonPath, err)
+			}
+		}
+	}
+
+	if config.DryRun {
+		logger.Infof("Would remove %d orphaned derivatives and images.json entries", c.removed)
+	} else {
+		logger.Infof("Removed %d orphaned derivatives and images.json entries", c.removed)
+	}
+	return nil
+}
+
+// findDirImageData lists the images.json files under root, paginated ones
+// by their index
+func findDirImageData(root string) ([]string, error) {
+	ignores := newIgnoreRules(root)
+	var jsonPaths []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ignores.ignored(path, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if strings.HasSuffix(path, "_files") || d.Name() == dedupeDirName {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Name() == "images.json" || d.Name() == "images.json.gz" || isDirImageIndex(path) {
+			jsonPaths = append(jsonPaths, path)
+		}
+		return nil
+	})
+	return jsonPaths, err
+}
+
+func readCleanedImageData(jsonPath string) (DirImageData, error) {
+	var dirImageData DirImageData
+	jsonBytes, err := readDirImageData(jsonPath)
+	if err != nil {
+		return dirImageData, err
+	}
+	err = json.Unmarshal(jsonBytes, &dirImageData)
+	return dirImageData, err
+}
+
+// entryOutputs are the local paths of the derivatives an images.json entry
+// in jsonDir records, its tile directory among them
+func entryOutputs(jsonDir string, imageData *ImageData) []string {
+	recorded := []string{imageData.FullPath, imageData.ThumbPath, imageData.ThumbSquarePath, imageData.DisplayPath, imageData.PreviewPath, imageData.DziPath}
+	recorded = append(recorded, imageData.PagePaths...)
+	for _, sized := range imageData.Sizes {
+		recorded = append(recorded, sized.Path)
+	}
+
+	var outputs []string
+	for _, path := range recorded {
+		if path != "" {
+			outputs = append(outputs, localPath(path))
+		}
+	}
+	if tiles := entryTilesDir(jsonDir, imageData); tiles != "" {
+		outputs = append(outputs, tiles)
+	}
+	return outputs
+}
+
+// entryTilesDir is the tile directory of an images.json entry in jsonDir, ""
+// if it has none. Tiles referenced by url are found beside the thumbnail,
+// which is named from the same base.
+func entryTilesDir(jsonDir string, imageData *ImageData) string {
+	if imageData.Tiles == "" {
+		return ""
+	}
+
+	var tiles string
+	switch config.TilesRef {
+	case "path":
+		tiles = localPath(imageData.Tiles)
+	case "relative":
+		tiles = filepath.Join(jsonDir, filepath.FromSlash(imageData.Tiles))
+	default:
+		thumbPath := localPath(imageData.ThumbPath)
+		base, found := strings.CutSuffix(strings.TrimSuffix(thumbPath, filepath.Ext(thumbPath)), "-thumbnail")
+		if !found {
+			return ""
+		}
+		tiles = base + "_files"
+	}
+	if !strings.HasSuffix(tiles, "_files") {
+		return ""
+	}
+	return tiles
+}
+
+// cleanDirImageData drops the entries of sources no longer there from the
+// images.json at jsonPath, along with the derivatives they record
+func (c *cleaner) cleanDirImageData(jsonPath string, dirImageData DirImageData) error {
+	live := c.keys[filepath.Dir(jsonPath)]
+	orphaned := 0
+	for name, imageData := range dirImageData.Images {
+		if live[name] {
+			continue
+		}
+		for _, output := range entryOutputs(filepath.Dir(jsonPath), imageData) {
+			// a source served as-is is its own full rendition, and already gone
+			if c.sources[output] || c.referenced[output] {
+				continue
+			}
+			if _, err := os.Lstat(output); err == nil {
+				// once, should another orphan share it
+				c.referenced[output] = true
+				c.remove(output)
+			}
+		}
+		c.drop(jsonPath, name)
+		delete(dirImageData.Images, name)
+		orphaned++
+	}
+	if orphaned == 0 || config.DryRun {
+		return nil
+	}
+
+	dirImageData.Count = len(dirImageData.Images)
+	dirImageData.Cover = coverImage(dirImageData.Images)
+	return rewriteDirImageData(jsonPath, dirImageData)
+}
+
+// rewriteDirImageData saves dirImageData back to jsonPath as it was read,
+// gzipped or paginated if it was
+func rewriteDirImageData(jsonPath string, dirImageData DirImageData) error {
+	if isDirImageIndex(jsonPath) {
+		return writeDirPages(jsonPath, dirImageData)
+	}
+
+	jsonFile, err := createFile(jsonPath)
+	if err != nil {
+		return err
+	}
+	defer jsonFile.Close()
+
+	var jsonWriter io.Writer = jsonFile
+	var gzipWriter *gzip.Writer
+	if strings.HasSuffix(jsonPath, ".gz") {
+		gzipWriter = gzip.NewWriter(jsonFile)
+		jsonWriter = gzipWriter
+	}
+
+	buffered := bufio.NewWriter(jsonWriter)
+	if err := encodeDirImageData(buffered, dirImageData); err != nil {
+		return err
+	}
+	if err := buffered.Flush(); err != nil {
+		return err
+	}
+	if gzipWriter != nil {
+		if err := gzipWriter.Close(); err != nil {
+			return err
+		}
+	}
+	return jsonFile.Close()
+}
+
+// remove deletes path, a file or tile directory, or with -dry-run only logs it
+func (c *cleaner) remove(path string) {
+	c.removed++
+	if config.DryRun {
+		logger.Infof("Would remove %s", path)
+		return
+	}
+	logger.Infof("Removing %s", path)
+	if err := os.RemoveAll(path); err != nil {
+		logger.Error(err)
+	}
+}
+
+// drop counts and logs the removal of the images.json entry name, which
+// cleanDirImageData makes
+func (c *cleaner) drop(jsonPath string, name string) {
+	c.removed++
+	if config.DryRun {
+		logger.Infof("Would drop %s from %s", name, jsonPath)
+		return
+	}
+	logger.Infof("Dropping %s from %s", name, jsonPath)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// cleanFixture is a gallery with the source a.jpg still there, the entry of
+// the deleted gone.jpg, a -dedupe-derivatives copy both share and a user's
+// file named like a derivative
+func cleanFixture(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	for _, name := range []string{"a.jpg", "a-thumbnail.jpg", "gone-thumbnail.jpg", "gone-display.jpg", "poster-preview.jpg", "gone_files/0/0_0.jpg", dedupeDirName + "/shared.jpg"} {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dirImageData := DirImageData{Count: 2, Images: map[string]*ImageData{
+		"a":    {FullPath: filepath.Join(root, "a.jpg"), ThumbPath: filepath.Join(root, "a-thumbnail.jpg"), DisplayPath: filepath.Join(root, "a.jpg"), ThumbSquarePath: filepath.Join(root, dedupeDirName, "shared.jpg")},
+		"gone": {FullPath: filepath.Join(root, "gone.jpg"), ThumbPath: filepath.Join(root, "gone-thumbnail.jpg"), DisplayPath: filepath.Join(root, "gone-display.jpg"), ThumbSquarePath: filepath.Join(root, dedupeDirName, "shared.jpg"), Tiles: filepath.Join(root, "gone_files")},
+	}}
+	jsonBytes, err := json.Marshal(dirImageData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "images.json"), jsonBytes, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func runClean(t *testing.T, root string) {
+	t.Helper()
+	images := make(chan *ImageData, 1)
+	images <- &ImageData{path: filepath.Join(root, "a.jpg"), name: "a"}
+	close(images)
+	errc := make(chan error, 1)
+	errc <- nil
+	if err := cleanOrphans(root, images, errc); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCleanOrphans(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+
+	tests := []struct {
+		dryRun  bool
+		kept    []string
+		removed []string
+		entries int
+	}{
+		{
+			dryRun:  true,
+			kept:    []string{"a.jpg", "a-thumbnail.jpg", "gone-thumbnail.jpg", "gone-display.jpg", "gone_files", "poster-preview.jpg", dedupeDirName + "/shared.jpg"},
+			entries: 2,
+		},
+		{
+			dryRun:  false,
+			kept:    []string{"a.jpg", "a-thumbnail.jpg", "poster-preview.jpg", dedupeDirName + "/shared.jpg"},
+			removed: []string{"gone-thumbnail.jpg", "gone-display.jpg", "gone_files"},
+			entries: 1,
+		},
+	}
+	for _, test := range tests {
+		root := cleanFixture(t)
+		config.root = root
+		config.TilesRef = "path"
+		config.Clean = true
+		config.DryRun = test.dryRun
+		runClean(t, root)
+
+		for _, name := range test.kept {
+			if _, err := os.Lstat(filepath.Join(root, name)); err != nil {
+				t.Errorf("dry run %t: %s was removed: %s", test.dryRun, name, err)
+			}
+		}
+		for _, name := range test.removed {
+			if _, err := os.Lstat(filepath.Join(root, name)); !os.IsNotExist(err) {
+				t.Errorf("dry run %t: %s was kept", test.dryRun, name)
+			}
+		}
+
+		jsonBytes, err := os.ReadFile(filepath.Join(root, "images.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var dirImageData DirImageData
+		if err := json.Unmarshal(jsonBytes, &dirImageData); err != nil {
+			t.Fatal(err)
+		}
+		if len(dirImageData.Images) != test.entries {
+			t.Errorf("dry run %t: %d images.json entries, want %d", test.dryRun, len(dirImageData.Images), test.entries)
+		}
+	}
+}
@@ -0,0 +1,801 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// Config holds the effective processing parameters for a run. Fields with a
+// JSON name are recorded in the meta section of every images.json so a
+// gallery can be checked against the settings that produced it.
+type Config struct {
+	Profile             string        `json:"profile"`
+	Format              string        `json:"format"`
+	ThumbFormat         string        `json:"thumb_format"`
+	DisplayFormat       string        `json:"display_format"`
+	FullFormat          string        `json:"full_format"`
+	Quality             int           `json:"quality"`
+	QuantTable          string        `json:"quant_table"`
+	JpegQuality         int           `json:"jpeg_quality"`
+	WebpQuality         int           `json:"webp_quality"`
+	HeicQuality         int           `json:"heic_quality"`
+	AvifQuality         int           `json:"avif_quality"`
+	ThumbQuality        int           `json:"thumb_quality,omitempty"`
+	DisplayQuality      int           `json:"display_quality,omitempty"`
+	QualityCurve        string        `json:"quality_curve,omitempty"`
+	FullQuality         int           `json:"full_quality,omitempty"`
+	ThumbnailHeight     int           `json:"thumbnail_height"`
+	ThumbMaxWidth       int           `json:"thumb_max_width"`
+	SlideHeight         int           `json:"slide_height"`
+	SlideMaxWidth       int           `json:"slide_max_width"`
+	SlideMinSource      int           `json:"slide_min_source,omitempty"`
+	TileMinDimension    int           `json:"tile_min_dimension"`
+	MinDimension        int           `json:"min_dimension"`
+	MaxDecodePixels     int64         `json:"max_decode_pixels,omitempty"`
+	JpegFail            bool          `json:"jpeg_fail"`
+	PdfDpi              int           `json:"pdf_dpi,omitempty"`
+	SvgDpi              int           `json:"svg_dpi,omitempty"`
+	SvgWidth            int           `json:"svg_width,omitempty"`
+	VerifyOutputs       bool          `json:"-"`
+	RecompressFull      bool          `json:"recompress_full,omitempty"`
+	RecompressFloor     int           `json:"recompress_floor,omitempty"`
+	Copyright           string        `json:"copyright,omitempty"`
+	StripMetadata       bool          `json:"strip_metadata"`
+	StripExifThumbnail  bool          `json:"strip_exif_thumbnail,omitempty"`
+	ThumbRatio          string        `json:"thumb_ratio,omitempty"`
+	ThumbGravity        string        `json:"thumb_gravity,omitempty"`
+	Interesting         string        `json:"interesting,omitempty"`
+	ThumbBorder         int           `json:"thumb_border,omitempty"`
+	ThumbBackground     string        `json:"thumb_background,omitempty"`
+	CheckerSize         int           `json:"checker_size,omitempty"`
+	CheckerColors       string        `json:"checker_colors,omitempty"`
+	ThumbsFromDisplay   bool          `json:"thumbs_from_display,omitempty"`
+	LinearResize        bool          `json:"linear_resize,omitempty"`
+	SquareThumbs        bool          `json:"square_thumbs,omitempty"`
+	DedupeDerivatives   bool          `json:"dedupe_derivatives,omitempty"`
+	DedupeLink          string        `json:"dedupe_link,omitempty"`
+	PagePreviews        bool          `json:"page_previews,omitempty"`
+	HeicAllFrames       bool          `json:"heic_all_frames,omitempty"`
+	SquareTolerance     float64       `json:"square_tolerance,omitempty"`
+	TrimBorders         bool          `json:"trim_borders,omitempty"`
+	TrimThreshold       float64       `json:"trim_threshold,omitempty"`
+	TrimTolerance       float64       `json:"trim_tolerance,omitempty"`
+	AutoLevels          bool          `json:"autolevels,omitempty"`
+	AutoLevelsStrength  float64       `json:"autolevels_strength,omitempty"`
+	AutoLevelsFull      bool          `json:"autolevels_full,omitempty"`
+	AutoWB              string        `json:"auto_wb,omitempty"`
+	AutoWBFull          bool          `json:"auto_wb_full,omitempty"`
+	ThumbBorderColor    string        `json:"thumb_border_color,omitempty"`
+	PreserveAlpha       bool          `json:"preserve_alpha,omitempty"`
+	AlphaFormat         string        `json:"alpha_format,omitempty"`
+	OutputLayout        string        `json:"output_layout"`
+	ShardDepth          int           `json:"shard_depth,omitempty"`
+	SlugifyNames        bool          `json:"slugify_names,omitempty"`
+	DirPrefix           bool          `json:"dir_prefix,omitempty"`
+	RenameSource        bool          `json:"-"`
+	OutputDir           string        `json:"-"`
+	DeleteOriginalPNG   bool          `json:"-"`
+	Interactive         bool          `json:"-"`
+	SkipSlides          bool          `json:"skip_slides,omitempty"`
+	Sizes               sizeList      `json:"sizes,omitempty"`
+	SizesOnly           bool          `json:"sizes_only,omitempty"`
+	SkipTiles           bool          `json:"skip_tiles,omitempty"`
+	FileSizes           bool          `json:"file_sizes,omitempty"`
+	KeepDzi             bool          `json:"keep_dzi,omitempty"`
+	OSDTileSources      bool          `json:"osd_tile_sources,omitempty"`
+	TileUpscaleTo       int           `json:"tile_upscale_to,omitempty"`
+	TileMaxLevel        int           `json:"tile_max_level,omitempty"`
+	StrictTiles         bool          `json:"-"`
+	ContactSheet        bool          `json:"contact_sheet,omitempty"`
+	ContactSheetColumns int           `json:"contact_sheet_columns,omitempty"`
+	ContactSheetRows    int           `json:"contact_sheet_rows,omitempty"`
+	PHash               bool          `json:"phash,omitempty"`
+	PHashThreshold      int           `json:"-"`
+	RawTool             string        `json:"raw_tool,omitempty"`
+	MetadataCSV         string        `json:"-"`
+	SQLite              string        `json:"-"`
+	Manifest            string        `json:"-"`
+	MergeManifests      bool          `json:"-"`
+	MergeOutput         string        `json:"-"`
+	Tags                stringList    `json:"-"`
+	PathBase            string        `json:"-"`
+	TilesRef            string        `json:"-"`
+	TilesURLBase        string        `json:"-"`
+	DetectCollisions    bool          `json:"-"`
+	RenameOnCollision   string        `json:"rename_on_collision,omitempty"`
+	ErrorReport         string        `json:"-"`
+	DirSummary          string        `json:"-"`
+	Catalog             string        `json:"-"`
+	ChecksumManifest    string        `json:"-"`
+	ChecksumAlgorithm   string        `json:"-"`
+	PurgeList           string        `json:"-"`
+	LogLevel            string        `json:"-"`
+	Events              string        `json:"-"`
+	RetryFailed         string        `json:"-"`
+	FailFast            bool          `json:"-"`
+	MaxFailures         string        `json:"-"`
+	Since               time.Duration `json:"-"`
+	MaxRuntime          time.Duration `json:"-"`
+	InputGlob           string        `json:"-"`
+	OnlyDirs            string        `json:"-"`
+	ResumeFromJSON      bool          `json:"-"`
+	CountOnly           bool          `json:"-"`
+	Clean               bool          `json:"-"`
+	DryRun              bool          `json:"-"`
+	Benchmark           int           `json:"-"`
+	Schedule            string        `json:"-"`
+	Serve               string        `json:"-"`
+	ServeOnly           bool          `json:"-"`
+	Force               bool          `json:"-"`
+	FollowSymlinks      bool          `json:"-"`
+	WalkConcurrency     int           `json:"-"`
+	Workers             int           `json:"-"`
+	WorkerAffinity      bool          `json:"-"`
+	VipsConcurrency     int           `json:"-"`
+	VipsDiscThreshold   string        `json:"-"`
+	MaxOpenFiles        int           `json:"-"`
+	WriteRate           float64       `json:"-"`
+	FileMode            octalMode     `json:"-"`
+	DirMode             octalMode     `json:"-"`
+	BatchSize           int           `json:"-"`
+	JSONPretty          bool          `json:"-"`
+	JSONGzip            bool          `json:"-"`
+	JSONPageSize        int           `json:"-"`
+	JSONSort            string        `json:"-"`
+
+	thumbBorderColor *vips.Color
+	checkerColors    [2]*vips.Color
+	thumbRatio       float64
+	qualityCurve     qualityCurve
+	quantTable       int
+	inputGlob        *inputGlob
+	onlyDirs         onlyDirs
+	maxFailures      *maxFailures
+	root             string
+	pathBase         string
+	tilesURLBase     *url.URL
+	benchmarkDir     string
+}
+
+var config = Config{
+	Profile:             "web",
+	LogLevel:            "info",
+	Schedule:            "walk",
+	Format:              "jpeg",
+	Quality:             75,
+	QuantTable:          strconv.Itoa(photoQuantTable),
+	ThumbnailHeight:     thumbnailHeight,
+	ThumbMaxWidth:       unboundedWidth,
+	SlideHeight:         slideHeight,
+	SlideMaxWidth:       unboundedWidth,
+	TileMinDimension:    tileMinDimension,
+	MinDimension:        2,
+	RecompressFloor:     60,
+	ThumbGravity:        "center",
+	Interesting:         "none",
+	AutoLevelsStrength:  1,
+	AutoWB:              "none",
+	TrimThreshold:       10,
+	TrimTolerance:       8,
+	ThumbBorderColor:    "ffffff",
+	ThumbBackground:     "none",
+	CheckerSize:         8,
+	CheckerColors:       "ffffff,cccccc",
+	AlphaFormat:         "webp",
+	OutputLayout:        "mirrored",
+	DedupeLink:          "symlink",
+	ContactSheetColumns: 6,
+	ContactSheetRows:    8,
+	PHashThreshold:      8,
+	RawTool:             "dcraw",
+	WalkConcurrency:     1,
+	MaxOpenFiles:        defaultMaxOpenFiles(),
+	FileMode:            octalMode{mode: 0644},
+	DirMode:             octalMode{mode: 0755},
+	JSONPretty:          true,
+	JSONSort:            "name",
+	ChecksumAlgorithm:   "sha256",
+	StripMetadata:       true,
+	RenameOnCollision:   "suffix",
+	JpegFail:            true,
+}
+
+// octalMode is a permissions flag given in octal. set records whether it was
+// given at all, so defaults can leave the umask alone.
+type octalMode struct {
+	mode os.FileMode
+	set  bool
+}
+
+func (m *octalMode) String() string {
+	return fmt.Sprintf("%#o", uint32(m.mode))
+}
+
+func (m *octalMode) Set(value string) error {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return fmt.Errorf("invalid octal permissions %q", value)
+	}
+	m.mode = os.FileMode(mode)
+	m.set = true
+	return nil
+}
+
+// stringList is a flag that may be repeated, collecting every value
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func registerFlags() {
+	flag.StringVar(&config.Profile, "profile", config.Profile, "bundle of defaults for a use, one of "+profileNames()+", explicit flags override it")
+	flag.StringVar(&config.Format, "format", config.Format, "output format for derivatives: jpeg, webp, png, avif or heic, which only Safari displays")
+	flag.StringVar(&config.ThumbFormat, "thumb-format", config.ThumbFormat, "output format for thumbnails, defaults to -format")
+	flag.StringVar(&config.DisplayFormat, "display-format", config.DisplayFormat, "output format for display images, defaults to -format")
+	flag.StringVar(&config.FullFormat, "full-format", config.FullFormat, "output format for full renditions, defaults to -format; "+keepSourceFormat+" serves sources in an output format as-is and writes the rest as png")
+	flag.IntVar(&config.Quality, "quality", config.Quality, "lossy encoding quality, 1 to 100, for formats without their own quality flag")
+	flag.IntVar(&config.JpegQuality, "jpeg-quality", config.JpegQuality, "jpeg encoding quality, defaults to -quality")
+	flag.IntVar(&config.WebpQuality, "webp-quality", config.WebpQuality, "webp encoding quality, defaults to -quality")
+	flag.IntVar(&config.HeicQuality, "heic-quality", config.HeicQuality, "heic encoding quality, defaults to -quality")
+	flag.IntVar(&config.AvifQuality, "avif-quality", config.AvifQuality, "avif encoding quality, defaults to -quality")
+	flag.IntVar(&config.ThumbQuality, "thumb-quality", config.ThumbQuality, "thumbnail encoding quality, defaults to the thumbnail format's")
+	flag.IntVar(&config.DisplayQuality, "display-quality", config.DisplayQuality, "display image encoding quality, defaults to the display format's")
+	flag.IntVar(&config.FullQuality, "full-quality", config.FullQuality, "converted full rendition encoding quality, defaults to the full format's")
+	flag.StringVar(&config.QualityCurve, "quality-curve", config.QualityCurve, "lossy quality by longest edge in px for renditions without their own -X-quality, EDGE:QUALITY,...,QUALITY, or default for "+defaultQualityCurve+"; flat or empty keeps the format qualities")
+	flag.StringVar(&config.QuantTable, "quant-table", config.QuantTable, "jpeg quantization table 0 to 8, 3 for photos and 1 for flat graphics, or auto to pick per image")
+	flag.IntVar(&config.SlideHeight, "slide-height", config.SlideHeight, "target height in px of the display image")
+	flag.IntVar(&config.SlideMaxWidth, "slide-max-width", config.SlideMaxWidth, "widest in px the display image may be, fitting it within a box instead of by height alone")
+	flag.IntVar(&config.ThumbMaxWidth, "thumb-max-width", config.ThumbMaxWidth, "widest in px a thumbnail may be, so panoramas don't come out as strips; ignored with -thumb-ratio")
+	flag.IntVar(&config.SlideMinSource, "slide-min-source", config.SlideMinSource, "minimum source width or height in px to generate a display image, defaults to -slide-height")
+	flag.BoolVar(&config.RecompressFull, "recompress-full", config.RecompressFull, "also try a lower quality encode of converted full renditions and keep it if meaningfully smaller")
+	flag.IntVar(&config.RecompressFloor, "recompress-floor", config.RecompressFloor, "lowest quality -recompress-full may pick")
+	flag.BoolVar(&config.StripMetadata, "strip-metadata", config.StripMetadata, "strip metadata from converted full renditions, false keeps it all; thumbnails and display images are always stripped, bar -copyright")
+	flag.BoolVar(&config.StripExifThumbnail, "strip-exif-thumbnail", config.StripExifThumbnail, "drop just the embedded EXIF thumbnail from the metadata -strip-metadata=false keeps")
+	flag.StringVar(&config.Copyright, "copyright", config.Copyright, "copyright notice embedded as EXIF in every derivative despite metadata stripping")
+	flag.StringVar(&config.ThumbRatio, "thumb-ratio", config.ThumbRatio, "crop thumbnails to a fixed WxH aspect ratio, e.g. 16x9")
+	flag.StringVar(&config.ThumbGravity, "thumb-gravity", config.ThumbGravity, "what -thumb-ratio crops keep: north, south, center or attention")
+	flag.StringVar(&config.ThumbBackground, "thumb-background", config.ThumbBackground, "background behind thumbnails: none, blur to fit -thumb-ratio thumbnails uncropped over a blurred copy of the image filling the box, or checker to show the transparency of transparent ones with -preserve-alpha, for review only")
+	flag.IntVar(&config.CheckerSize, "checker-size", config.CheckerSize, "px of each square of -thumb-background checker")
+	flag.StringVar(&config.CheckerColors, "checker-colors", config.CheckerColors, "the two hex colors of -thumb-background checker, comma separated")
+	flag.StringVar(&config.Interesting, "interesting", config.Interesting, "crop strategy for -thumb-ratio thumbnails, overriding -thumb-gravity: none, centre, entropy, attention, low or high")
+	flag.BoolVar(&config.TrimBorders, "trim-borders", config.TrimBorders, "crop uniform borders, e.g. from a scanner bed, the color of all four corners, off the full rendition and everything made from it")
+	flag.Float64Var(&config.TrimThreshold, "trim-threshold", config.TrimThreshold, "with -trim-borders, how far in 0-255 a pixel must differ from the border color to be kept")
+	flag.Float64Var(&config.TrimTolerance, "trim-tolerance", config.TrimTolerance, "with -trim-borders, how far in 0-255 the four corners may differ and still be a border")
+	flag.BoolVar(&config.AutoLevels, "autolevels", config.AutoLevels, "stretch the contrast of thumbnails and display images to the full brightness range")
+	flag.Float64Var(&config.AutoLevelsStrength, "autolevels-strength", config.AutoLevelsStrength, "how much of the -autolevels stretch to apply, 0 to 1")
+	flag.BoolVar(&config.AutoLevelsFull, "autolevels-full", config.AutoLevelsFull, "with -autolevels, also stretch converted full renditions")
+	flag.StringVar(&config.AutoWB, "auto-wb", config.AutoWB, "correct colour casts in thumbnails and display images: gray-world so the channels average the same, white-patch so their highlights match, or none; measured once per image so every rendition gets the same gains, capped to leave toned images mostly as they are")
+	flag.BoolVar(&config.AutoWBFull, "auto-wb-full", config.AutoWBFull, "with -auto-wb, also correct converted full renditions")
+	flag.BoolVar(&config.LinearResize, "linear-resize", config.LinearResize, "downscale thumbnails and display images in linear light, keeping fine bright detail from darkening, at the cost of decoding sources in full")
+	flag.BoolVar(&config.ThumbsFromDisplay, "thumbs-from-display", config.ThumbsFromDisplay, "downscale thumbnails from the display image instead of decoding the full rendition a second time")
+	flag.BoolVar(&config.PagePreviews, "page-previews", config.PagePreviews, "for multi-page tiff and pdf sources, write a full rendition per page and an animated webp preview cycling through them")
+	flag.BoolVar(&config.DedupeDerivatives, "dedupe-derivatives", config.DedupeDerivatives, "replace derivatives byte-identical to one written earlier in the run with links to a shared copy in "+dedupeDirName+", and record that in images.json")
+	flag.StringVar(&config.DedupeLink, "dedupe-link", config.DedupeLink, "link type for -dedupe-derivatives: symlink or hardlink")
+	flag.BoolVar(&config.SquareThumbs, "square-thumbs", config.SquareThumbs, "also write a square cropped thumbnail, recorded as thumb_square_path")
+	flag.BoolVar(&config.HeicAllFrames, "heic-all-frames", config.HeicAllFrames, "also write every other frame of burst HEIC sources as pages, recorded as page_paths, rather than only the primary image")
+	flag.Float64Var(&config.SquareTolerance, "square-tolerance", config.SquareTolerance, "with -square-thumbs, reuse the main thumbnail for sources whose aspect ratio is within this of 1, e.g. 0.05")
+	flag.IntVar(&config.ThumbBorder, "thumb-border", config.ThumbBorder, "width in px of a solid border around thumbnails, 0 for none")
+	flag.StringVar(&config.ThumbBorderColor, "thumb-border-color", config.ThumbBorderColor, "thumbnail border color as hex, e.g. ffffff")
+	flag.BoolVar(&config.PreserveAlpha, "preserve-alpha", config.PreserveAlpha, "keep transparency for sources with an alpha channel instead of flattening to jpeg")
+	flag.StringVar(&config.AlphaFormat, "alpha-format", config.AlphaFormat, "output format for transparent sources with -preserve-alpha: webp, png or avif")
+	flag.StringVar(&config.OutputLayout, "output-layout", config.OutputLayout, "mirrored writes derivatives and images.json beside each source, flat writes all of them into the root")
+	flag.IntVar(&config.ShardDepth, "shard-depth", config.ShardDepth, "spread derivatives over this many levels of hash prefix subdirectories, e.g. ab/cd, 0 to disable")
+	flag.BoolVar(&config.DirPrefix, "dir-prefix", config.DirPrefix, "prefix derivative names with a slug of their directory's name, or the contents of a "+prefixFileName+" file in it")
+	flag.BoolVar(&config.SlugifyNames, "slugify-names", config.SlugifyNames, "name derivatives and images.json keys with URL-safe slugs of the source names")
+	flag.BoolVar(&config.RenameSource, "rename-source", config.RenameSource, "with -slugify-names, also rename source files to their slugs")
+	flag.StringVar(&config.OutputDir, "output-dir", config.OutputDir, "with a .tar or .tar.gz input, where derivatives are written, mirroring the archive's paths")
+	flag.BoolVar(&config.DeleteOriginalPNG, "delete-original-png", config.DeleteOriginalPNG, "delete PNG sources once converted to a full rendition in another format")
+	flag.BoolVar(&config.Interactive, "i", config.Interactive, "with -delete-original-png, ask before deleting each source")
+	flag.Var(&config.Sizes, "size", "named width to also write a display image at, name:width, recorded under sizes by name, may be repeated")
+	flag.BoolVar(&config.SizesOnly, "sizes-only", config.SizesOnly, "write only the -size renditions, the smallest standing in for the thumbnail and the largest for the display image")
+	flag.BoolVar(&config.SkipSlides, "skip-slides", config.SkipSlides, "don't generate display images, pointing display_path at the full rendition")
+	flag.BoolVar(&config.FileSizes, "file-sizes", config.FileSizes, "record the size in bytes of the thumbnail, display image, full rendition and tiles in images.json")
+	flag.BoolVar(&config.SkipTiles, "skip-tiles", config.SkipTiles, "don't generate tile pyramids for large images")
+	flag.BoolVar(&config.OSDTileSources, "osd-tile-sources", config.OSDTileSources, "record each tiled image's OpenSeadragon tile source in images.json as tile_source, its Url the -tiles-ref of the tiles")
+	flag.BoolVar(&config.KeepDzi, "keep-dzi", config.KeepDzi, "keep the .dzi descriptor next to generated tiles and record it as dzi_path")
+	flag.IntVar(&config.TileUpscaleTo, "tile-upscale-to", config.TileUpscaleTo, "upsample tiled images to at least this long edge in px before tiling, 0 to disable")
+	flag.BoolVar(&config.Force, "force", config.Force, "regenerate tile pyramids even where a complete one already exists")
+	flag.BoolVar(&config.StrictTiles, "strict-tiles", config.StrictTiles, "fail an image's tiles when the pyramid has fewer levels than its size implies, instead of only logging it")
+	flag.IntVar(&config.TileMaxLevel, "tile-max-level", config.TileMaxLevel, "cap the tile pyramid at this many levels by downsampling huge images, 0 for no cap")
+	flag.BoolVar(&config.ContactSheet, "contact-sheet", config.ContactSheet, "write a contact-sheet.jpg montage of each directory's thumbnails")
+	flag.IntVar(&config.ContactSheetColumns, "contact-sheet-columns", config.ContactSheetColumns, "thumbnails per contact sheet row")
+	flag.IntVar(&config.ContactSheetRows, "contact-sheet-rows", config.ContactSheetRows, "rows per contact sheet before continuing on another page")
+	flag.BoolVar(&config.PHash, "phash", config.PHash, "compute a perceptual hash per image and report near-duplicates at the end of the run")
+	flag.IntVar(&config.PHashThreshold, "phash-threshold", config.PHashThreshold, "maximum Hamming distance between hashes reported as near-duplicates")
+	flag.StringVar(&config.RawTool, "raw-tool", config.RawTool, "dcraw-compatible converter used to develop camera RAW files")
+	flag.BoolVar(&config.DetectCollisions, "detect-collisions", config.DetectCollisions, "log an error when two sources write the same output path")
+	flag.StringVar(&config.RenameOnCollision, "rename-on-collision", config.RenameOnCollision, "for sources in one directory named the same but for their extension: suffix the later ones' names with -2, -3, ..., skip them with a warning, or error to fail the run")
+	flag.StringVar(&config.LogLevel, "log-level", config.LogLevel, "least severe lines to log: debug for the files the walk passes over too, info, warn for skipped and degraded images, or error for failures only")
+	flag.StringVar(&config.Catalog, "catalog", config.Catalog, "also write a CSV row per processed image to this file: source path, dimensions, capture date, title, caption, tags and output paths")
+	flag.StringVar(&config.ChecksumManifest, "checksum-manifest", config.ChecksumManifest, "record the content hash of every derivative written in this JSON file by its images.json path, merged over the hashes already there of derivatives still recorded, to tell which changed for CDN invalidation")
+	flag.StringVar(&config.PurgeList, "purge-list", config.PurgeList, "with -checksum-manifest, write the paths whose hash changed or was dropped this run to this file, one per line")
+	flag.StringVar(&config.ChecksumAlgorithm, "checksum-algorithm", config.ChecksumAlgorithm, "hash for -checksum-manifest: sha256, sha1, sha512 or md5")
+	flag.StringVar(&config.DirSummary, "dir-summary", config.DirSummary, "write each directory's image count, output bytes, tiled count and capture date range to this JSON file, keyed by path relative to the root; requires -file-sizes")
+	flag.StringVar(&config.ErrorReport, "error-report", config.ErrorReport, "write a JSON array of {path, stage, error} for every image that failed, also when interrupted, and with stage unprocessed for those -max-runtime left")
+	flag.StringVar(&config.Events, "events", config.Events, "write each image started, derivative written, image completed, skipped or failed and directory flushed to this file as NDJSON")
+	flag.StringVar(&config.RetryFailed, "retry-failed", config.RetryFailed, "process only the images that failed in this -error-report, merging them into the existing images.json and rewriting the report with what still fails")
+	flag.BoolVar(&config.VerifyOutputs, "verify-outputs", config.VerifyOutputs, "read back every rendition written, rewriting it once and failing the image if it doesn't decode whole at its size")
+	flag.Int64Var(&config.MaxDecodePixels, "max-decode-pixels", config.MaxDecodePixels, "sources with more pixels are never decoded in memory, converted by the vips command and without perceptual hash, crop or trim, 0 for no limit")
+	flag.BoolVar(&config.JpegFail, "jpeg-fail", config.JpegFail, "fail JPEG sources that are truncated or corrupt, -jpeg-fail=false loads what decodes of them instead")
+	flag.IntVar(&config.PdfDpi, "pdf-dpi", config.PdfDpi, "render PDF sources at this many dpi rather than the vips default of 72")
+	flag.IntVar(&config.SvgDpi, "svg-dpi", config.SvgDpi, "render SVG sources at this many dpi rather than at -svg-width")
+	flag.IntVar(&config.SvgWidth, "svg-width", config.SvgWidth, "rasterize SVG sources this many px wide, 2048 unless -svg-dpi is given instead")
+	flag.IntVar(&config.MinDimension, "min-dimension", config.MinDimension, "skip sources narrower or shorter than this many px, such as tracking pixels")
+	flag.StringVar(&config.MaxFailures, "max-failures", config.MaxFailures, "stop once more images or derivatives than this have failed, a count or a percentage of the images finished like 30%, applied from 20 images on")
+	flag.BoolVar(&config.FailFast, "fail-fast", config.FailFast, "stop at the first image that fails to process, exiting with its error")
+	flag.StringVar(&config.Serve, "serve", config.Serve, "after processing, serve the gallery over HTTP on this address, e.g. :8080")
+	flag.BoolVar(&config.ServeOnly, "serve-only", config.ServeOnly, "serve already processed output with -serve without processing")
+	flag.StringVar(&config.Schedule, "schedule", config.Schedule, "order images are processed in: walk as found, or largest-first by header dimensions once the walk is done, so the slowest don't hold up the end of a run")
+	flag.IntVar(&config.Benchmark, "benchmark", config.Benchmark, "process this many randomly sampled images into a temporary directory and report throughput, per-stage times and peak memory, writing nothing else")
+	flag.BoolVar(&config.Clean, "clean", config.Clean, "instead of processing, remove derivatives and images.json entries of sources that no longer exist; run with the flags the gallery was made with")
+	flag.BoolVar(&config.DryRun, "dry-run", config.DryRun, "with -clean, only log what would be removed")
+	flag.BoolVar(&config.CountOnly, "count-only", config.CountOnly, "report how many images need slides and tiles from their headers, without processing")
+	flag.BoolVar(&config.FollowSymlinks, "follow-symlinks", config.FollowSymlinks, "descend into symlinked directories and process symlinked files as their targets")
+	flag.IntVar(&config.WalkConcurrency, "walk-concurrency", config.WalkConcurrency, "directories listed in parallel while walking, for high-latency filesystems")
+	flag.IntVar(&config.Workers, "workers", config.Workers, "images processed in parallel, 0 for GOMAXPROCS")
+	flag.BoolVar(&config.WorkerAffinity, "worker-affinity", config.WorkerAffinity, "split GOMAXPROCS between the workers' vips threads instead of giving every worker that many")
+	flag.IntVar(&config.VipsConcurrency, "vips-concurrency", config.VipsConcurrency, "threads each vips operation runs on, 0 for the default of 1")
+	flag.StringVar(&config.VipsDiscThreshold, "vips-disc-threshold", config.VipsDiscThreshold, "decoded size above which vips decompresses images to a temp file instead of memory, e.g. 500m, empty for the vips default")
+	flag.Float64Var(&config.WriteRate, "write-rate", config.WriteRate, "most derivative and images.json writes per second across all workers, for rate-limited storage, 0 for unlimited")
+	flag.IntVar(&config.MaxOpenFiles, "max-open-files", config.MaxOpenFiles, "concurrent file writes and subprocesses allowed, 0 for unlimited; defaults below the open file rlimit")
+	flag.Var(&config.FileMode, "file-mode", "octal permissions for every file written, e.g. 0640")
+	flag.Var(&config.DirMode, "dir-mode", "octal permissions for every directory created, e.g. 0750")
+	flag.IntVar(&config.BatchSize, "batch-size", config.BatchSize, "write images.json and release vips caches every this many images, 0 to write once at the end")
+	flag.StringVar(&config.MetadataCSV, "metadata-csv", config.MetadataCSV, "CSV of path,title,caption,tags rows, paths relative to the gallery root and tags separated by semicolons")
+	flag.Var(&config.Tags, "tag", "tag recorded on every image of the run, may be repeated")
+	flag.StringVar(&config.PathBase, "path-base", config.PathBase, "record images.json paths relative to this directory, e.g. the web root, instead of as walked")
+	flag.StringVar(&config.TilesRef, "tiles-ref", config.TilesRef, "how images.json references tiles: path as recorded, relative to the images.json, url under -tiles-url-base, or iiif for the full rendition's IIIF image service at -tiles-url-base; defaults to url with -tiles-url-base, else path")
+	flag.StringVar(&config.TilesURLBase, "tiles-url-base", config.TilesURLBase, "absolute http(s) URL the gallery root, or -path-base, is served at, for -tiles-ref url or iiif")
+	flag.StringVar(&config.SQLite, "sqlite", config.SQLite, "also index every processed image in an images table of this sqlite database")
+	flag.StringVar(&config.Manifest, "manifest", config.Manifest, "append every processed image to this NDJSON file, for -merge-manifests to combine with other runs'")
+	flag.BoolVar(&config.MergeManifests, "merge-manifests", config.MergeManifests, "instead of processing, write the images.json of every directory in the -manifest files given as arguments")
+	flag.StringVar(&config.MergeOutput, "o", config.MergeOutput, "with -merge-manifests, also write all directories' images to this one JSON file")
+	flag.BoolVar(&config.JSONPretty, "json-pretty", config.JSONPretty, "indent images.json for readability, false writes it compact")
+	flag.BoolVar(&config.JSONGzip, "json-gzip", config.JSONGzip, "write gzip compressed images.json.gz instead of images.json")
+	flag.IntVar(&config.JSONPageSize, "json-page-size", config.JSONPageSize, "split each images.json into images-0.json, images-1.json, ... of this many images, described by images-index.json, 0 for a single images.json")
+	flag.StringVar(&config.JSONSort, "json-sort", config.JSONSort, "order of the images across -json-page-size pages: name, or date captured with undated images last")
+	flag.BoolVar(&config.ResumeFromJSON, "resume-from-json", config.ResumeFromJSON, "only re-encode thumbnails and display images of images already in images.json, trusting their recorded dimensions")
+	flag.StringVar(&config.OnlyDirs, "only-dirs", config.OnlyDirs, "only process the images in these comma separated directories below the root and their subdirectories, e.g. albums/rome,albums/oslo")
+	flag.StringVar(&config.InputGlob, "input-glob", config.InputGlob, "only process files whose path below the root matches this pattern, ** matching any directories, e.g. photos/2024/**/*.jpg")
+	flag.DurationVar(&config.MaxRuntime, "max-runtime", config.MaxRuntime, "stop taking new images after this long, finishing those in progress and writing images.json, e.g. 2h")
+	flag.DurationVar(&config.Since, "since", config.Since, "only process files modified within this duration, merging into existing images.json")
+}
+
+// validate checks flag values and derives the parsed forms used while processing
+func (c *Config) validate() error {
+	for _, format := range []*string{&c.ThumbFormat, &c.DisplayFormat, &c.FullFormat} {
+		if *format == "" {
+			*format = c.Format
+		}
+	}
+	formats := []string{c.Format, c.ThumbFormat, c.DisplayFormat}
+	// only full renditions can be served as the source is
+	if c.FullFormat != keepSourceFormat {
+		formats = append(formats, c.FullFormat)
+	}
+	for _, format := range formats {
+		if _, exists := formatExtensions[format]; !exists {
+			return fmt.Errorf("unsupported output format %q, must be jpeg, webp, png, avif or heic", format)
+		}
+	}
+
+	if c.Quality < 1 || c.Quality > 100 {
+		return fmt.Errorf("-quality must be between 1 and 100: %d", c.Quality)
+	}
+	// each format's quality scale differs, so they're tuned separately
+	for _, format := range []struct {
+		flag    string
+		quality *int
+	}{{"-jpeg-quality", &c.JpegQuality}, {"-webp-quality", &c.WebpQuality}, {"-heic-quality", &c.HeicQuality}, {"-avif-quality", &c.AvifQuality}} {
+		if *format.quality == 0 {
+			*format.quality = c.Quality
+		}
+		if *format.quality < 1 || *format.quality > 100 {
+			return fmt.Errorf("%s must be between 1 and 100: %d", format.flag, *format.quality)
+		}
+	}
+	// unset, each rendition uses its format's quality
+	for _, rendition := range []struct {
+		flag    string
+		quality int
+	}{{"-thumb-quality", c.ThumbQuality}, {"-display-quality", c.DisplayQuality}, {"-full-quality", c.FullQuality}} {
+		if rendition.quality < 0 || rendition.quality > 100 {
+			return fmt.Errorf("%s must be between 1 and 100: %d", rendition.flag, rendition.quality)
+		}
+	}
+
+	if c.QuantTable == "auto" {
+		c.quantTable = autoQuantTable
+	} else {
+		table, err := strconv.Atoi(c.QuantTable)
+		if err != nil || table < 0 || table > maxQuantTable {
+			return fmt.Errorf("-quant-table must be between 0 and %d or auto: %q", maxQuantTable, c.QuantTable)
+		}
+		c.quantTable = table
+	}
+
+	if c.TrimThreshold <= 0 || c.TrimThreshold > 255 {
+		return fmt.Errorf("-trim-threshold must be above 0 and at most 255: %g", c.TrimThreshold)
+	}
+	if c.TrimTolerance < 0 || c.TrimTolerance > 255 {
+		return fmt.Errorf("-trim-tolerance must be between 0 and 255: %g", c.TrimTolerance)
+	}
+
+	if c.MaxDecodePixels < 0 {
+		return fmt.Errorf("-max-decode-pixels must not be negative: %d", c.MaxDecodePixels)
+	}
+	if c.PdfDpi < 0 {
+		return fmt.Errorf("-pdf-dpi must not be negative: %d", c.PdfDpi)
+	}
+	if c.SvgDpi < 0 {
+		return fmt.Errorf("-svg-dpi must not be negative: %d", c.SvgDpi)
+	}
+	if c.SvgWidth < 0 {
+		return fmt.Errorf("-svg-width must not be negative: %d", c.SvgWidth)
+	}
+	if c.SvgWidth > 0 && c.SvgDpi > 0 {
+		return fmt.Errorf("-svg-width and -svg-dpi both size SVG sources")
+	}
+
+	if c.MinDimension < 1 {
+		return fmt.Errorf("-min-dimension must be at least 1: %d", c.MinDimension)
+	}
+
+	if c.SlideHeight <= 0 {
+		return fmt.Errorf("-slide-height must be positive: %d", c.SlideHeight)
+	}
+	if c.SlideMaxWidth <= 0 {
+		return fmt.Errorf("-slide-max-width must be positive: %d", c.SlideMaxWidth)
+	}
+	if c.ThumbMaxWidth <= 0 {
+		return fmt.Errorf("-thumb-max-width must be positive: %d", c.ThumbMaxWidth)
+	}
+	if c.SlideMinSource == 0 {
+		c.SlideMinSource = c.SlideHeight
+	}
+	if c.SlideMinSource < c.SlideHeight {
+		// anything smaller would be upscaled into the display image
+		return fmt.Errorf("-slide-min-source must be at least -slide-height: %d < %d", c.SlideMinSource, c.SlideHeight)
+	}
+	if c.RecompressFloor < 1 || c.RecompressFloor > 100 {
+		return fmt.Errorf("-recompress-floor must be between 1 and 100: %d", c.RecompressFloor)
+	}
+	if c.QualityCurve == "default" {
+		c.QualityCurve = defaultQualityCurve
+	}
+	if c.QualityCurve == "flat" {
+		c.QualityCurve = ""
+	}
+	if c.QualityCurve != "" {
+		curve, err := parseQualityCurve(c.QualityCurve)
+		if err != nil {
+			return fmt.Errorf("-quality-curve: %w", err)
+		}
+		c.qualityCurve = curve
+	}
+
+	if c.ThumbRatio != "" {
+		ratio, err := parseRatio(c.ThumbRatio)
+		if err != nil {
+			return fmt.Errorf("-thumb-ratio: %w", err)
+		}
+		c.thumbRatio = ratio
+	}
+	if _, exists := thumbGravities[c.ThumbGravity]; !exists {
+		return fmt.Errorf("-thumb-gravity must be north, south, center or attention: %q", c.ThumbGravity)
+	}
+	if _, exists := interestingStrategies[c.Interesting]; !exists {
+		return fmt.Errorf("-interesting must be none, centre, entropy, attention, low or high: %q", c.Interesting)
+	}
+	if !thumbBackgrounds[c.ThumbBackground] {
+		return fmt.Errorf("-thumb-background must be none, blur or checker: %q", c.ThumbBackground)
+	}
+	if c.ThumbBackground == "blur" && c.ThumbRatio == "" {
+		return fmt.Errorf("-thumb-background blur requires -thumb-ratio, other thumbnails already fit uncropped")
+	}
+	// only then are the renditions thumbnails load from left transparent
+	if c.ThumbBackground == "checker" && !c.PreserveAlpha {
+		return fmt.Errorf("-thumb-background checker requires -preserve-alpha, without it thumbnails are flattened before there's anything to show")
+	}
+	if c.CheckerSize < 1 {
+		return fmt.Errorf("-checker-size must be positive: %d", c.CheckerSize)
+	}
+	if c.Interesting != "none" && c.ThumbRatio == "" {
+		return fmt.Errorf("-interesting requires -thumb-ratio, uncropped thumbnails have nothing to crop")
+	}
+	if c.AutoLevelsStrength < 0 || c.AutoLevelsStrength > 1 {
+		return fmt.Errorf("-autolevels-strength must be between 0 and 1: %g", c.AutoLevelsStrength)
+	}
+	if c.AutoLevelsFull && !c.AutoLevels {
+		return fmt.Errorf("-autolevels-full requires -autolevels")
+	}
+	if !whiteBalances[c.AutoWB] {
+		return fmt.Errorf("-auto-wb must be none, gray-world or white-patch: %s", c.AutoWB)
+	}
+	if c.AutoWBFull && c.AutoWB == "none" {
+		return fmt.Errorf("-auto-wb-full requires -auto-wb")
+	}
+	if c.SquareTolerance < 0 {
+		return fmt.Errorf("-square-tolerance must not be negative: %g", c.SquareTolerance)
+	}
+	if c.ThumbBorder < 0 {
+		return fmt.Errorf("-thumb-border must not be negative: %d", c.ThumbBorder)
+	}
+	if c.SizesOnly && len(c.Sizes) == 0 {
+		return fmt.Errorf("-sizes-only requires -size")
+	}
+	// those need the thumbnail or display image -sizes-only doesn't write
+	if c.SizesOnly && (c.SquareThumbs || c.ThumbsFromDisplay || c.SkipSlides) {
+		return fmt.Errorf("-sizes-only can't be combined with -square-thumbs, -thumbs-from-display or -skip-slides")
+	}
+
+	if !alphaFormats[c.AlphaFormat] {
+		return fmt.Errorf("-alpha-format must be webp, png or avif: %q", c.AlphaFormat)
+	}
+	if c.DedupeLink != "symlink" && c.DedupeLink != "hardlink" {
+		return fmt.Errorf("-dedupe-link must be symlink or hardlink: %q", c.DedupeLink)
+	}
+
+	if c.OutputLayout != "mirrored" && c.OutputLayout != "flat" {
+		return fmt.Errorf("-output-layout must be mirrored or flat: %q", c.OutputLayout)
+	}
+	if c.Interactive && !c.DeleteOriginalPNG {
+		return fmt.Errorf("-i requires -delete-original-png")
+	}
+	if c.ShardDepth < 0 || c.ShardDepth > maxShardDepth {
+		return fmt.Errorf("-shard-depth must be between 0 and %d: %d", maxShardDepth, c.ShardDepth)
+	}
+	if c.RenameSource && !c.SlugifyNames {
+		return fmt.Errorf("-rename-source requires -slugify-names")
+	}
+	if c.TileUpscaleTo < 0 {
+		return fmt.Errorf("-tile-upscale-to must not be negative: %d", c.TileUpscaleTo)
+	}
+	if c.TileMaxLevel < 0 {
+		return fmt.Errorf("-tile-max-level must not be negative: %d", c.TileMaxLevel)
+	}
+
+	if c.DirSummary != "" && !c.FileSizes {
+		return fmt.Errorf("-dir-summary requires -file-sizes, which records the output bytes it totals")
+	}
+	if c.MaxFailures != "" {
+		limit, err := parseMaxFailures(c.MaxFailures)
+		if err != nil {
+			return fmt.Errorf("-max-failures %w", err)
+		}
+		c.maxFailures = limit
+	}
+	if c.MaxRuntime < 0 {
+		return fmt.Errorf("-max-runtime must not be negative: %s", c.MaxRuntime)
+	}
+	if c.Since < 0 {
+		return fmt.Errorf("-since must not be negative: %s", c.Since)
+	}
+
+	// the retried report is brought up to date unless another one is asked for
+	if c.RetryFailed != "" && c.ErrorReport == "" {
+		c.ErrorReport = c.RetryFailed
+	}
+
+	if c.MergeOutput != "" && !c.MergeManifests {
+		return fmt.Errorf("-o needs -merge-manifests")
+	}
+
+	if c.ServeOnly && c.Serve == "" {
+		return fmt.Errorf("-serve-only needs -serve")
+	}
+
+	if _, ok := logLevels[c.LogLevel]; !ok {
+		return fmt.Errorf("-log-level must be debug, info, warn or error: %s", c.LogLevel)
+	}
+
+	if c.Clean && (c.Since > 0 || c.InputGlob != "" || c.OnlyDirs != "" || c.RetryFailed != "") {
+		return fmt.Errorf("-clean needs every source walked, not just -since, -input-glob, -only-dirs or -retry-failed ones")
+	}
+	if c.DryRun && !c.Clean {
+		return fmt.Errorf("-dry-run only applies to -clean")
+	}
+
+	if _, exists := checksumAlgorithms[c.ChecksumAlgorithm]; !exists {
+		return fmt.Errorf("-checksum-algorithm must be sha256, sha1, sha512 or md5: %s", c.ChecksumAlgorithm)
+	}
+	if c.PurgeList != "" && c.ChecksumManifest == "" {
+		return fmt.Errorf("-purge-list requires -checksum-manifest")
+	}
+
+	if c.JSONPageSize < 0 {
+		return fmt.Errorf("-json-page-size must not be negative: %d", c.JSONPageSize)
+	}
+	if !jsonSorts[c.JSONSort] {
+		return fmt.Errorf("-json-sort must be name or date: %s", c.JSONSort)
+	}
+
+	if !collisionStrategies[c.RenameOnCollision] {
+		return fmt.Errorf("-rename-on-collision must be error, suffix or skip: %s", c.RenameOnCollision)
+	}
+
+	if !schedules[c.Schedule] {
+		return fmt.Errorf("-schedule must be walk or largest-first: %s", c.Schedule)
+	}
+
+	if c.Benchmark < 0 {
+		return fmt.Errorf("-benchmark must not be negative: %d", c.Benchmark)
+	}
+	if c.Benchmark > 0 && (c.RenameSource || c.DeleteOriginalPNG || c.ResumeFromJSON) {
+		return fmt.Errorf("-benchmark can't be combined with -rename-source, -delete-original-png or -resume-from-json, which touch the gallery itself")
+	}
+
+	if c.WriteRate < 0 {
+		return fmt.Errorf("-write-rate must not be negative: %g", c.WriteRate)
+	}
+
+	if c.Workers < 0 {
+		return fmt.Errorf("-workers must not be negative: %d", c.Workers)
+	}
+	if c.VipsConcurrency < 0 {
+		return fmt.Errorf("-vips-concurrency must not be negative: %d", c.VipsConcurrency)
+	}
+	if c.VipsConcurrency > 0 && c.WorkerAffinity {
+		return fmt.Errorf("-vips-concurrency and -worker-affinity both set the vips threads")
+	}
+	// vips takes a byte count with an optional b, k, m or g unit
+	if c.VipsDiscThreshold != "" {
+		size := strings.TrimRight(strings.ToLower(c.VipsDiscThreshold), "bkmg")
+		if _, err := strconv.ParseUint(size, 10, 64); err != nil || len(c.VipsDiscThreshold)-len(size) > 1 {
+			return fmt.Errorf("-vips-disc-threshold must be a size like 500m: %q", c.VipsDiscThreshold)
+		}
+	}
+	if c.InputGlob != "" {
+		glob, err := parseInputGlob(c.InputGlob)
+		if err != nil {
+			return fmt.Errorf("-input-glob: %w", err)
+		}
+		c.inputGlob = glob
+	}
+	if c.OnlyDirs != "" {
+		dirs, err := parseOnlyDirs(c.OnlyDirs)
+		if err != nil {
+			return fmt.Errorf("-only-dirs: %w", err)
+		}
+		c.onlyDirs = dirs
+	}
+
+	if c.WalkConcurrency < 1 {
+		return fmt.Errorf("-walk-concurrency must be at least 1: %d", c.WalkConcurrency)
+	}
+
+	if c.ContactSheetColumns < 1 || c.ContactSheetRows < 1 {
+		return fmt.Errorf("-contact-sheet-columns and -contact-sheet-rows must be positive: %d, %d", c.ContactSheetColumns, c.ContactSheetRows)
+	}
+	if c.PHashThreshold < 0 || c.PHashThreshold > 64 {
+		return fmt.Errorf("-phash-threshold must be between 0 and 64: %d", c.PHashThreshold)
+	}
+	if c.BatchSize < 0 {
+		return fmt.Errorf("-batch-size must not be negative: %d", c.BatchSize)
+	}
+	if c.MaxOpenFiles < 0 {
+		return fmt.Errorf("-max-open-files must not be negative: %d", c.MaxOpenFiles)
+	}
+
+	if c.PathBase != "" {
+		pathBase, err := filepath.Abs(c.PathBase)
+		if err != nil {
+			return fmt.Errorf("-path-base: %w", err)
+		}
+		c.pathBase = pathBase
+	}
+
+	if c.TilesRef == "" {
+		c.TilesRef = "path"
+		if c.TilesURLBase != "" {
+			c.TilesRef = "url"
+		}
+	}
+	if !tilesRefStyles[c.TilesRef] {
+		return fmt.Errorf("-tiles-ref must be path, relative, url or iiif: %s", c.TilesRef)
+	}
+	if c.OSDTileSources && c.TilesRef == "iiif" {
+		return fmt.Errorf("-osd-tile-sources needs the tiles referenced, -tiles-ref iiif references an image service")
+	}
+	if (c.TilesRef == "url" || c.TilesRef == "iiif") != (c.TilesURLBase != "") {
+		return fmt.Errorf("-tiles-url-base is needed with, and only with, -tiles-ref url or iiif")
+	}
+	if c.TilesURLBase != "" {
+		base, err := url.Parse(c.TilesURLBase)
+		if err != nil {
+			return fmt.Errorf("-tiles-url-base: %w", err)
+		}
+		if (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" || base.RawQuery != "" || base.Fragment != "" {
+			return fmt.Errorf("-tiles-url-base must be an absolute http or https URL: %s", c.TilesURLBase)
+		}
+		c.tilesURLBase = base
+	}
+
+	color, err := parseHexColor(c.ThumbBorderColor)
+	if err != nil {
+		return fmt.Errorf("-thumb-border-color: %w", err)
+	}
+	c.thumbBorderColor = color
+
+	checkerColors := strings.Split(c.CheckerColors, ",")
+	if len(checkerColors) != 2 {
+		return fmt.Errorf("-checker-colors must be two hex colors: %q", c.CheckerColors)
+	}
+	for i, checkerColor := range checkerColors {
+		color, err := parseHexColor(checkerColor)
+		if err != nil {
+			return fmt.Errorf("-checker-colors: %w", err)
+		}
+		c.checkerColors[i] = color
+	}
+
+	return nil
+}
+
+// thumbGravities map -thumb-gravity to the vips crop strategy. vips crops
+// along whichever axis overflows, so north keeps the top of tall crops and
+// the left of wide ones, south the bottom or right.
+var thumbGravities = map[string]vips.Interesting{
+	"north":     vips.InterestingLow,
+	"south":     vips.InterestingHigh,
+	"center":    vips.InterestingCentre,
+	"attention": vips.InterestingAttention,
+}
+
+// interestingStrategies map -interesting to the vips crop strategy, none
+// leaving the choice to -thumb-gravity
+var interestingStrategies = map[string]vips.Interesting{
+	"none":      vips.InterestingNone,
+	"centre":    vips.InterestingCentre,
+	"entropy":   vips.InterestingEntropy,
+	"attention": vips.InterestingAttention,
+	"low":       vips.InterestingLow,
+	"high":      vips.InterestingHigh,
+}
+
+// parseRatio parses WxH into W/H
+func parseRatio(ratio string) (float64, error) {
+	w, h, found := strings.Cut(ratio, "x")
+	if !found {
+		return 0, fmt.Errorf("invalid ratio %q, want WxH", ratio)
+	}
+
+	width, err := strconv.ParseFloat(w, 64)
+	if err != nil || width <= 0 {
+		return 0, fmt.Errorf("invalid ratio %q, want WxH", ratio)
+	}
+	height, err := strconv.ParseFloat(h, 64)
+	if err != nil || height <= 0 {
+		return 0, fmt.Errorf("invalid ratio %q, want WxH", ratio)
+	}
+
+	return width / height, nil
+}
+
+func parseHexColor(hex string) (*vips.Color, error) {
+	hex = strings.TrimPrefix(hex, "#")
+	if len(hex) != 6 {
+		return nil, fmt.Errorf("invalid hex color %q", hex)
+	}
+
+	rgb, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex color %q", hex)
+	}
+
+	return &vips.Color{R: uint8(rgb >> 16), G: uint8(rgb >> 8), B: uint8(rgb)}, nil
+}
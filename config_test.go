@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateThumbBackground(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+	defaults := config
+
+	tests := []struct {
+		background    string
+		thumbRatio    string
+		preserveAlpha bool
+		failure       string
+	}{
+		{"none", "", false, ""},
+		{"blur", "", false, "requires -thumb-ratio"},
+		{"blur", "4x3", false, ""},
+		{"checker", "", false, "requires -preserve-alpha"},
+		{"checker", "", true, ""},
+	}
+	for _, test := range tests {
+		c := defaults
+		c.ThumbBackground = test.background
+		c.ThumbRatio = test.thumbRatio
+		c.PreserveAlpha = test.preserveAlpha
+		err := c.validate()
+		if test.failure == "" && err != nil {
+			t.Errorf("-thumb-background %s, -thumb-ratio %q, -preserve-alpha %t: %s", test.background, test.thumbRatio, test.preserveAlpha, err)
+		}
+		if test.failure != "" && (err == nil || !strings.Contains(err.Error(), test.failure)) {
+			t.Errorf("-thumb-background %s, -thumb-ratio %q, -preserve-alpha %t: error %v, want one that %s", test.background, test.thumbRatio, test.preserveAlpha, err, test.failure)
+		}
+	}
+}
+
+func TestValidateAvif(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+	defaults := config
+
+	tests := []struct {
+		format      string
+		quality     int
+		avifQuality int
+		want        int
+		failure     string
+	}{
+		{"avif", 75, 0, 75, ""},
+		{"avif", 75, 50, 50, ""},
+		{"jpeg", 75, 50, 50, ""},
+		{"avif", 75, 101, 0, "-avif-quality must be between 1 and 100"},
+		{"av1", 75, 0, 0, "must be jpeg, webp, png, avif or heic"},
+	}
+	for _, test := range tests {
+		config = defaults
+		config.Format = test.format
+		config.Quality = test.quality
+		config.AvifQuality = test.avifQuality
+		err := config.validate()
+		if test.failure != "" {
+			if err == nil || !strings.Contains(err.Error(), test.failure) {
+				t.Errorf("-format %s, -avif-quality %d: error %v, want one that says %s", test.format, test.avifQuality, err, test.failure)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("-format %s, -avif-quality %d: %s", test.format, test.avifQuality, err)
+			continue
+		}
+		if quality := qualityFor("avif"); quality != test.want {
+			t.Errorf("-quality %d, -avif-quality %d: avif encodes at %d, want %d", test.quality, test.avifQuality, quality, test.want)
+		}
+		if test.format == "avif" && formatExtensions[config.ThumbFormat] != ".avif" {
+			t.Errorf("-format avif: thumbnails are %s", config.ThumbFormat)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"path/filepath"
+	"sort"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// contactSheetCell is the box in px each thumbnail is fitted into
+const contactSheetCell = 240
+
+// contactSheetLabel is the px under each thumbnail for its filename
+const contactSheetLabel = 28
+
+const contactSheetMargin = 8
+
+var contactSheetBackground = &vips.Color{R: 255, G: 255, B: 255}
+
+// writeContactSheets lays out a directory's thumbnails in grids of
+// -contact-sheet-columns by -contact-sheet-rows, one contact-sheet.jpg per
+// page, returning the sheet paths
+func writeContactSheets(dir string, imageData map[string]*ImageData) ([]string, error) {
+	names := make([]string, 0, len(imageData))
+	for name, data := range imageData {
+		if data.ThumbPath != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	perPage := config.ContactSheetColumns * config.ContactSheetRows
+
+	var sheets []string
+	for page := 0; page*perPage < len(names); page++ {
+		pageNames := names[page*perPage : min((page+1)*perPage, len(names))]
+
+		sheetPath := filepath.Join(dir, "contact-sheet.jpg")
+		if page > 0 {
+			sheetPath = filepath.Join(dir, fmt.Sprintf("contact-sheet-%d.jpg", page+1))
+		}
+
+		logger.Infof("Generating contact sheet %s", sheetPath)
+		if err := writeContactSheet(sheetPath, pageNames, imageData); err != nil {
+			return sheets, err
+		}
+		sheets = append(sheets, sheetPath)
+	}
+
+	return sheets, nil
+}
+
+func writeContactSheet(sheetPath string, names []string, imageData map[string]*ImageData) error {
+	cells := make([]*vips.ImageRef, 0, len(names))
+	defer func() {
+		for _, cell := range cells {
+			cell.Close()
+		}
+	}()
+
+	for _, name := range names {
+		cell, err := contactSheetCellImage(localPath(imageData[name].ThumbPath), name)
+		if err != nil {
+			return err
+		}
+		cells = append(cells, cell)
+	}
+
+	sheet, err := cells[0].Copy()
+	if err != nil {
+		return err
+	}
+	defer sheet.Close()
+
+	if err := sheet.ArrayJoin(cells[1:], config.ContactSheetColumns); err != nil {
+		return err
+	}
+	err = sheet.EmbedBackground(contactSheetMargin, contactSheetMargin,
+		sheet.Width()+2*contactSheetMargin, sheet.Height()+2*contactSheetMargin, contactSheetBackground)
+	if err != nil {
+		return err
+	}
+
+	sheetBytes, err := exportImage(sheet, "jpeg", qualityFor("jpeg"))
+	if err != nil {
+		return err
+	}
+
+	outputPaths.claim(sheetPath, filepath.Dir(sheetPath))
+	if err := writeFile(sheetPath, sheetBytes); err != nil {
+		return err
+	}
+	checksums.record(sheetPath, sheetBytes)
+	return nil
+}
+
+// contactSheetCellImage is a thumbnail centred in its cell with the name below
+func contactSheetCellImage(thumbPath string, name string) (*vips.ImageRef, error) {
+	cell, err := vips.NewThumbnailFromFile(thumbPath, contactSheetCell, contactSheetCell, vips.InterestingNone)
+	if err != nil {
+		return nil, err
+	}
+
+	// every cell needs the same bands for the join
+	err = cell.ToColorSpace(vips.InterpretationSRGB)
+	if err == nil && cell.HasAlpha() {
+		err = cell.Flatten(contactSheetBackground)
+	}
+	if err == nil {
+		err = cell.EmbedBackground((contactSheetCell-cell.Width())/2, (contactSheetCell-cell.Height())/2,
+			contactSheetCell, contactSheetCell+contactSheetLabel, contactSheetBackground)
+	}
+	if err == nil {
+		// label text is pango markup
+		err = cell.Label(&vips.LabelParams{
+			Text:      html.EscapeString(name),
+			Font:      vips.DefaultFont,
+			Width:     vips.ValueOf(contactSheetCell - 2*contactSheetMargin),
+			Height:    vips.ValueOf(contactSheetLabel - contactSheetMargin),
+			OffsetX:   vips.ValueOf(contactSheetMargin),
+			OffsetY:   vips.ValueOf(contactSheetCell + contactSheetMargin/2),
+			Opacity:   1,
+			Color:     vips.Color{},
+			Alignment: vips.AlignCenter,
+		})
+	}
+	if err != nil {
+		cell.Close()
+		return nil, err
+	}
+
+	return cell, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// imageCounts is the -count-only breakdown
+type imageCounts struct {
+	images     int
+	slides     int
+	tiles      int
+	unreadable int
+	bytes      int64
+}
+
+// countImages reads just the headers of the walked images to report how much
+// work a full run would be, without decoding pixels or writing anything
+func countImages(images <-chan *ImageData) imageCounts {
+	var counts imageCounts
+
+	for imageData := range images {
+		counts.images++
+
+		if imageData.source != nil {
+			counts.bytes += int64(len(imageData.source))
+		} else if info, err := os.Stat(imageData.path); err == nil {
+			counts.bytes += info.Size()
+		}
+
+		// RAW needs developing before the dimensions are known
+		if isRaw(imageData.path) {
+			counts.unreadable++
+			continue
+		}
+
+		// loading is lazy, this only reads the header
+		image, err := loadSource(imageData)
+		if err != nil {
+			logger.Warnf("%s: %s", imageData.path, err)
+			counts.unreadable++
+			continue
+		}
+		width, height := image.Width(), image.Height()
+		image.Close()
+
+		if !config.SkipSlides && (width > config.SlideMinSource || height > config.SlideMinSource) {
+			counts.slides++
+		}
+		if !config.SkipTiles && (width > config.TileMinDimension || height > config.TileMinDimension) {
+			counts.tiles++
+		}
+	}
+
+	return counts
+}
+
+func (c imageCounts) print() {
+	fmt.Printf("images:      %d\n", c.images)
+	fmt.Printf("slides:      %d\n", c.slides)
+	fmt.Printf("tiles:       %d\n", c.tiles)
+	if c.unreadable > 0 {
+		fmt.Printf("no header:   %d\n", c.unreadable)
+	}
+	fmt.Printf("input bytes: %d (%.1f MiB)\n", c.bytes, float64(c.bytes)/(1<<20))
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// cropSidecarSuffix names a source's crop sidecar, photo.jpg has photo.crop.json
+const cropSidecarSuffix = ".crop.json"
+
+// CropRect is a crop sidecar's rectangle, in source px as stored
+type CropRect struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+// readCropSidecar loads the crop rectangle beside imageData's source, nil
+// when there is none or it can't be read
+func readCropSidecar(imageData *ImageData) *CropRect {
+	sidecarPath := strings.TrimSuffix(imageData.path, filepath.Ext(imageData.path)) + cropSidecarSuffix
+	sidecar, err := os.ReadFile(sidecarPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Error(err)
+		}
+		return nil
+	}
+
+	var crop CropRect
+	if err := json.Unmarshal(sidecar, &crop); err != nil {
+		logger.Warnf("Ignoring crop sidecar %s: %s", sidecarPath, err)
+		return nil
+	}
+	return &crop
+}
+
+// applyCrop crops image to imageData's sidecar rectangle, ignoring one that
+// doesn't lie within the image
+func applyCrop(imageData *ImageData, image *vips.ImageRef) error {
+	crop := imageData.Crop
+	if crop.X < 0 || crop.Y < 0 || crop.W < 1 || crop.H < 1 || crop.X+crop.W > image.Width() || crop.Y+crop.H > image.Height() {
+		logger.Warnf("Ignoring crop %+v of %s, it isn't within %dx%d", *crop, imageData.path, image.Width(), image.Height())
+		imageData.Crop = nil
+		return nil
+	}
+
+	logger.Infof("Cropping %s to %dx%d at %d,%d", imageData.path, crop.W, crop.H, crop.X, crop.Y)
+	if err := image.ExtractArea(crop.X, crop.Y, crop.W, crop.H); err != nil {
+		return err
+	}
+	imageData.Cropped = true
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// dedupeDirName is the directory under the output root holding the shared
+// copy of each deduplicated derivative, named by its content hash. Being
+// named by content, a shared copy is never rewritten, so regenerating one
+// image with -force can't change what the others linked to it show.
+const dedupeDirName = "_dedupe"
+
+// derivativeLinks finds byte-identical derivatives for -dedupe-derivatives,
+// linking every one after the first to a shared copy. Only the results loop
+// uses it, so it isn't locked.
+type derivativeLinks struct {
+	first map[[sha256.Size]byte]string
+}
+
+func newDerivativeLinks() *derivativeLinks {
+	return &derivativeLinks{first: map[[sha256.Size]byte]string{}}
+}
+
+// dedupe links each of imageData's derivatives that duplicates an earlier
+// one, pointing imageData at the shared copy. Sources are never linked.
+func (d *derivativeLinks) dedupe(imageData *ImageData) {
+	derivatives := []*string{&imageData.ThumbPath, &imageData.ThumbSquarePath, &imageData.DisplayPath, &imageData.PreviewPath, &imageData.FullPath}
+	for i := range imageData.PagePaths {
+		derivatives = append(derivatives, &imageData.PagePaths[i])
+	}
+	for _, derivative := range derivatives {
+		d.dedupePath(imageData, derivative)
+	}
+
+	for name, sized := range imageData.Sizes {
+		d.dedupePath(imageData, &sized.Path)
+		imageData.Sizes[name] = sized
+	}
+}
+
+func (d *derivativeLinks) dedupePath(imageData *ImageData, derivative *string) {
+	if *derivative == "" || *derivative == imageData.path {
+		return
+	}
+	shared, err := d.link(*derivative)
+	if err != nil {
+		logger.Errorf("-dedupe-derivatives %s: %s", *derivative, err)
+		return
+	}
+	*derivative = shared
+}
+
+// link replaces path with a -dedupe-link to the shared copy of the first
+// derivative with the same content, returning the path now to record
+func (d *derivativeLinks) link(path string) (string, error) {
+	hash, err := fileHash(path)
+	if err != nil {
+		return "", err
+	}
+
+	first, seen := d.first[hash]
+	if !seen {
+		d.first[hash] = path
+		return path, nil
+	}
+	if first == path {
+		return path, nil
+	}
+
+	shared, err := sharedCopy(first, hash)
+	if err != nil {
+		return "", err
+	}
+	// already linked by an earlier run
+	if sameFile(path, shared) {
+		return shared, nil
+	}
+
+	// linked beside and renamed over, so path is never left missing
+	linkPath := path + ".dedupe"
+	os.Remove(linkPath)
+	if config.DedupeLink == "hardlink" {
+		err = os.Link(shared, linkPath)
+	} else {
+		var target string
+		target, err = filepath.Rel(filepath.Dir(path), shared)
+		if err == nil {
+			err = os.Symlink(target, linkPath)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := os.Rename(linkPath, path); err != nil {
+		os.Remove(linkPath)
+		return "", err
+	}
+
+	logger.Infof("Linked %s to identical %s", path, shared)
+	return shared, nil
+}
+
+// sharedCopy is the path of the shared copy of the content hash, first
+// having it. It's made from first if there isn't one yet, hard linked where
+// the filesystem allows and copied where not.
+func sharedCopy(first string, hash [sha256.Size]byte) (string, error) {
+	shared := benchmarkPath(filepath.Join(config.root, dedupeDirName, hex.EncodeToString(hash[:])+filepath.Ext(first)))
+	if _, err := os.Lstat(shared); err == nil {
+		return shared, nil
+	}
+	if err := makeDirs(filepath.Dir(shared)); err != nil {
+		return "", err
+	}
+
+	// first may itself link to an earlier shared copy
+	source, err := filepath.EvalSymlinks(first)
+	if err != nil {
+		return "", err
+	}
+	partial := shared + ".partial"
+	os.Remove(partial)
+	if err := os.Link(source, partial); err != nil {
+		data, err := os.ReadFile(source)
+		if err != nil {
+			return "", err
+		}
+		if err := writeFile(partial, data); err != nil {
+			return "", err
+		}
+	}
+	if err := os.Rename(partial, shared); err != nil {
+		os.Remove(partial)
+		return "", err
+	}
+	checksums.recordFile(shared)
+	return shared, nil
+}
+
+// sameFile reports whether a and b are, or link to, the same file
+func sameFile(a string, b string) bool {
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bInfo, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(aInfo, bInfo)
+}
+
+func fileHash(path string) ([sha256.Size]byte, error) {
+	var hash [sha256.Size]byte
+
+	file, err := os.Open(path)
+	if err != nil {
+		return hash, err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return hash, err
+	}
+	copy(hash[:], hasher.Sum(nil))
+	return hash, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDedupeDerivatives(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+
+	for _, link := range []string{"symlink", "hardlink"} {
+		root := t.TempDir()
+		config.root = root
+		config.DedupeLink = link
+		write := func(name string, contents string) string {
+			path := filepath.Join(root, name)
+			if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+			return path
+		}
+
+		first := &ImageData{
+			path:      filepath.Join(root, "a.jpg"),
+			ThumbPath: write("a-thumbnail.jpg", "blank"),
+			PagePaths: []string{write("a-page-0.jpg", "cover")},
+			Sizes:     sizedMap{"small": {Path: write("a-small.jpg", "tiny")}},
+		}
+		second := &ImageData{
+			path:        filepath.Join(root, "b.jpg"),
+			ThumbPath:   write("b-thumbnail.jpg", "blank"),
+			DisplayPath: write("b-display.jpg", "unique"),
+			PagePaths:   []string{write("b-page-0.jpg", "cover")},
+			Sizes:       sizedMap{"small": {Path: write("b-small.jpg", "tiny"), Width: 10}},
+		}
+		links := newDerivativeLinks()
+		links.dedupe(first)
+		links.dedupe(second)
+
+		if first.ThumbPath != filepath.Join(root, "a-thumbnail.jpg") {
+			t.Errorf("%s: the first thumbnail was moved to %s", link, first.ThumbPath)
+		}
+		if second.DisplayPath != filepath.Join(root, "b-display.jpg") {
+			t.Errorf("%s: the unique display image was linked to %s", link, second.DisplayPath)
+		}
+		for _, deduped := range []string{second.ThumbPath, second.PagePaths[0], second.Sizes["small"].Path} {
+			if filepath.Dir(deduped) != filepath.Join(root, dedupeDirName) {
+				t.Errorf("%s: %s isn't a shared copy", link, deduped)
+			}
+		}
+		if second.Sizes["small"].Width != 10 {
+			t.Errorf("%s: deduping lost the -size dimensions", link)
+		}
+		if !sameFile(filepath.Join(root, "b-thumbnail.jpg"), second.ThumbPath) {
+			t.Errorf("%s: b-thumbnail.jpg isn't linked to %s", link, second.ThumbPath)
+		}
+
+		// a -force rerun rewriting the first leaves the shared copy be
+		if err := writeFile(first.ThumbPath, []byte("regenerated")); err != nil {
+			t.Fatal(err)
+		}
+		for _, path := range []string{second.ThumbPath, filepath.Join(root, "b-thumbnail.jpg")} {
+			if contents, err := os.ReadFile(path); err != nil || string(contents) != "blank" {
+				t.Errorf("%s: %s reads %q, %v after the first was regenerated", link, path, contents, err)
+			}
+		}
+
+		// a later run finds them linked already
+		rerun := newDerivativeLinks()
+		rerun.dedupe(&ImageData{path: first.path, ThumbPath: write("a-thumbnail.jpg", "blank")})
+		again := &ImageData{path: second.path, ThumbPath: filepath.Join(root, "b-thumbnail.jpg")}
+		rerun.dedupe(again)
+		if again.ThumbPath != second.ThumbPath {
+			t.Errorf("%s: rerun recorded %s, want %s", link, again.ThumbPath, second.ThumbPath)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"sync"
+)
+
+// dirSummary is a directory's -dir-summary entry, from its images.json as
+// written
+type dirSummary struct {
+	Count           int    `json:"count"`
+	OutputBytes     int64  `json:"output_bytes"`
+	Tiled           int    `json:"tiled"`
+	EarliestCapture string `json:"earliest_capture,omitempty"`
+	LatestCapture   string `json:"latest_capture,omitempty"`
+}
+
+// dirSummaries collects the -dir-summary of every directory written, the
+// last write of one standing
+type dirSummaries struct {
+	sync.Mutex
+	dirs map[string]dirSummary
+}
+
+var dirStats = dirSummaries{dirs: map[string]dirSummary{}}
+
+// record summarises the images of dir's images.json. The output bytes are
+// those -file-sizes recorded.
+func (s *dirSummaries) record(dir string, imageData map[string]*ImageData) {
+	var summary dirSummary
+	for _, data := range imageData {
+		summary.Count++
+		summary.OutputBytes += data.ThumbSize + data.DisplaySize + data.FullSize + data.TilesSize
+		if data.Tiles != "" {
+			summary.Tiled++
+		}
+		// capture dates are all one layout, so compare as strings
+		if date := data.CaptureDate; date != "" {
+			if summary.EarliestCapture == "" || date < summary.EarliestCapture {
+				summary.EarliestCapture = date
+			}
+			if date > summary.LatestCapture {
+				summary.LatestCapture = date
+			}
+		}
+	}
+
+	key := dir
+	if relDir, err := filepath.Rel(config.root, dir); err == nil {
+		key = filepath.ToSlash(relDir)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.dirs[key] = summary
+}
+
+// writeReport saves the summaries to reportPath keyed by directory
+// relative to the root
+func (s *dirSummaries) writeReport(reportPath string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	reportJson, err := json.MarshalIndent(s.dirs, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(reportPath, reportJson)
+}
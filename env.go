@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// envPrefix starts the environment variable of every flag, -thumb-format
+// being GALLERY_THUMB_FORMAT
+const envPrefix = "GALLERY_"
+
+// envName is the environment variable setting flagName
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// applyEnvironment sets the flags that weren't given on the command line
+// from their environment variables. It runs before applyProfile, which
+// then leaves them be as it does explicit flags.
+func applyEnvironment() error {
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		value, set := os.LookupEnv(envName(f.Name))
+		if !set || explicit[f.Name] || err != nil {
+			return
+		}
+		if setErr := flag.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("%s: -%s: %w", envName(f.Name), f.Name, setErr)
+		}
+	})
+	return err
+}
+
+// usage is the flag package's usage with the environment variables noted
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprintf(flag.CommandLine.Output(), "\nA flag not given is read from its environment variable, if set: %s and its name in upper case with - as _, e.g. %s for -thumb-format. Flags take precedence over the environment, and both over -profile.\n", envPrefix, envName("thumb-format"))
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// event types passed to the event hook
+const (
+	eventImageStarted      = "image-started"
+	eventDerivativeWritten = "derivative-written"
+	eventImageCompleted    = "image-completed"
+	eventImageSkipped      = "image-skipped"
+	eventImageFailed       = "image-failed"
+	eventDirFlushed        = "directory-flushed"
+)
+
+// Event is one step of a run as seen by the event hook
+type Event struct {
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Worker  int       `json:"worker,omitempty"`
+	Path    string    `json:"path,omitempty"`
+	Stage   string    `json:"stage,omitempty"`
+	Output  string    `json:"output,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	Dir     string    `json:"dir,omitempty"`
+	Count   int       `json:"count,omitempty"`
+	Elapsed float64   `json:"elapsed_seconds,omitempty"`
+}
+
+// eventHook passes a run's events to each of its handlers one at a time,
+// whichever worker they come from
+type eventHook struct {
+	sync.Mutex
+	handlers []func(Event)
+}
+
+var events eventHook
+
+func (h *eventHook) emit(event Event) {
+	h.Lock()
+	defer h.Unlock()
+
+	if len(h.handlers) == 0 {
+		return
+	}
+	event.Time = time.Now()
+	for _, handler := range h.handlers {
+		handler(event)
+	}
+}
+
+// subscribe adds handler to those receiving every event
+func (h *eventHook) subscribe(handler func(Event)) {
+	h.Lock()
+	defer h.Unlock()
+	h.handlers = append(h.handlers, handler)
+}
+
+// openEventLog sends every event to the -events file as NDJSON
+func openEventLog(eventsPath string) (*os.File, error) {
+	file, err := os.OpenFile(eventsPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, config.FileMode.mode)
+	if err != nil {
+		return nil, err
+	}
+
+	encoder := json.NewEncoder(file)
+	events.subscribe(func(event Event) {
+		if err := encoder.Encode(event); err != nil {
+			logger.Errorf("-events %s: %s", eventsPath, err)
+		}
+	})
+	return file, nil
+}
+
+// derivativeOutput is the path the generator for stage records its output at
+func derivativeOutput(imageData *ImageData, stage string) string {
+	switch stage {
+	case "thumbnail":
+		return imageData.ThumbPath
+	case "square-thumbnail":
+		return imageData.ThumbSquarePath
+	case "display":
+		return imageData.DisplayPath
+	case "tiles":
+		return imageData.Tiles
+	case "page-preview":
+		return imageData.PreviewPath
+	}
+	return ""
+}
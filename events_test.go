@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestEventHookHandlers(t *testing.T) {
+	var hook eventHook
+	hook.emit(Event{Type: eventImageCompleted})
+
+	var logged []string
+	hook.subscribe(func(event Event) { logged = append(logged, event.Type) })
+	b := &benchmark{stages: map[string]*stageTiming{}}
+	hook.subscribe(b.observe)
+
+	hook.emit(Event{Type: eventImageCompleted, Elapsed: 1})
+	hook.emit(Event{Type: eventImageFailed})
+	if len(logged) != 2 || logged[0] != eventImageCompleted || logged[1] != eventImageFailed {
+		t.Errorf("-events handler got %v", logged)
+	}
+	if b.completed != 1 || b.failed != 1 {
+		t.Errorf("-benchmark handler counted %d completed, %d failed", b.completed, b.failed)
+	}
+}
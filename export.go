@@ -0,0 +1,400 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// formatExtensions are the file extensions derivatives get in each output format
+var formatExtensions = map[string]string{
+	"jpeg": ".jpg",
+	"webp": ".webp",
+	"png":  ".png",
+	"heic": ".heic",
+	"avif": ".avif",
+}
+
+// sourceFormats are the output formats a source already is, by extension
+var sourceFormats = map[string]string{
+	".jpg":  "jpeg",
+	".jpeg": "jpeg",
+	".webp": "webp",
+	".png":  "png",
+	".heic": "heic",
+	".heif": "heic",
+	".avif": "avif",
+}
+
+// alphaFormats are the output formats that keep an alpha channel
+var alphaFormats = map[string]bool{
+	"webp": true,
+	"png":  true,
+	"avif": true,
+}
+
+func sourceFormat(path string) string {
+	return sourceFormats[strings.ToLower(filepath.Ext(path))]
+}
+
+// keepSourceFormat is the -full-format serving each source as-is where
+// it's in an output format, and as lossless png where not
+const keepSourceFormat = "source"
+
+// fullFormat is the format of the full rendition of the source at path
+func fullFormat(path string, hasAlpha bool) string {
+	if config.FullFormat == keepSourceFormat {
+		if format := sourceFormat(path); format != "" {
+			return format
+		}
+		return "png"
+	}
+	return outputFormat(config.FullFormat, hasAlpha)
+}
+
+// outputFormat is the format a derivative is written in: requested, unless
+// a transparent source is being kept transparent and requested can't hold alpha
+func outputFormat(requested string, hasAlpha bool) string {
+	if config.PreserveAlpha && hasAlpha && !alphaFormats[requested] {
+		return config.AlphaFormat
+	}
+	return requested
+}
+
+// jpeg quantization tables by -quant-table index, as mozjpeg numbers them:
+//
+//	0 JPEG Annex K, the libjpeg default
+//	1 flat, keeps hard edges in graphics and text sharp
+//	2 MSSIM tuned on the Kodak photo set
+//	3 ImageMagick's by N. Robidoux, a good photo default
+//	4 PSNR-HVS-M tuned on the Kodak photo set
+//	5 Klein, Silverstein and Carney
+//	6 Watson, Taylor and Borthwick
+//	7 Ahumada, Watson and Peterson
+//	8 Peterson, Ahumada and Watson
+const (
+	photoQuantTable   = 3
+	graphicQuantTable = 1
+	maxQuantTable     = 8
+)
+
+// autoQuantTable is the -quant-table value that picks a table per image
+const autoQuantTable = -1
+
+// graphicEntropy is the luminance histogram entropy in bits below which an
+// image is taken for a flat graphic rather than a photo
+const graphicEntropy = 5.0
+
+// The export params are built here in full instead of from govips' defaults,
+// so the same source and flags always encode to the same bytes. None of the
+// encoders write timestamps or hostnames, and vips renders the same pixels on
+// any number of threads. Output only changes with the libvips and encoder
+// library versions, which is why images.json records vips_version.
+func jpegExportParams(quality int) *vips.JpegExportParams {
+	return &vips.JpegExportParams{
+		StripMetadata:      true,
+		Quality:            quality,
+		Interlace:          true,
+		OptimizeCoding:     true,
+		SubsampleMode:      vips.VipsForeignSubsampleAuto,
+		TrellisQuant:       true,
+		OvershootDeringing: true,
+		OptimizeScans:      true,
+		QuantTable:         photoQuantTable,
+	}
+}
+
+func webpExportParams(quality int) *vips.WebpExportParams {
+	return &vips.WebpExportParams{
+		StripMetadata:   true,
+		Quality:         quality,
+		ReductionEffort: 4,
+	}
+}
+
+// heicExportParams encode lossy HEVC. There is no StripMetadata for heif,
+// encodeImage strips by hand.
+func heicExportParams(quality int) *vips.HeifExportParams {
+	return &vips.HeifExportParams{
+		Quality:  quality,
+		Bitdepth: 8,
+		Effort:   5,
+		Lossless: false,
+	}
+}
+
+// avifExportParams encode lossy AV1 at the effort heic is encoded with
+func avifExportParams(quality int) *vips.AvifExportParams {
+	return &vips.AvifExportParams{
+		StripMetadata: true,
+		Quality:       quality,
+		Bitdepth:      8,
+		Effort:        5,
+		Lossless:      false,
+	}
+}
+
+func pngExportParams() *vips.PngExportParams {
+	return &vips.PngExportParams{
+		StripMetadata: true,
+		Compression:   6,
+		Filter:        vips.PngFilterNone,
+	}
+}
+
+// qualityFor is the configured lossy encoding quality of format
+func qualityFor(format string) int {
+	switch format {
+	case "jpeg":
+		return config.JpegQuality
+	case "webp":
+		return config.WebpQuality
+	case "heic":
+		return config.HeicQuality
+	case "avif":
+		return config.AvifQuality
+	}
+	return config.Quality
+}
+
+// renditionQuality is a rendition's -thumb-quality, -display-quality or
+// -full-quality. Unset, it is the -quality-curve quality for image's size,
+// or without a curve its format's quality.
+func renditionQuality(quality int, format string, image *vips.ImageRef) int {
+	if quality > 0 {
+		return quality
+	}
+	if config.qualityCurve != nil && format != "png" {
+		// animated images are one page tall
+		return config.qualityCurve.at(max(image.Width(), image.GetPageHeight()))
+	}
+	return qualityFor(format)
+}
+
+// defaultQualityCurve is what -quality-curve default picks: thumbnails at
+// 90, display sized images at 82, anything larger at 75
+const defaultQualityCurve = "640:90,2048:82,75"
+
+// qualityStep is a quality for renditions whose longest edge is at most edge
+type qualityStep struct {
+	edge    int
+	quality int
+}
+
+// qualityCurve maps a rendition's longest edge to its quality, steps in
+// ascending edge order ending in one without an edge for anything larger
+type qualityCurve []qualityStep
+
+func (c qualityCurve) at(edge int) int {
+	for _, step := range c {
+		if step.edge == 0 || edge <= step.edge {
+			return step.quality
+		}
+	}
+	return c[len(c)-1].quality
+}
+
+// parseQualityCurve reads a curve written EDGE:QUALITY,...,QUALITY, e.g.
+// 640:90,2048:82,75
+func parseQualityCurve(curve string) (qualityCurve, error) {
+	var parsed qualityCurve
+	steps := strings.Split(curve, ",")
+	for i, step := range steps {
+		edge, quality, hasEdge := strings.Cut(step, ":")
+		if !hasEdge {
+			quality, edge = edge, ""
+		}
+		if hasEdge == (i == len(steps)-1) {
+			return nil, fmt.Errorf("invalid quality curve %q, want EDGE:QUALITY,...,QUALITY", curve)
+		}
+
+		var parsedStep qualityStep
+		var err error
+		if hasEdge {
+			parsedStep.edge, err = strconv.Atoi(edge)
+			if err != nil || parsedStep.edge <= 0 || (i > 0 && parsedStep.edge <= parsed[i-1].edge) {
+				return nil, fmt.Errorf("invalid quality curve %q, edges must be ascending pixel sizes", curve)
+			}
+		}
+		parsedStep.quality, err = strconv.Atoi(quality)
+		if err != nil || parsedStep.quality < 1 || parsedStep.quality > 100 {
+			return nil, fmt.Errorf("invalid quality curve %q, qualities must be 1 to 100", curve)
+		}
+		parsed = append(parsed, parsedStep)
+	}
+	return parsed, nil
+}
+
+// exportImage encodes image in format, one of the formatExtensions keys,
+// stripped of metadata but for -copyright. quality is ignored by lossless
+// formats.
+func exportImage(image *vips.ImageRef, format string, quality int) ([]byte, error) {
+	return encodeImage(image, format, quality, true)
+}
+
+// exportFullImage is exportImage for full renditions, which keep all of the
+// source's metadata with -strip-metadata=false
+func exportFullImage(image *vips.ImageRef, format string, quality int) ([]byte, error) {
+	return encodeImage(image, format, quality, config.StripMetadata)
+}
+
+func encodeImage(image *vips.ImageRef, format string, quality int, strip bool) ([]byte, error) {
+	var imageBytes []byte
+	var err error
+
+	// stripping on export would take the copyright with it, so strip by hand
+	if config.Copyright != "" {
+		if err := embedCopyright(image, strip); err != nil {
+			return nil, err
+		}
+		strip = false
+	}
+
+	// of the metadata kept, the embedded preview only bloats the file
+	if !strip && config.StripExifThumbnail {
+		if err := removeExifThumbnail(image); err != nil {
+			return nil, err
+		}
+	}
+
+	switch format {
+	case "jpeg":
+		params := jpegExportParams(quality)
+		params.StripMetadata = strip
+		params.QuantTable = quantTableFor(image)
+		imageBytes, _, err = image.ExportJpeg(params)
+	case "webp":
+		params := webpExportParams(quality)
+		params.StripMetadata = strip
+		imageBytes, _, err = image.ExportWebp(params)
+	case "png":
+		params := pngExportParams()
+		params.StripMetadata = strip
+		imageBytes, _, err = image.ExportPng(params)
+	case "heic":
+		if strip {
+			if err := stripMetadata(image); err != nil {
+				return nil, err
+			}
+		}
+		imageBytes, _, err = image.ExportHeif(heicExportParams(quality))
+	case "avif":
+		params := avifExportParams(quality)
+		params.StripMetadata = strip
+		imageBytes, _, err = image.ExportAvif(params)
+	default:
+		err = fmt.Errorf("unsupported output format %q", format)
+	}
+
+	return imageBytes, err
+}
+
+// quantTableFor is the -quant-table for image, guessing photo or graphic
+// from its tonal variety in auto mode
+func quantTableFor(image *vips.ImageRef) int {
+	if config.quantTable != autoQuantTable {
+		return config.quantTable
+	}
+
+	entropy, err := luminanceEntropy(image)
+	if err != nil {
+		logger.Warnf("Estimating complexity for -quant-table auto: %s", err)
+		return photoQuantTable
+	}
+	if entropy < graphicEntropy {
+		return graphicQuantTable
+	}
+	return photoQuantTable
+}
+
+// luminanceEntropy is the entropy in bits of image's brightness histogram,
+// low for the few flat tones of graphics, high for photos
+func luminanceEntropy(image *vips.ImageRef) (float64, error) {
+	luminance, err := image.Copy()
+	if err != nil {
+		return 0, err
+	}
+	defer luminance.Close()
+
+	if err := luminance.ToColorSpace(vips.InterpretationBW); err != nil {
+		return 0, err
+	}
+	if luminance.Bands() > 1 {
+		if err := luminance.ExtractBand(0, 1); err != nil {
+			return 0, err
+		}
+	}
+	if err := luminance.HistogramFind(); err != nil {
+		return 0, err
+	}
+	return luminance.HistogramEntropy()
+}
+
+// copyrightField is the vips metadata name written out as the EXIF Copyright tag
+const copyrightField = "exif-ifd0-Copyright"
+
+// embedCopyright sets the -copyright EXIF tag. With strip it first drops all
+// other metadata from image, as StripMetadata would, otherwise the copyright
+// replaces just the source's own.
+func embedCopyright(image *vips.ImageRef, strip bool) error {
+	if strip {
+		if err := stripMetadata(image); err != nil {
+			return err
+		}
+	}
+
+	image.SetString(copyrightField, config.Copyright)
+	return nil
+}
+
+// stripMetadata drops image's metadata as a stripped export would
+func stripMetadata(image *vips.ImageRef) error {
+	if err := image.RemoveMetadata(); err != nil {
+		return err
+	}
+	// RemoveMetadata keeps these, a stripped export wouldn't
+	if err := image.RemoveICCProfile(); err != nil {
+		return err
+	}
+	return image.RemoveOrientation()
+}
+
+// recompressionStep is how far below the configured quality the alternative
+// full rendition encode is tried
+const recompressionStep = 10
+
+// recompressionMinSavings is the fraction of bytes the lower quality encode
+// must save to be worth its quality loss
+const recompressionMinSavings = 0.1
+
+// exportRecompressed encodes image at the configured quality and at a lower
+// one no further than the floor, keeping the lower encode only when it is
+// meaningfully smaller
+func exportRecompressed(image *vips.ImageRef, format string, source string) ([]byte, error) {
+	quality := renditionQuality(config.FullQuality, format, image)
+	imageBytes, err := exportFullImage(image, format, quality)
+	if err != nil {
+		return nil, err
+	}
+
+	lowerQuality := max(quality-recompressionStep, config.RecompressFloor)
+	if format == "png" || lowerQuality >= quality {
+		return imageBytes, nil
+	}
+
+	lowerBytes, err := exportFullImage(image, format, lowerQuality)
+	if err != nil {
+		return nil, err
+	}
+
+	saved := len(imageBytes) - len(lowerBytes)
+	if float64(saved) < float64(len(imageBytes))*recompressionMinSavings {
+		return imageBytes, nil
+	}
+
+	logger.Infof("Recompressed %s at quality %d, saved %d bytes", source, lowerQuality, saved)
+	return lowerBytes, nil
+}
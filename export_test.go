@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+var vipsStarted sync.Once
+
+// startVips starts libvips for the tests that encode or decode, once for the
+// whole run as it can't be restarted
+func startVips(t *testing.T) {
+	t.Helper()
+	vipsStarted.Do(func() { vips.Startup(nil) })
+}
+
+// testJpeg is a black width by height jpeg without metadata
+func testJpeg(t *testing.T, width int, height int) []byte {
+	t.Helper()
+	startVips(t)
+	image, err := vips.Black(width, height)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer image.Close()
+	params := vips.NewJpegExportParams()
+	params.StripMetadata = true
+	jpegBytes, _, err := image.ExportJpeg(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jpegBytes
+}
+
+func TestParseQualityCurve(t *testing.T) {
+	tests := []struct {
+		curve  string
+		parsed qualityCurve
+		failed bool
+	}{
+		{"80", qualityCurve{{quality: 80}}, false},
+		{"400:90,1600:80,70", qualityCurve{{edge: 400, quality: 90}, {edge: 1600, quality: 80}, {quality: 70}}, false},
+		{"", nil, true},
+		{"400:90", nil, true},
+		{"90,80", nil, true},
+		{"1600:80,400:90,70", nil, true},
+		{"400:90,400:80,70", nil, true},
+		{"0:90,70", nil, true},
+		{"400:101,70", nil, true},
+		{"400:90,0", nil, true},
+		{"big:90,70", nil, true},
+	}
+	for _, test := range tests {
+		parsed, err := parseQualityCurve(test.curve)
+		if (err != nil) != test.failed || !reflect.DeepEqual(parsed, test.parsed) {
+			t.Errorf("parseQualityCurve(%q) = %v, %v", test.curve, parsed, err)
+		}
+	}
+}
+
+func TestDeterministicEncoding(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+	config.Copyright = ""
+	source := testJpeg(t, 64, 48)
+
+	for _, format := range []string{"jpeg", "webp", "png"} {
+		var encoded [2][]byte
+		for i := range encoded {
+			image, err := vips.NewImageFromBuffer(source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			encoded[i], err = exportImage(image, format, 80)
+			image.Close()
+			if err != nil {
+				t.Fatalf("%s: %s", format, err)
+			}
+		}
+		if !bytes.Equal(encoded[0], encoded[1]) {
+			t.Errorf("%s: encoding the same source twice differs", format)
+		}
+	}
+}
+
+func TestCopyrightReadBack(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+	config.Copyright = "© 2024 Jane Doe"
+	source := withExif(testJpeg(t, 64, 48), exifWithThumbnail(binary.BigEndian, "Camera Co"))
+
+	tests := []struct {
+		format string
+		strip  bool
+	}{
+		{"jpeg", true},
+		{"jpeg", false},
+		{"webp", true},
+		{"webp", false},
+	}
+	for _, test := range tests {
+		image, err := vips.NewImageFromBuffer(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded, err := encodeImage(image, test.format, 80, test.strip)
+		image.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", test.format, err)
+		}
+
+		written, err := vips.NewImageFromBuffer(encoded)
+		if err != nil {
+			t.Fatalf("%s: %s", test.format, err)
+		}
+		// vips appends the tag's description to its value
+		if copyright := written.GetString(copyrightField); !strings.HasPrefix(copyright, config.Copyright) {
+			t.Errorf("%s, strip %t: read back copyright %q, want %q", test.format, test.strip, copyright, config.Copyright)
+		}
+		if kept := slices.Contains(written.GetFields(), "exif-ifd0-Make"); kept == test.strip {
+			t.Errorf("%s, strip %t: kept the source's Make %t", test.format, test.strip, kept)
+		}
+		written.Close()
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// stageError is an image failing at one stage of processing
+type stageError struct {
+	stage string
+	err   error
+}
+
+func (e *stageError) Error() string {
+	return fmt.Sprintf("%s: %s", e.stage, e.err)
+}
+
+func (e *stageError) Unwrap() error {
+	return e.err
+}
+
+// skipError is an image left out on purpose rather than failing, such as a
+// degenerate source
+type skipError struct {
+	reason string
+}
+
+func (e *skipError) Error() string {
+	return e.reason
+}
+
+// skippedImages counts the images processImage skipped this run
+var skippedImages atomic.Int64
+
+// imageFailure is one -error-report entry
+type imageFailure struct {
+	Path  string `json:"path"`
+	Stage string `json:"stage"`
+	Error string `json:"error"`
+}
+
+// failureLog collects every image failure of the run, and the images
+// -max-runtime left unprocessed
+type failureLog struct {
+	sync.Mutex
+	failures    []imageFailure
+	unprocessed []imageFailure
+}
+
+var failures failureLog
+
+func (f *failureLog) record(path string, err error) {
+	f.Lock()
+	defer f.Unlock()
+
+	failure := imageFailure{Path: path, Error: err.Error()}
+	var failedStage *stageError
+	if errors.As(err, &failedStage) {
+		failure.Stage = failedStage.stage
+		failure.Error = failedStage.err.Error()
+	}
+	f.failures = append(f.failures, failure)
+}
+
+// unprocessedStage is the -error-report stage of an image -max-runtime
+// stopped the run before, so -retry-failed picks it up next run
+const unprocessedStage = "unprocessed"
+
+// recordUnprocessed reports path for -retry-failed without counting it as
+// a failure
+func (f *failureLog) recordUnprocessed(path string) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.unprocessed = append(f.unprocessed, imageFailure{Path: path, Stage: unprocessedStage, Error: errMaxRuntime.Error()})
+}
+
+func (f *failureLog) count() int {
+	f.Lock()
+	defer f.Unlock()
+
+	return len(f.failures)
+}
+
+// byStage summarises the failures so far as counts per stage, e.g.
+// "8 load, 4 tiles"
+func (f *failureLog) byStage() string {
+	f.Lock()
+	defer f.Unlock()
+
+	counts := map[string]int{}
+	for _, failure := range f.failures {
+		stage := failure.Stage
+		if stage == "" {
+			stage = "other"
+		}
+		counts[stage]++
+	}
+	stages := make([]string, 0, len(counts))
+	for stage := range counts {
+		stages = append(stages, stage)
+	}
+	sort.Strings(stages)
+	for i, stage := range stages {
+		stages[i] = fmt.Sprintf("%d %s", counts[stage], stage)
+	}
+	return strings.Join(stages, ", ")
+}
+
+// finishedImages counts the images processImage has returned for this run,
+// whatever the outcome
+var finishedImages atomic.Int64
+
+// maxFailuresMinImages is how many images must have finished before a
+// percentage -max-failures applies, so one early failure isn't 100%
+const maxFailuresMinImages = 20
+
+// maxFailures is a parsed -max-failures, a count or a percentage of the
+// images finished
+type maxFailures struct {
+	count   int
+	percent float64
+}
+
+func parseMaxFailures(value string) (*maxFailures, error) {
+	if percent, found := strings.CutSuffix(value, "%"); found {
+		p, err := strconv.ParseFloat(percent, 64)
+		if err != nil || p <= 0 || p >= 100 {
+			return nil, fmt.Errorf("percentage must be between 0 and 100: %q", value)
+		}
+		return &maxFailures{percent: p}, nil
+	}
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("must be a positive count or a percentage like 30%%: %q", value)
+	}
+	return &maxFailures{count: count}, nil
+}
+
+// tooManyFailures is the cause a run is cancelled with past -max-failures
+type tooManyFailures struct {
+	failed   int
+	finished int
+	limit    string
+}
+
+func (e *tooManyFailures) Error() string {
+	return fmt.Sprintf("%d failures after %d images, past -max-failures %s", e.failed, e.finished, e.limit)
+}
+
+// exceeded is the cause to cancel the run with once failed failures over
+// finished images is past m, nil until then
+func (m *maxFailures) exceeded(failed int, finished int) error {
+	if m.count > 0 && failed > m.count {
+		return &tooManyFailures{failed, finished, strconv.Itoa(m.count)}
+	}
+	if m.percent > 0 && finished >= maxFailuresMinImages && float64(failed) > m.percent/100*float64(finished) {
+		return &tooManyFailures{failed, finished, strconv.FormatFloat(m.percent, 'g', -1, 64) + "%"}
+	}
+	return nil
+}
+
+// readReport loads the failures of an earlier -error-report
+func readReport(reportPath string) ([]imageFailure, error) {
+	reportJson, err := os.ReadFile(reportPath)
+	if err != nil {
+		return nil, err
+	}
+	var report []imageFailure
+	if err := json.Unmarshal(reportJson, &report); err != nil {
+		return nil, fmt.Errorf("%s: %w", reportPath, err)
+	}
+	return report, nil
+}
+
+// buildRetryImageList lists each image that failed in the -error-report at
+// reportPath once, in place of walking the tree
+func buildRetryImageList(ctx context.Context, reportPath string) (<-chan *ImageData, <-chan error) {
+	images := make(chan *ImageData, 100)
+	errc := make(chan error, 1)
+
+	go func() {
+		defer close(images)
+		report, err := readReport(reportPath)
+		if err != nil {
+			errc <- err
+			return
+		}
+
+		retried := map[string]bool{}
+		for _, failure := range report {
+			if retried[failure.Path] {
+				continue
+			}
+			retried[failure.Path] = true
+
+			if _, err := os.Stat(failure.Path); err != nil {
+				logger.Warnf("Not retrying %s: %s", failure.Path, err)
+				continue
+			}
+
+			ext := filepath.Ext(failure.Path)
+			name := strings.TrimSuffix(filepath.Base(failure.Path), ext)
+			var imageData = ImageData{
+				path: failure.Path,
+				name: name,
+			}
+			if config.SlugifyNames {
+				imageData.OriginalName = filepath.Base(failure.Path)
+				imageData.Slug = slugs.assign(filepath.Dir(failure.Path), name)
+				imageData.name = imageData.Slug
+			}
+
+			select {
+			case images <- &imageData:
+			case <-ctx.Done():
+				errc <- ctx.Err()
+				return
+			}
+		}
+		errc <- nil
+	}()
+
+	return images, errc
+}
+
+// writeReport saves the failures so far and the unprocessed images to
+// reportPath as a JSON array, sorted by path so reruns on the same input
+// write the same report. It's written past -write-rate and -max-open-files,
+// which an interrupted run mustn't wait on, and renamed into place so it's
+// never left half written.
+func (f *failureLog) writeReport(reportPath string) error {
+	f.Lock()
+	defer f.Unlock()
+
+	report := append(append([]imageFailure{}, f.failures...), f.unprocessed...)
+	sort.SliceStable(report, func(i, j int) bool {
+		return report[i].Path < report[j].Path
+	})
+	reportJson, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	partial := reportPath + ".partial"
+	if err := os.WriteFile(partial, reportJson, config.FileMode.mode); err != nil {
+		return err
+	}
+	if err := applyMode(partial, config.FileMode); err != nil {
+		os.Remove(partial)
+		return err
+	}
+	if err := os.Rename(partial, reportPath); err != nil {
+		os.Remove(partial)
+		return err
+	}
+	return nil
+}
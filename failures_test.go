@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseMaxFailures(t *testing.T) {
+	tests := []struct {
+		value  string
+		limit  *maxFailures
+		failed bool
+	}{
+		{"5", &maxFailures{count: 5}, false},
+		{"30%", &maxFailures{percent: 30}, false},
+		{"2.5%", &maxFailures{percent: 2.5}, false},
+		{"0", nil, true},
+		{"-3", nil, true},
+		{"0%", nil, true},
+		{"100%", nil, true},
+		{"many", nil, true},
+		{"%", nil, true},
+	}
+	for _, test := range tests {
+		limit, err := parseMaxFailures(test.value)
+		if (err != nil) != test.failed {
+			t.Errorf("parseMaxFailures(%q) error %v", test.value, err)
+			continue
+		}
+		if limit != nil && *limit != *test.limit {
+			t.Errorf("parseMaxFailures(%q) = %+v, want %+v", test.value, *limit, *test.limit)
+		}
+	}
+}
+
+func TestMaxFailuresExceeded(t *testing.T) {
+	tests := []struct {
+		limit    maxFailures
+		failed   int
+		finished int
+		exceeded bool
+	}{
+		{maxFailures{count: 5}, 5, 10, false},
+		{maxFailures{count: 5}, 6, 10, true},
+		{maxFailures{count: 5}, 6, 6, true},
+		{maxFailures{percent: 30}, 10, maxFailuresMinImages - 1, false},
+		{maxFailures{percent: 30}, 6, maxFailuresMinImages, false},
+		{maxFailures{percent: 30}, 7, maxFailuresMinImages, true},
+		{maxFailures{percent: 30}, 30, 100, false},
+		{maxFailures{percent: 30}, 31, 100, true},
+	}
+	for _, test := range tests {
+		if exceeded := test.limit.exceeded(test.failed, test.finished) != nil; exceeded != test.exceeded {
+			t.Errorf("%+v exceeded by %d of %d = %t, want %t", test.limit, test.failed, test.finished, exceeded, test.exceeded)
+		}
+	}
+}
+
+func TestUnprocessedRetried(t *testing.T) {
+	defer func() { failures.failures, failures.unprocessed = nil, nil }()
+	dir := t.TempDir()
+	for _, name := range []string{"broken.jpg", "late.jpg"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	failures.record(filepath.Join(dir, "broken.jpg"), &stageError{"load", errors.New("truncated")})
+	failures.recordUnprocessed(filepath.Join(dir, "late.jpg"))
+	if count := failures.count(); count != 1 {
+		t.Errorf("%d failures counted, want the one that failed", count)
+	}
+
+	reportPath := filepath.Join(dir, "errors.json")
+	if err := failures.writeReport(reportPath); err != nil {
+		t.Fatal(err)
+	}
+	report, err := readReport(reportPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report) != 2 || report[0].Stage != "load" || report[1].Stage != unprocessedStage {
+		t.Errorf("report %+v, want the load failure and the unprocessed image", report)
+	}
+
+	images, errc := buildRetryImageList(context.Background(), reportPath)
+	var retried []string
+	for imageData := range images {
+		retried = append(retried, imageData.name)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if len(retried) != 2 || retried[0] != "broken" || retried[1] != "late" {
+		t.Errorf("-retry-failed listed %v", retried)
+	}
+}
+
+func TestWriteReportPastLimits(t *testing.T) {
+	defer func(slots chan struct{}) { fileSlots = slots }(fileSlots)
+	// every file slot taken, as by workers stuck at an interrupt
+	fileSlots = make(chan struct{}, 1)
+	fileSlots <- struct{}{}
+
+	reportPath := filepath.Join(t.TempDir(), "errors.json")
+	written := make(chan error, 1)
+	go func() { written <- failures.writeReport(reportPath) }()
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("writeReport waited on -max-open-files")
+	}
+	if _, err := os.Stat(reportPath + ".partial"); !os.IsNotExist(err) {
+		t.Errorf("partial report left behind: %v", err)
+	}
+	if _, err := readReport(reportPath); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileKey identifies the file behind info by device and inode
+func fileKey(path string, info os.FileInfo) any {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return [2]uint64{uint64(stat.Dev), uint64(stat.Ino)}
+	}
+	return path
+}
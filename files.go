@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// prompts serialises -i questions from concurrent processors
+var prompts sync.Mutex
+
+var stdin = bufio.NewReader(os.Stdin)
+
+// writeFile is os.WriteFile with -file-mode, paced by -write-rate and holding
+// a file slot
+func writeFile(path string, data []byte) error {
+	waitWriteRate()
+	acquireFileSlot()
+	defer releaseFileSlot()
+
+	// a -dedupe-derivatives link is replaced, writing through it would
+	// change the derivative it shares
+	if info, err := os.Lstat(path); err == nil && !info.IsDir() {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	if err := os.WriteFile(path, data, config.FileMode.mode); err != nil {
+		return err
+	}
+	return applyMode(path, config.FileMode)
+}
+
+// createFile is os.Create with -file-mode, paced by -write-rate
+func createFile(path string) (*os.File, error) {
+	waitWriteRate()
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, config.FileMode.mode)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyMode(path, config.FileMode); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// fileSize is the size of the file at path, 0 if there is none
+func fileSize(path string) int64 {
+	if path == "" {
+		return 0
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// treeSize totals the size of every file under root
+func treeSize(root string) int64 {
+	var size int64
+	filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if entry.Type().IsRegular() {
+			if info, err := entry.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
+
+// makeDirs is os.MkdirAll with -dir-mode, applied to every directory it
+// creates
+func makeDirs(dir string) error {
+	var missing []string
+	for parent := dir; ; parent = filepath.Dir(parent) {
+		if _, err := os.Stat(parent); err == nil || parent == filepath.Dir(parent) {
+			break
+		}
+		missing = append(missing, parent)
+	}
+
+	if err := os.MkdirAll(dir, config.DirMode.mode); err != nil {
+		return err
+	}
+	for _, created := range missing {
+		if err := applyMode(created, config.DirMode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyModes sets -file-mode and -dir-mode throughout a tree written by
+// something else, e.g. dzsave
+func applyModes(root string) error {
+	if !config.FileMode.set && !config.DirMode.set {
+		return nil
+	}
+
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return applyMode(path, config.DirMode)
+		}
+		return applyMode(path, config.FileMode)
+	})
+}
+
+// applyMode chmods path when the mode was given explicitly, since the
+// permissions passed on creation are masked by the umask and ignored for
+// files that already exist
+func applyMode(path string, mode octalMode) error {
+	if !mode.set {
+		return nil
+	}
+	return os.Chmod(path, mode.mode)
+}
+
+// deleteOriginalPNG removes a PNG source once it has been converted to a
+// full rendition elsewhere, asking first with -i
+func deleteOriginalPNG(imageData *ImageData) error {
+	// archived sources were never written, so there's nothing to delete
+	if sourceFormat(imageData.path) != "png" || imageData.FullPath == imageData.path || imageData.source != nil {
+		return nil
+	}
+	info, err := os.Stat(imageData.FullPath)
+	if err != nil {
+		return fmt.Errorf("not deleting %s, its full rendition is missing: %w", imageData.path, err)
+	}
+	// what a conversion that failed part way leaves behind
+	if info.Size() == 0 {
+		return fmt.Errorf("not deleting %s, its full rendition %s is empty", imageData.path, imageData.FullPath)
+	}
+
+	if config.Interactive && !confirm(fmt.Sprintf("Delete %s, converted to %s?", imageData.path, imageData.FullPath)) {
+		logger.Infof("Keeping %s", imageData.path)
+		return nil
+	}
+
+	logger.Infof("Deleting original %s, converted to %s", imageData.path, imageData.FullPath)
+	return os.Remove(imageData.path)
+}
+
+// confirm asks a yes/no question on the terminal, defaulting to no
+func confirm(question string) bool {
+	prompts.Lock()
+	defer prompts.Unlock()
+
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, err := stdin.ReadString('\n')
+	if err != nil {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
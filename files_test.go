@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDeleteOriginalPNG(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+	defer func(saved *bufio.Reader) { stdin = saved }(stdin)
+
+	tests := []struct {
+		name        string
+		source      string
+		full        string
+		fullSize    int
+		interactive bool
+		answer      string
+		archived    bool
+		deleted     bool
+		failed      bool
+	}{
+		{"converted", "photo.png", "photo.jpg", 4, false, "", false, true, false},
+		{"confirmed", "photo.png", "photo.jpg", 4, true, "y\n", false, true, false},
+		{"kept when declined", "photo.png", "photo.jpg", 4, true, "n\n", false, false, false},
+		{"kept without an answer", "photo.png", "photo.jpg", 4, true, "", false, false, false},
+		{"conversion failed", "photo.png", "photo.jpg", -1, false, "", false, false, true},
+		{"conversion left an empty file", "photo.png", "photo.jpg", 0, false, "", false, false, true},
+		{"served as-is", "photo.png", "photo.png", 3, false, "", false, false, false},
+		{"not a png", "photo.tif", "photo.jpg", 4, false, "", false, false, false},
+		{"archived", "photo.png", "photo.jpg", 4, false, "", true, false, false},
+	}
+	for _, test := range tests {
+		dir := t.TempDir()
+		imageData := &ImageData{path: filepath.Join(dir, test.source), FullPath: filepath.Join(dir, test.full)}
+		if err := os.WriteFile(imageData.path, []byte("png"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if test.archived {
+			imageData.source = []byte("png")
+		}
+		// a size of -1 is a rendition that was never written
+		if test.fullSize >= 0 && test.full != test.source {
+			if err := os.WriteFile(imageData.FullPath, make([]byte, test.fullSize), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		config.Interactive = test.interactive
+		stdin = bufio.NewReader(strings.NewReader(test.answer))
+
+		err := deleteOriginalPNG(imageData)
+		if (err != nil) != test.failed {
+			t.Errorf("%s: deleteOriginalPNG = %v, want failed %t", test.name, err, test.failed)
+		}
+		_, statErr := os.Stat(imageData.path)
+		if deleted := os.IsNotExist(statErr); deleted != test.deleted {
+			t.Errorf("%s: source deleted %t, want %t", test.name, deleted, test.deleted)
+		}
+	}
+}
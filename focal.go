@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// focalSidecarSuffix names a source's focal point sidecar, photo.jpg has
+// photo.focal.json
+const focalSidecarSuffix = ".focal.json"
+
+// Focal is a focal point sidecar's point, as fractions of the source's width
+// and height from its top left
+type Focal struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// readFocalSidecar loads the focal point beside imageData's source, nil when
+// there is none or it can't be read
+func readFocalSidecar(imageData *ImageData) *Focal {
+	sidecarPath := strings.TrimSuffix(imageData.path, filepath.Ext(imageData.path)) + focalSidecarSuffix
+	sidecar, err := os.ReadFile(sidecarPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Error(err)
+		}
+		return nil
+	}
+
+	var focal Focal
+	if err := json.Unmarshal(sidecar, &focal); err != nil {
+		logger.Warnf("Ignoring focal point sidecar %s: %s", sidecarPath, err)
+		return nil
+	}
+	if focal.X < 0 || focal.X > 1 || focal.Y < 0 || focal.Y > 1 {
+		logger.Warnf("Ignoring focal point %+v of %s, it isn't within 0 to 1", focal, sidecarPath)
+		return nil
+	}
+	return &focal
+}
+
+// renditionFocus moves imageData's focal point on its width by height source
+// onto the full rendition, past any crop and trim, clamped to its edges
+func renditionFocus(imageData *ImageData, width int, height int) *Focal {
+	if imageData.Focal == nil {
+		return nil
+	}
+
+	x := imageData.Focal.X * float64(width)
+	y := imageData.Focal.Y * float64(height)
+	if crop := imageData.Crop; crop != nil && imageData.Cropped {
+		x, y = x-float64(crop.X), y-float64(crop.Y)
+		width, height = crop.W, crop.H
+	}
+	if trim := imageData.Trim; trim != nil {
+		x, y = x-float64(trim.Left), y-float64(trim.Top)
+		width, height = trim.Width, trim.Height
+	}
+	return &Focal{
+		X: math.Min(math.Max(x/float64(width), 0), 1),
+		Y: math.Min(math.Max(y/float64(height), 0), 1),
+	}
+}
+
+// loadBoxedThumbnail is loadThumbnail for a fixed width by height box,
+// cropped around imageData's focal point if it has one, else by
+// thumbnailCrop
+func loadBoxedThumbnail(imageData *ImageData, width int, height int) (*vips.ImageRef, error) {
+	if imageData.focus == nil {
+		return loadThumbnail(imageData.FullPath, width, height, thumbnailCrop())
+	}
+
+	coverWidth, coverHeight := coverBox(imageData, width, height)
+	thumbnail, err := loadThumbnail(imageData.FullPath, coverWidth, coverHeight, vips.InterestingNone)
+	if err != nil {
+		return nil, err
+	}
+	if err := cropAround(thumbnail, imageData.focus, width, height); err != nil {
+		thumbnail.Close()
+		return nil, err
+	}
+	return thumbnail, nil
+}
+
+// coverBox is the size the full rendition scales to so it just covers a
+// width by height box
+func coverBox(imageData *ImageData, width int, height int) (int, int) {
+	scale := math.Max(float64(width)/float64(imageData.MaxWidth), float64(height)/float64(imageData.MaxHeight))
+	return int(math.Ceil(float64(imageData.MaxWidth) * scale)), int(math.Ceil(float64(imageData.MaxHeight) * scale))
+}
+
+// cropAround crops image to width by height, as near centred on focus as
+// its edges allow
+func cropAround(image *vips.ImageRef, focus *Focal, width int, height int) error {
+	width, height = min(width, image.Width()), min(height, image.Height())
+	left := int(math.Round(focus.X*float64(image.Width()) - float64(width)/2))
+	top := int(math.Round(focus.Y*float64(image.Height()) - float64(height)/2))
+	left = max(0, min(left, image.Width()-width))
+	top = max(0, min(top, image.Height()-height))
+	return image.ExtractArea(left, top, width, height)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// inputGlob is a parsed -input-glob, matched against slash separated paths
+// relative to the walk root. Each segment is a path.Match pattern, and a **
+// segment matches any number of directories, e.g. photos/2024/**/*.jpg.
+type inputGlob struct {
+	segments []string
+}
+
+func parseInputGlob(pattern string) (*inputGlob, error) {
+	cleaned := strings.TrimPrefix(path.Clean(filepath.ToSlash(pattern)), "./")
+	segments := strings.Split(cleaned, "/")
+	for _, segment := range segments {
+		if segment == "**" {
+			continue
+		}
+		if _, err := path.Match(segment, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	return &inputGlob{segments: segments}, nil
+}
+
+// matches reports whether the file at relPath is selected
+func (g *inputGlob) matches(relPath string) bool {
+	return matchSegments(g.segments, strings.Split(relPath, "/"))
+}
+
+func matchSegments(segments []string, names []string) bool {
+	for len(segments) > 0 {
+		if segments[0] == "**" {
+			for skip := 0; skip <= len(names); skip++ {
+				if matchSegments(segments[1:], names[skip:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(names) == 0 {
+			return false
+		}
+		if matched, _ := path.Match(segments[0], names[0]); !matched {
+			return false
+		}
+		segments, names = segments[1:], names[1:]
+	}
+	return len(names) == 0
+}
+
+// mayContain reports whether anything below the directory at relDir could be
+// selected, so the walk can prune those that can't
+func (g *inputGlob) mayContain(relDir string) bool {
+	if relDir == "." {
+		return true
+	}
+
+	for i, name := range strings.Split(relDir, "/") {
+		if g.segments[i] == "**" {
+			return true
+		}
+		// the last segment names files, a directory this deep holds none of them
+		if i == len(g.segments)-1 {
+			return false
+		}
+		if matched, _ := path.Match(g.segments[i], name); !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// globbedOut reports whether -input-glob leaves out path, relative to root
+func globbedOut(root string, path string, isDir bool) bool {
+	if config.inputGlob == nil {
+		return false
+	}
+
+	relPath, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	relPath = filepath.ToSlash(relPath)
+
+	if isDir {
+		return !config.inputGlob.mayContain(relPath)
+	}
+	return !config.inputGlob.matches(relPath)
+}
+
+// onlyDirs are the -only-dirs directories, slash separated and relative to
+// the walk root
+type onlyDirs []string
+
+func parseOnlyDirs(list string) (onlyDirs, error) {
+	var dirs onlyDirs
+	for _, dir := range strings.Split(list, ",") {
+		cleaned := path.Clean(filepath.ToSlash(strings.TrimSpace(dir)))
+		if cleaned == "." || path.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+			return nil, fmt.Errorf("%q must be a directory below the root", dir)
+		}
+		dirs = append(dirs, cleaned)
+	}
+	return dirs, nil
+}
+
+// selects reports whether files in the directory at relDir are processed,
+// being in or below a listed directory
+func (d onlyDirs) selects(relDir string) bool {
+	for _, dir := range d {
+		if relDir == dir || strings.HasPrefix(relDir, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// leadsTo reports whether relDir holds a listed directory further down, so
+// the walk has to descend through it
+func (d onlyDirs) leadsTo(relDir string) bool {
+	if relDir == "." {
+		return true
+	}
+	for _, dir := range d {
+		if strings.HasPrefix(dir, relDir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// dirFilteredOut reports whether -only-dirs leaves out path, relative to root
+func dirFilteredOut(root string, path string, isDir bool) bool {
+	if config.onlyDirs == nil {
+		return false
+	}
+
+	relPath, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	relPath = filepath.ToSlash(relPath)
+
+	if isDir {
+		return !config.onlyDirs.selects(relPath) && !config.onlyDirs.leadsTo(relPath)
+	}
+	return !config.onlyDirs.selects(filepath.ToSlash(filepath.Dir(relPath)))
+}
@@ -0,0 +1,97 @@
+package main
+
+import "testing"
+
+func TestInputGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		matches bool
+	}{
+		{"*.jpg", "a.jpg", true},
+		{"*.jpg", "dir/a.jpg", false},
+		{"photos/2024/**/*.jpg", "photos/2024/a.jpg", true},
+		{"photos/2024/**/*.jpg", "photos/2024/jan/day1/a.jpg", true},
+		{"photos/2024/**/*.jpg", "photos/2023/jan/a.jpg", false},
+		{"photos/2024/**/*.jpg", "photos/2024/jan/a.png", false},
+		{"**/*.png", "a.png", true},
+		{"**", "any/thing/at/all.tif", true},
+		{"photos/*/a.jpg", "photos/x/y/a.jpg", false},
+	}
+	for _, test := range tests {
+		glob, err := parseInputGlob(test.pattern)
+		if err != nil {
+			t.Fatalf("parseInputGlob(%q): %s", test.pattern, err)
+		}
+		if matches := glob.matches(test.path); matches != test.matches {
+			t.Errorf("%q matches %q = %t, want %t", test.pattern, test.path, matches, test.matches)
+		}
+	}
+
+	if _, err := parseInputGlob("photos/[a-"); err == nil {
+		t.Error("parseInputGlob accepted a malformed pattern")
+	}
+}
+
+func TestInputGlobMayContain(t *testing.T) {
+	tests := []struct {
+		pattern    string
+		dir        string
+		mayContain bool
+	}{
+		{"photos/2024/*.jpg", ".", true},
+		{"photos/2024/*.jpg", "photos", true},
+		{"photos/2024/*.jpg", "photos/2024", true},
+		{"photos/2024/*.jpg", "photos/2023", false},
+		{"photos/2024/*.jpg", "photos/2024/jan", false},
+		{"photos/2024/*.jpg", "music", false},
+		{"photos/**/*.jpg", "photos/a/b/c", true},
+		{"*.jpg", "anything", false},
+	}
+	for _, test := range tests {
+		glob, err := parseInputGlob(test.pattern)
+		if err != nil {
+			t.Fatalf("parseInputGlob(%q): %s", test.pattern, err)
+		}
+		if mayContain := glob.mayContain(test.dir); mayContain != test.mayContain {
+			t.Errorf("%q may contain %q = %t, want %t", test.pattern, test.dir, mayContain, test.mayContain)
+		}
+	}
+}
+
+func TestOnlyDirs(t *testing.T) {
+	dirs, err := parseOnlyDirs("2024/trips, ./portraits/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path     string
+		isDir    bool
+		filtered bool
+	}{
+		{"root/a.jpg", false, true},
+		{"root/2024", true, false},
+		{"root/2024/a.jpg", false, true},
+		{"root/2024/trips", true, false},
+		{"root/2024/trips/a.jpg", false, false},
+		{"root/2024/trips/rome/a.jpg", false, false},
+		{"root/2024/work", true, true},
+		{"root/portraits/a.jpg", false, false},
+		{"root/portraitsx/a.jpg", false, true},
+		{"root/2023", true, true},
+	}
+	defer func(saved Config) { config = saved }(config)
+	config.onlyDirs = dirs
+	for _, test := range tests {
+		if filtered := dirFilteredOut("root", test.path, test.isDir); filtered != test.filtered {
+			t.Errorf("dirFilteredOut(%q, dir %t) = %t, want %t", test.path, test.isDir, filtered, test.filtered)
+		}
+	}
+
+	for _, list := range []string{".", "/abs", "..", "../up", "ok,../up"} {
+		if _, err := parseOnlyDirs(list); err == nil {
+			t.Errorf("parseOnlyDirs(%q) accepted a directory outside the root", list)
+		}
+	}
+}
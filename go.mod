@@ -3,7 +3,12 @@ module image-gallery-processor
 go 1.22
 
 require (
-	github.com/davidbyttow/govips/v2 v2.15.0 // indirect
+	github.com/davidbyttow/govips/v2 v2.15.0
+	github.com/mattn/go-sqlite3 v1.14.22
+	golang.org/x/time v0.5.0
+)
+
+require (
 	golang.org/x/image v0.18.0 // indirect
 	golang.org/x/net v0.26.0 // indirect
 	golang.org/x/text v0.16.0 // indirect
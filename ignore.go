@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ignoreFileName holds gitignore-style patterns for the directory it's in and
+// everything below it
+const ignoreFileName = ".galleryignore"
+
+// ignoreRule is one .galleryignore line. Patterns containing a slash are
+// matched against the path relative to the ignore file, others against the
+// name alone at any depth.
+type ignoreRule struct {
+	pattern  string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// ignoreRules lazily loads and caches each directory's .galleryignore
+type ignoreRules struct {
+	sync.Mutex
+	root  string
+	byDir map[string][]ignoreRule
+}
+
+func newIgnoreRules(root string) *ignoreRules {
+	return &ignoreRules{root: root, byDir: map[string][]ignoreRule{}}
+}
+
+func parseIgnoreRule(line string) (ignoreRule, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+
+	var rule ignoreRule
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimSuffix(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		rule.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	rule.pattern = line
+
+	return rule, line != ""
+}
+
+func (r ignoreRule) matches(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+
+	target := rel
+	if !r.anchored {
+		target = path.Base(rel)
+	}
+	matched, err := path.Match(r.pattern, target)
+	return err == nil && matched
+}
+
+func (r *ignoreRules) rulesFor(dir string) []ignoreRule {
+	r.Lock()
+	defer r.Unlock()
+
+	if rules, loaded := r.byDir[dir]; loaded {
+		return rules
+	}
+
+	var rules []ignoreRule
+	ignoreFile, err := os.Open(filepath.Join(dir, ignoreFileName))
+	if err == nil {
+		scanner := bufio.NewScanner(ignoreFile)
+		for scanner.Scan() {
+			if rule, ok := parseIgnoreRule(scanner.Text()); ok {
+				rules = append(rules, rule)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			logger.Error(err)
+		}
+		ignoreFile.Close()
+	} else if !os.IsNotExist(err) {
+		logger.Error(err)
+	}
+
+	r.byDir[dir] = rules
+	return rules
+}
+
+// ignored applies the .galleryignore files from the root down to path's
+// parent. As with gitignore the last matching rule wins, so deeper files and
+// later lines can re-include with a negation.
+func (r *ignoreRules) ignored(filePath string, isDir bool) bool {
+	rel, err := filepath.Rel(r.root, filePath)
+	if err != nil || rel == "." {
+		return false
+	}
+
+	segments := strings.Split(filepath.ToSlash(rel), "/")
+	ignored := false
+	dir := r.root
+	for i := range segments {
+		if i > 0 {
+			dir = filepath.Join(dir, segments[i-1])
+		}
+
+		relToDir := strings.Join(segments[i:], "/")
+		for _, rule := range r.rulesFor(dir) {
+			if rule.matches(relToDir, isDir) {
+				ignored = !rule.negate
+			}
+		}
+	}
+
+	return ignored
+}
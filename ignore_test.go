@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIgnoreRules(t *testing.T) {
+	root := t.TempDir()
+	ignoreFiles := map[string]string{
+		ignoreFileName:                       "# scratch files\n*.tmp\ndraft/\n*.jpg\n!keep.jpg\n",
+		filepath.Join("sub", ignoreFileName): "!keep.tmp\n",
+	}
+	for name, contents := range ignoreFiles {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rules := newIgnoreRules(root)
+
+	tests := []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{"scratch.tmp", false, true},
+		{"deep/down/scratch.tmp", false, true},
+		{"photo.png", false, false},
+		{"draft", true, true},
+		{"sub/draft", true, true},
+		{"draft", false, false},
+		{"photo.jpg", false, true},
+		{"keep.jpg", false, false},
+		{"sub/keep.jpg", false, false},
+		{"sub/keep.tmp", false, false},
+		{"sub/other.tmp", false, true},
+		{"keep.tmp", false, true},
+	}
+	for _, test := range tests {
+		if ignored := rules.ignored(filepath.Join(root, test.path), test.isDir); ignored != test.ignored {
+			t.Errorf("ignored(%q, dir %t) = %t, want %t", test.path, test.isDir, ignored, test.ignored)
+		}
+	}
+}
+
+func TestParseIgnoreRule(t *testing.T) {
+	tests := []struct {
+		line string
+		rule ignoreRule
+		ok   bool
+	}{
+		{"*.tmp", ignoreRule{pattern: "*.tmp"}, true},
+		{"draft/", ignoreRule{pattern: "draft", dirOnly: true}, true},
+		{"!keep.jpg", ignoreRule{pattern: "keep.jpg", negate: true}, true},
+		{"/raw/*.cr2", ignoreRule{pattern: "raw/*.cr2", anchored: true}, true},
+		{"# comment", ignoreRule{}, false},
+		{"   ", ignoreRule{}, false},
+	}
+	for _, test := range tests {
+		rule, ok := parseIgnoreRule(test.line)
+		if rule != test.rule || ok != test.ok {
+			t.Errorf("parseIgnoreRule(%q) = %+v, %t, want %+v, %t", test.line, rule, ok, test.rule, test.ok)
+		}
+	}
+}
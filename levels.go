@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// autoLevelsClip is the fraction of pixels at each end of the histogram let
+// clip to black or white, so a few specks don't hold back the stretch
+const autoLevelsClip = 0.005
+
+// autoLevelsMaxGain caps the stretch, a near flat image would otherwise be
+// blown out into noise
+const autoLevelsMaxGain = 4.0
+
+// autoLevels stretches image's contrast so its darkest and brightest
+// pixels, bar autoLevelsClip of them, reach black and white. -autolevels-strength
+// blends between the image as it was at 0 and the full stretch at 1.
+// Images already spanning the range are left about as they were.
+func autoLevels(image *vips.ImageRef) error {
+	var maxValue float64
+	switch image.BandFormat() {
+	case vips.BandFormatUchar:
+		maxValue = 255
+	case vips.BandFormatUshort:
+		maxValue = 65535
+	default:
+		return nil
+	}
+
+	low, high, err := levelRange(image)
+	if err != nil {
+		return err
+	}
+	if high <= low {
+		return nil
+	}
+
+	gain := min(maxValue/(high-low), autoLevelsMaxGain)
+	strength := config.AutoLevelsStrength
+
+	// every band gets the same curve so colours don't shift, except alpha
+	a := make([]float64, image.Bands())
+	b := make([]float64, image.Bands())
+	for band := range a {
+		a[band] = 1 + strength*(gain-1)
+		b[band] = -strength * gain * low
+	}
+	if image.HasAlpha() {
+		a[len(a)-1], b[len(b)-1] = 1, 0
+	}
+
+	format := image.BandFormat()
+	if err := image.Linear(a, b); err != nil {
+		return err
+	}
+	return image.Cast(format)
+}
+
+// levelRange finds the brightness below and above which autoLevelsClip of
+// image's pixels lie
+func levelRange(image *vips.ImageRef) (float64, float64, error) {
+	luminance, err := image.Copy()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer luminance.Close()
+
+	if err := luminance.ToColorSpace(vips.InterpretationBW); err != nil {
+		return 0, 0, err
+	}
+	if luminance.Bands() > 1 {
+		if err := luminance.ExtractBand(0, 1); err != nil {
+			return 0, 0, err
+		}
+	}
+	if err := luminance.HistogramFind(); err != nil {
+		return 0, 0, err
+	}
+
+	// one uint count per brightness value
+	histogram, err := luminance.ToBytes()
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(histogram) == 0 || len(histogram)%4 != 0 {
+		return 0, 0, fmt.Errorf("unexpected %d byte histogram", len(histogram))
+	}
+	counts := make([]uint64, len(histogram)/4)
+	var total uint64
+	for value := range counts {
+		counts[value] = uint64(binary.NativeEndian.Uint32(histogram[4*value:]))
+		total += counts[value]
+	}
+
+	clip := uint64(float64(total) * autoLevelsClip)
+	low, high := 0, len(counts)-1
+	for seen := counts[low]; seen <= clip && low < high; seen += counts[low] {
+		low++
+	}
+	for seen := counts[high]; seen <= clip && high > low; seen += counts[high] {
+		high--
+	}
+
+	return float64(low), float64(high), nil
+}
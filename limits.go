@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+
+	"golang.org/x/time/rate"
+)
+
+// fdHeadroom is left free below the open file rlimit for vips, stdio and
+// the walk when picking the default -max-open-files
+const fdHeadroom = 64
+
+// fileSlots bounds how many derivative writes and subprocesses hold file
+// descriptors at once, sized in main from -max-open-files
+var fileSlots chan struct{}
+
+func acquireFileSlot() {
+	if fileSlots != nil {
+		fileSlots <- struct{}{}
+	}
+}
+
+func releaseFileSlot() {
+	if fileSlots != nil {
+		<-fileSlots
+	}
+}
+
+// writeLimiter paces file writes to -write-rate per second across every
+// worker, with no burst so a run doesn't start with one
+var writeLimiter *rate.Limiter
+
+func waitWriteRate() {
+	if writeLimiter != nil {
+		writeLimiter.Wait(context.Background())
+	}
+}
+
+// defaultMaxOpenFiles is half of what's left of the open file rlimit after
+// headroom, or 0 (unlimited) if the limit can't be read
+func defaultMaxOpenFiles() int {
+	limit, ok := openFileLimit()
+	if !ok || limit <= fdHeadroom {
+		return 0
+	}
+	return int((limit - fdHeadroom) / 2)
+}
+
+// runCommand runs cmd holding a file slot
+func runCommand(cmd *exec.Cmd) error {
+	acquireFileSlot()
+	defer releaseFileSlot()
+
+	return cmd.Run()
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// setLoaderOptions sets on params what -jpeg-fail, -pdf-dpi and -svg-dpi
+// change for the loader of the source at path, going by its extension, and
+// pins psd and psb to their composite
+func setLoaderOptions(params *vips.ImportParams, path string) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jpg", ".jpeg":
+		if !config.JpegFail {
+			params.FailOnError.Set(false)
+		}
+	case ".pdf":
+		if config.PdfDpi > 0 {
+			params.Density.Set(config.PdfDpi)
+		}
+	case ".svg", ".svgz":
+		if config.SvgDpi > 0 {
+			params.Density.Set(config.SvgDpi)
+		}
+	case ".psd", ".psb":
+		// the magick loader's first frame is the flattened composite, the
+		// layers follow it
+		params.Page.Set(0)
+		params.NumPages.Set(1)
+	}
+}
+
+// loaderParams are the import params to load the source at path with
+func loaderParams(path string) *vips.ImportParams {
+	params := vips.NewImportParams()
+	setLoaderOptions(params, path)
+	return params
+}
+
+// loaderArg is path for the vips command, with the loader options the flags
+// set for it appended as it takes them
+func loaderArg(path string) string {
+	params := &vips.ImportParams{}
+	setLoaderOptions(params, path)
+	if options := params.OptionString(); options != "" {
+		return path + "[" + options + "]"
+	}
+	return path
+}
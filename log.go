@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// logLevel orders log lines by severity, -log-level drops those below it
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevels = map[string]logLevel{
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"warn":  levelWarn,
+	"error": levelError,
+}
+
+// vipsLogLevels are what libvips itself may log at each -log-level
+var vipsLogLevels = map[logLevel]vips.LogLevel{
+	levelDebug: vips.LogLevelDebug,
+	levelInfo:  vips.LogLevelMessage,
+	levelWarn:  vips.LogLevelWarning,
+	levelError: vips.LogLevelCritical,
+}
+
+// leveledLogger writes to the standard logger the lines at or above its
+// level. Fatal lines are always written.
+type leveledLogger struct {
+	out   *log.Logger
+	level logLevel
+}
+
+var logger = &leveledLogger{out: log.Default(), level: levelInfo}
+
+func (l *leveledLogger) write(level logLevel, line string) {
+	if level < l.level {
+		return
+	}
+	// the caller of Infof or the like, for log.Lshortfile
+	l.out.Output(3, line)
+}
+
+// Debugf logs detail only worth reading when something is missed, like the
+// files the walk passes over
+func (l *leveledLogger) Debugf(format string, v ...any) {
+	l.write(levelDebug, fmt.Sprintf(format, v...))
+}
+
+// Infof logs progress, what was generated, written or kept
+func (l *leveledLogger) Infof(format string, v ...any) {
+	l.write(levelInfo, fmt.Sprintf(format, v...))
+}
+
+// Warnf logs something skipped or degraded that the run carries on past
+func (l *leveledLogger) Warnf(format string, v ...any) {
+	l.write(levelWarn, fmt.Sprintf(format, v...))
+}
+
+// Errorf logs a failure
+func (l *leveledLogger) Errorf(format string, v ...any) {
+	l.write(levelError, fmt.Sprintf(format, v...))
+}
+
+// Error logs a failure as log.Println would
+func (l *leveledLogger) Error(v ...any) {
+	l.write(levelError, fmt.Sprintln(v...))
+}
+
+func (l *leveledLogger) Fatal(v ...any) {
+	l.out.Fatal(v...)
+}
+
+func (l *leveledLogger) Fatalf(format string, v ...any) {
+	l.out.Fatalf(format, v...)
+}
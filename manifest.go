@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// dirManifests are the images.json entries of a run by directory and name
+type dirManifests map[string]map[string]*ImageData
+
+func (m dirManifests) add(dir string, name string, imageData *ImageData) {
+	if _, exists := m[dir]; !exists {
+		m[dir] = map[string]*ImageData{}
+	}
+	m[dir][name] = imageData
+}
+
+// write saves every directory's images.json in parallel, merging into those
+// merge reports true for
+func (m dirManifests) write(merge func(dir string) bool) {
+	var dirWg sync.WaitGroup
+	for dir, imageData := range m {
+		dirMerge := merge(dir)
+		dirWg.Add(1)
+		go func() {
+			writeDirImageData(dir, imageData, dirMerge)
+			dirWg.Done()
+		}()
+	}
+	dirWg.Wait()
+}
+
+// manifestEntry is one -manifest line, an image with where its images.json goes
+type manifestEntry struct {
+	Dir   string     `json:"dir"`
+	Name  string     `json:"name"`
+	Image *ImageData `json:"image"`
+}
+
+// manifestWriter appends a run's images to a -manifest as NDJSON
+type manifestWriter struct {
+	file    *os.File
+	encoder *json.Encoder
+}
+
+func openManifest(manifestPath string) (*manifestWriter, error) {
+	file, err := os.OpenFile(manifestPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, config.FileMode.mode)
+	if err != nil {
+		return nil, err
+	}
+	return &manifestWriter{file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+func (w *manifestWriter) add(imageData *ImageData) error {
+	dir, name := imageDataKey(imageData)
+	return w.encoder.Encode(manifestEntry{Dir: dir, Name: name, Image: imageData})
+}
+
+func (w *manifestWriter) close() error {
+	return w.file.Close()
+}
+
+// readManifests collects the entries of manifestPaths, later entries for the
+// same image replacing earlier ones
+func readManifests(manifestPaths []string) (dirManifests, error) {
+	manifests := dirManifests{}
+	for _, manifestPath := range manifestPaths {
+		file, err := os.Open(manifestPath)
+		if err != nil {
+			return nil, err
+		}
+
+		decoder := json.NewDecoder(file)
+		for {
+			var entry manifestEntry
+			err := decoder.Decode(&entry)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				file.Close()
+				return nil, err
+			}
+			if entry.Dir == "" || entry.Name == "" || entry.Image == nil {
+				continue
+			}
+			manifests.add(entry.Dir, entry.Name, entry.Image)
+		}
+		file.Close()
+	}
+	return manifests, nil
+}
+
+// GalleryManifest is the -merge-output file, every directory's images in one
+type GalleryManifest struct {
+	Meta        RunMeta                          `json:"meta"`
+	Directories map[string]map[string]*ImageData `json:"directories"`
+}
+
+// mergeManifests writes the images.json of every directory in the
+// -manifest files at manifestPaths, and with outputPath all of them together
+func mergeManifests(manifestPaths []string, outputPath string) error {
+	manifests, err := readManifests(manifestPaths)
+	if err != nil {
+		return err
+	}
+	logger.Infof("Merging %d directories from %d manifests", len(manifests), len(manifestPaths))
+
+	manifests.write(func(string) bool { return false })
+
+	if outputPath == "" {
+		return nil
+	}
+
+	gallery := GalleryManifest{
+		Meta:        newRunMeta(),
+		Directories: make(map[string]map[string]*ImageData, len(manifests)),
+	}
+	for dir, imageData := range manifests {
+		gallery.Directories[recordedPath(dir)] = withRecordedPaths(dir, imageData)
+	}
+
+	var galleryJson []byte
+	if config.JSONPretty {
+		galleryJson, err = json.MarshalIndent(gallery, "", "  ")
+	} else {
+		galleryJson, err = json.Marshal(gallery)
+	}
+	if err != nil {
+		return err
+	}
+	return writeFile(outputPath, galleryJson)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// imageMetadata is one -metadata-csv row
+type imageMetadata struct {
+	title   string
+	caption string
+	tags    []string
+}
+
+// galleryMetadata holds -metadata-csv rows keyed by slash-separated source
+// path relative to the walk root
+var galleryMetadata map[string]imageMetadata
+
+// loadMetadataCSV reads path,title,caption,tags rows, tags separated by
+// semicolons. A first row starting with a "path" column is taken as a header.
+func loadMetadataCSV(csvPath string) (map[string]imageMetadata, error) {
+	csvFile, err := os.Open(csvPath)
+	if err != nil {
+		return nil, err
+	}
+	defer csvFile.Close()
+
+	reader := csv.NewReader(csvFile)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	metadata := map[string]imageMetadata{}
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if line == 1 && strings.EqualFold(record[0], "path") {
+			continue
+		}
+		if len(record) > 4 {
+			return nil, fmt.Errorf("%s:%d: want at most path,title,caption,tags, got %d columns", csvPath, line, len(record))
+		}
+
+		record = append(record, "", "", "")
+		var tags []string
+		for _, tag := range strings.Split(record[3], ";") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+		metadata[metadataKey(record[0])] = imageMetadata{
+			title:   strings.TrimSpace(record[1]),
+			caption: strings.TrimSpace(record[2]),
+			tags:    tags,
+		}
+	}
+
+	return metadata, nil
+}
+
+// metadataKey normalises a root relative path so CSV rows written on any OS
+// match the walked paths
+func metadataKey(relPath string) string {
+	return path.Clean(strings.TrimPrefix(filepath.ToSlash(strings.TrimSpace(relPath)), "./"))
+}
+
+// applyMetadata fills imageData's title, caption and tags from its
+// -metadata-csv row, if it has one
+func applyMetadata(imageData *ImageData) {
+	if galleryMetadata == nil {
+		return
+	}
+
+	relPath, err := filepath.Rel(config.root, imageData.path)
+	if err != nil {
+		return
+	}
+	metadata, exists := galleryMetadata[metadataKey(relPath)]
+	if !exists {
+		return
+	}
+
+	imageData.Title = metadata.title
+	imageData.Caption = metadata.caption
+	imageData.Tags = metadata.tags
+}
+
+// mergeTags joins tag lists in order, dropping blanks and repeats
+func mergeTags(tagLists ...[]string) []string {
+	var merged []string
+	seen := map[string]bool{}
+	for _, tags := range tagLists {
+		for _, tag := range tags {
+			tag = strings.TrimSpace(tag)
+			if tag == "" || seen[tag] {
+				continue
+			}
+			seen[tag] = true
+			merged = append(merged, tag)
+		}
+	}
+	return merged
+}
+
+// captureDateFields are the EXIF dates tried for when a photo was taken,
+// best first
+var captureDateFields = []string{"exif-ifd2-DateTimeOriginal", "exif-ifd2-DateTimeDigitized", "exif-ifd0-DateTime"}
+
+// exifDateLayout is how EXIF writes dates, vips appending a description
+const exifDateLayout = "2006:01:02 15:04:05"
+
+// captureDate is when image was taken as local time without a zone, as EXIF
+// records it, e.g. 2024-05-01T14:03:00. Empty when it isn't recorded.
+func captureDate(image *vips.ImageRef) string {
+	for _, field := range captureDateFields {
+		value := image.GetString(field)
+		if len(value) < len(exifDateLayout) {
+			continue
+		}
+		date, err := time.Parse(exifDateLayout, value[:len(exifDateLayout)])
+		if err != nil {
+			continue
+		}
+		return date.Format("2006-01-02T15:04:05")
+	}
+	return ""
+}
+
+// exifDataField is the vips metadata holding the raw EXIF block, which
+// libvips rebuilds on save from it and the exif-ifdN- fields
+const exifDataField = "exif-data"
+
+// removeExifThumbnail drops the preview embedded in image's EXIF, IFD1,
+// keeping every other tag
+func removeExifThumbnail(image *vips.ImageRef) error {
+	exif := image.GetBlob(exifDataField)
+	if exif == nil {
+		return nil
+	}
+	unlinked, err := unlinkExifThumbnail(exif)
+	if err != nil {
+		return err
+	}
+
+	// the fields would bring IFD1 back on save
+	var keep []string
+	for _, field := range image.GetFields() {
+		if !strings.HasPrefix(field, "exif-ifd1-") && field != exifDataField {
+			keep = append(keep, field)
+		}
+	}
+	if err := image.RemoveMetadata(keep...); err != nil {
+		return err
+	}
+	image.SetBlob(exifDataField, unlinked)
+	return nil
+}
+
+// unlinkExifThumbnail copies an EXIF block with IFD0's link to IFD1 cleared,
+// so the thumbnail there isn't read back and libvips writes it out without
+func unlinkExifThumbnail(exif []byte) ([]byte, error) {
+	tiff := 0
+	if bytes.HasPrefix(exif, []byte("Exif\x00\x00")) {
+		tiff = 6
+	}
+	if len(exif) < tiff+8 {
+		return nil, errors.New("EXIF block too short")
+	}
+
+	var order binary.ByteOrder
+	switch string(exif[tiff : tiff+2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, errors.New("EXIF block has no TIFF header")
+	}
+
+	ifd0 := tiff + int(order.Uint32(exif[tiff+4:]))
+	if ifd0+2 > len(exif) {
+		return nil, errors.New("EXIF IFD0 out of bounds")
+	}
+	next := ifd0 + 2 + 12*int(order.Uint16(exif[ifd0:]))
+	if next+4 > len(exif) {
+		return nil, errors.New("EXIF IFD0 out of bounds")
+	}
+
+	unlinked := bytes.Clone(exif)
+	order.PutUint32(unlinked[next:], 0)
+	return unlinked, nil
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// exifWithThumbnail is a TIFF structured EXIF block with Make in IFD0 and a
+// thumbnail in IFD1, as cameras write it
+func exifWithThumbnail(order binary.ByteOrder, maker string) []byte {
+	thumbnail := []byte("\xff\xd8\xff\xd9")
+	makeBytes := append([]byte(maker), 0)
+	if len(makeBytes)%2 == 1 {
+		makeBytes = append(makeBytes, 0)
+	}
+	makeOffset := 8 + 2 + 12 + 4
+	ifd1 := makeOffset + len(makeBytes)
+	thumbnailOffset := ifd1 + 2 + 2*12 + 4
+
+	var tiff bytes.Buffer
+	write := func(values ...any) {
+		for _, value := range values {
+			binary.Write(&tiff, order, value)
+		}
+	}
+	if order == binary.LittleEndian {
+		tiff.WriteString("II")
+	} else {
+		tiff.WriteString("MM")
+	}
+	write(uint16(42))
+	write(uint32(8))
+
+	// IFD0, Make as ASCII
+	write(uint16(1))
+	write(uint16(0x010f), uint16(2), uint32(len(maker)+1), uint32(makeOffset))
+	write(uint32(ifd1))
+	tiff.Write(makeBytes)
+
+	// IFD1, JPEGInterchangeFormat and its length as LONGs
+	write(uint16(2))
+	write(uint16(0x0201), uint16(4), uint32(1), uint32(thumbnailOffset))
+	write(uint16(0x0202), uint16(4), uint32(1), uint32(len(thumbnail)))
+	write(uint32(0))
+	tiff.Write(thumbnail)
+
+	return append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+}
+
+// exifIFD0 reads the Make in exif's IFD0 and its link to IFD1, 0 for none
+func exifIFD0(t *testing.T, exif []byte) (string, uint32) {
+	t.Helper()
+	tiff := bytes.TrimPrefix(exif, []byte("Exif\x00\x00"))
+	if len(tiff) < 8 {
+		t.Fatalf("EXIF block of %d bytes", len(exif))
+	}
+	var order binary.ByteOrder = binary.BigEndian
+	if string(tiff[:2]) == "II" {
+		order = binary.LittleEndian
+	}
+
+	ifd0 := int(order.Uint32(tiff[4:]))
+	count := int(order.Uint16(tiff[ifd0:]))
+	var maker string
+	for i := 0; i < count; i++ {
+		entry := tiff[ifd0+2+12*i:]
+		if order.Uint16(entry) != 0x010f {
+			continue
+		}
+		length := int(order.Uint32(entry[4:]))
+		value := entry[8:12]
+		if length > 4 {
+			value = tiff[order.Uint32(entry[8:]):]
+		}
+		maker = string(bytes.TrimRight(value[:length], "\x00"))
+	}
+	return maker, order.Uint32(tiff[ifd0+2+12*count:])
+}
+
+func TestUnlinkExifThumbnail(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		exif := exifWithThumbnail(order, "Camera Co")
+		for _, block := range [][]byte{exif, bytes.TrimPrefix(exif, []byte("Exif\x00\x00"))} {
+			original := bytes.Clone(block)
+			unlinked, err := unlinkExifThumbnail(block)
+			if err != nil {
+				t.Errorf("%s: %s", order, err)
+				continue
+			}
+			if maker, next := exifIFD0(t, unlinked); maker != "Camera Co" || next != 0 {
+				t.Errorf("%s: unlinked IFD0 has Make %q and links to %d, want Camera Co and 0", order, maker, next)
+			}
+			if !bytes.Equal(block, original) {
+				t.Errorf("%s: unlinking changed the image's own block", order)
+			}
+		}
+	}
+
+	for _, broken := range [][]byte{[]byte("Exif\x00\x00II"), []byte("Exif\x00\x00XX*\x00\x08\x00\x00\x00"), []byte("II*\x00\xff\x00\x00\x00")} {
+		if _, err := unlinkExifThumbnail(broken); err == nil {
+			t.Errorf("unlinkExifThumbnail(%q) didn't fail", broken)
+		}
+	}
+}
+
+// jpegExif is the EXIF block in jpegBytes' APP1 segment, nil without one
+func jpegExif(jpegBytes []byte) []byte {
+	for i := 2; i+4 <= len(jpegBytes) && jpegBytes[i] == 0xff; {
+		marker := jpegBytes[i+1]
+		length := int(binary.BigEndian.Uint16(jpegBytes[i+2:]))
+		segment := jpegBytes[i+4 : i+2+length]
+		if marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment
+		}
+		if marker == 0xda {
+			break
+		}
+		i += 2 + length
+	}
+	return nil
+}
+
+// withExif inserts exif into jpegBytes as an APP1 segment after SOI
+func withExif(jpegBytes []byte, exif []byte) []byte {
+	var withExif bytes.Buffer
+	withExif.Write(jpegBytes[:2])
+	withExif.Write([]byte{0xff, 0xe1})
+	binary.Write(&withExif, binary.BigEndian, uint16(len(exif)+2))
+	withExif.Write(exif)
+	withExif.Write(jpegBytes[2:])
+	return withExif.Bytes()
+}
+
+func TestStripExifThumbnail(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+	source := withExif(testJpeg(t, 64, 48), exifWithThumbnail(binary.BigEndian, "Camera Co"))
+	config.StripMetadata = false
+	config.Copyright = ""
+
+	for _, stripThumbnail := range []bool{false, true} {
+		config.StripExifThumbnail = stripThumbnail
+		image, err := vips.NewImageFromBuffer(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded, err := encodeImage(image, "jpeg", 80, false)
+		image.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		exif := jpegExif(encoded)
+		if exif == nil {
+			t.Errorf("-strip-exif-thumbnail=%t dropped all the EXIF", stripThumbnail)
+			continue
+		}
+		maker, next := exifIFD0(t, exif)
+		if maker != "Camera Co" {
+			t.Errorf("-strip-exif-thumbnail=%t: Make is %q, want Camera Co", stripThumbnail, maker)
+		}
+		if stripped := next == 0; stripped != stripThumbnail {
+			t.Errorf("-strip-exif-thumbnail=%t: IFD0 links to IFD1 at %d", stripThumbnail, next)
+		}
+	}
+}
+
+func TestMetadataCSVInImagesJSON(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+	defer func(saved map[string]imageMetadata) { galleryMetadata = saved }(galleryMetadata)
+	root := t.TempDir()
+	config.root = root
+
+	csvPath := filepath.Join(t.TempDir(), "metadata.csv")
+	csvRows := "path,title,caption,tags\n" +
+		"a.jpg,Harbour,\"Boats, at dawn\",sea; boats;\n" +
+		"./b/c.jpg, Forum ,,rome\n"
+	if err := os.WriteFile(csvPath, []byte(csvRows), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	galleryMetadata, err = loadMetadataCSV(csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path    string
+		title   string
+		caption string
+		tags    []string
+	}{
+		{"a.jpg", "Harbour", "Boats, at dawn", []string{"sea", "boats"}},
+		{"b/c.jpg", "Forum", "", []string{"rome"}},
+		{"b/d.jpg", "", "", nil},
+	}
+	for _, test := range tests {
+		imageData := &ImageData{path: filepath.Join(root, filepath.FromSlash(test.path)), name: strings.TrimSuffix(filepath.Base(test.path), ".jpg")}
+		imageData.FullPath = imageData.path
+		applyMetadata(imageData)
+		dir := filepath.Dir(imageData.path)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeDirImageData(dir, map[string]*ImageData{imageData.name: imageData}, true)
+
+		jsonBytes, err := os.ReadFile(filepath.Join(dir, "images.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var written DirImageData
+		if err := json.Unmarshal(jsonBytes, &written); err != nil {
+			t.Fatal(err)
+		}
+		entry := written.Images[imageData.name]
+		if entry == nil {
+			t.Errorf("%s: not in images.json", test.path)
+			continue
+		}
+		if entry.Title != test.title || entry.Caption != test.caption || !slices.Equal(entry.Tags, test.tags) {
+			t.Errorf("%s: images.json has %q, %q, %q, want %q, %q, %q", test.path, entry.Title, entry.Caption, entry.Tags, test.title, test.caption, test.tags)
+		}
+	}
+}
+
+func TestLoadMetadataCSVTooManyColumns(t *testing.T) {
+	csvPath := filepath.Join(t.TempDir(), "metadata.csv")
+	if err := os.WriteFile(csvPath, []byte("a.jpg,Harbour,Boats,sea,extra\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadMetadataCSV(csvPath); err == nil || !strings.Contains(err.Error(), ":1:") {
+		t.Errorf("loadMetadataCSV of a 5 column row = %v, want an error naming line 1", err)
+	}
+}
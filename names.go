@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// slugRegistry hands out unique slugs per directory
+type slugRegistry struct {
+	sync.Mutex
+	taken map[string]map[string]bool
+}
+
+var slugs = slugRegistry{taken: map[string]map[string]bool{}}
+
+// slugify lowercases name and collapses anything outside [a-z0-9] to single dashes
+func slugify(name string) string {
+	var slug strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			slug.WriteRune(r)
+			dash = false
+		} else if !dash && slug.Len() > 0 {
+			slug.WriteByte('-')
+			dash = true
+		}
+	}
+
+	if s := strings.TrimSuffix(slug.String(), "-"); s != "" {
+		return s
+	}
+	return "image"
+}
+
+// assign returns a slug for name unique within dir, adding -2, -3, ... on collisions
+func (r *slugRegistry) assign(dir string, name string) string {
+	r.Lock()
+	defer r.Unlock()
+
+	if _, exists := r.taken[dir]; !exists {
+		r.taken[dir] = map[string]bool{}
+	}
+
+	base := slugify(name)
+	slug := base
+	for i := 2; r.taken[dir][slug]; i++ {
+		slug = fmt.Sprintf("%s-%d", base, i)
+	}
+	r.taken[dir][slug] = true
+
+	return slug
+}
+
+// collisionStrategies are the -rename-on-collision ways to resolve sources in
+// one directory named the same but for their extension, like photo.jpg and
+// photo.png, whose derivatives and images.json entries would overwrite
+var collisionStrategies = map[string]bool{
+	"error":  true,
+	"suffix": true,
+	"skip":   true,
+}
+
+// nameRegistry records which source took each name, per directory
+type nameRegistry struct {
+	sync.Mutex
+	taken map[string]map[string]string
+}
+
+var sourceNames = nameRegistry{taken: map[string]map[string]string{}}
+
+// nameCollision is a source named as an earlier one of its directory was,
+// failing the run with -rename-on-collision error
+type nameCollision struct {
+	previous string
+	path     string
+	name     string
+}
+
+func (e *nameCollision) Error() string {
+	return fmt.Sprintf("%s and %s are both named %s, see -rename-on-collision", e.previous, e.path, e.name)
+}
+
+// cancelOnCollision passes on the walk's errc, cancelling the run with a
+// name collision as soon as the walk ends with one rather than once
+// everything walked before it is processed
+func cancelOnCollision(errc <-chan error, cancel context.CancelCauseFunc) <-chan error {
+	forwarded := make(chan error, 1)
+	go func() {
+		err := <-errc
+		var collision *nameCollision
+		if errors.As(err, &collision) {
+			cancel(err)
+		}
+		forwarded <- err
+	}()
+	return forwarded
+}
+
+// resolve claims imageData's name in its directory. Taken names get -2, -3,
+// ... added as slugs do, or with -rename-on-collision skip the later source
+// is dropped, keep false, and with error the run fails. Which source is later
+// is the listing order: both walks visit a directory's entries one at a time
+// sorted by name, and archives are read in entry order, so the same sources
+// always resolve the same way.
+func (r *nameRegistry) resolve(imageData *ImageData) (keep bool, err error) {
+	dir := filepath.Dir(imageData.path)
+
+	r.Lock()
+	defer r.Unlock()
+
+	if _, exists := r.taken[dir]; !exists {
+		r.taken[dir] = map[string]string{}
+	}
+
+	base := imageData.name
+	if previous, taken := r.taken[dir][base]; taken {
+		switch config.RenameOnCollision {
+		case "error":
+			return false, &nameCollision{previous, imageData.path, base}
+		case "skip":
+			logger.Warnf("Skipping %s, %s is already named %s", imageData.path, previous, base)
+			return false, nil
+		}
+
+		name := base
+		for i := 2; r.taken[dir][name] != ""; i++ {
+			name = fmt.Sprintf("%s-%d", base, i)
+		}
+		logger.Warnf("Naming %s %s, %s is already named %s", imageData.path, name, previous, base)
+		if imageData.OriginalName == "" {
+			imageData.OriginalName = filepath.Base(imageData.path)
+		}
+		imageData.name = name
+	}
+	r.taken[dir][imageData.name] = imageData.path
+
+	return true, nil
+}
+
+// dirDisplayName humanizes dir's name for galleries, holiday_2019-summer is
+// "Holiday 2019 Summer"
+func dirDisplayName(dir string) string {
+	if absDir, err := filepath.Abs(dir); err == nil {
+		dir = absDir
+	}
+
+	words := strings.FieldsFunc(filepath.Base(dir), func(r rune) bool {
+		return r == '_' || r == '-' || r == ' ' || r == '.'
+	})
+	for i, word := range words {
+		first, size := utf8.DecodeRuneInString(word)
+		words[i] = string(unicode.ToUpper(first)) + word[size:]
+	}
+	return strings.Join(words, " ")
+}
+
+// coverImage picks a directory's cover, the first of its images by name
+// that has a thumbnail
+func coverImage(imageData map[string]*ImageData) string {
+	cover := ""
+	for name, data := range imageData {
+		if data.ThumbPath != "" && (cover == "" || name < cover) {
+			cover = name
+		}
+	}
+	return cover
+}
+
+// prefixFileName overrides the -dir-prefix of the directory it's in with its
+// contents, an empty file leaves the directory unprefixed
+const prefixFileName = ".prefix"
+
+// prefixRegistry caches the -dir-prefix of each directory
+type prefixRegistry struct {
+	sync.Mutex
+	dirs map[string]string
+}
+
+var prefixes = prefixRegistry{dirs: map[string]string{}}
+
+// of is the prefix for derivatives of sources in dir. The root has none but
+// from a prefix file.
+func (r *prefixRegistry) of(dir string) string {
+	if !config.DirPrefix {
+		return ""
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if prefix, exists := r.dirs[dir]; exists {
+		return prefix
+	}
+
+	var prefix string
+	if contents, err := os.ReadFile(filepath.Join(dir, prefixFileName)); err == nil {
+		prefix = strings.TrimSpace(string(contents))
+	} else if filepath.Clean(dir) != filepath.Clean(config.root) {
+		prefix = slugify(filepath.Base(dir))
+	}
+	r.dirs[dir] = prefix
+
+	return prefix
+}
+
+// renameSource moves the source file to its slug name, leaving it alone if
+// that would overwrite something
+func renameSource(imageData *ImageData) error {
+	ext := strings.ToLower(filepath.Ext(imageData.path))
+	renamed := filepath.Join(filepath.Dir(imageData.path), imageData.Slug+ext)
+	if renamed == imageData.path {
+		return nil
+	}
+
+	if _, err := os.Lstat(renamed); err == nil {
+		return fmt.Errorf("not renaming %s, %s already exists", imageData.path, renamed)
+	}
+
+	logger.Infof("Renaming %s to %s", imageData.path, renamed)
+	if err := os.Rename(imageData.path, renamed); err != nil {
+		return err
+	}
+	imageData.path = renamed
+
+	return nil
+}
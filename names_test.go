@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNameRegistryResolve(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+
+	tests := []struct {
+		strategy string
+		keep     []bool
+		names    []string
+		failed   bool
+	}{
+		{"suffix", []bool{true, true, true}, []string{"photo", "photo-2", "photo-3"}, false},
+		{"skip", []bool{true, false, false}, []string{"photo", "photo", "photo"}, false},
+		{"error", []bool{true, false, false}, []string{"photo", "photo", "photo"}, true},
+	}
+	for _, test := range tests {
+		config.RenameOnCollision = test.strategy
+		registry := nameRegistry{taken: map[string]map[string]string{}}
+
+		// the same name in another directory never collides
+		elsewhere := &ImageData{path: "other/photo.jpg", name: "photo"}
+		if keep, err := registry.resolve(elsewhere); !keep || err != nil || elsewhere.name != "photo" {
+			t.Errorf("%s: other/photo.jpg resolved to %q, %t, %v", test.strategy, elsewhere.name, keep, err)
+		}
+
+		for i, ext := range []string{".jpg", ".png", ".tif"} {
+			imageData := &ImageData{path: "dir/photo" + ext, name: "photo"}
+			keep, err := registry.resolve(imageData)
+			if keep != test.keep[i] || imageData.name != test.names[i] {
+				t.Errorf("%s: photo%s resolved to %q, keep %t, want %q, keep %t", test.strategy, ext, imageData.name, keep, test.names[i], test.keep[i])
+			}
+			if failed := err != nil; failed != (test.failed && i > 0) {
+				t.Errorf("%s: photo%s error %v", test.strategy, ext, err)
+			}
+			if err != nil && !strings.Contains(err.Error(), "dir/photo.jpg") {
+				t.Errorf("%s: error %q doesn't name the first source", test.strategy, err)
+			}
+			if test.strategy == "suffix" && i > 0 && imageData.OriginalName != "photo"+ext {
+				t.Errorf("suffix: photo%s recorded original name %q", ext, imageData.OriginalName)
+			}
+		}
+	}
+}
+
+func TestCancelOnCollision(t *testing.T) {
+	collision := &nameCollision{"dir/photo.jpg", "dir/photo.png", "photo"}
+	tests := []struct {
+		err       error
+		cancelled bool
+	}{
+		{nil, false},
+		{errors.New("permission denied"), false},
+		{collision, true},
+	}
+	for _, test := range tests {
+		ctx, cancel := context.WithCancelCause(context.Background())
+		errc := make(chan error, 1)
+		errc <- test.err
+		if err := <-cancelOnCollision(errc, cancel); err != test.err {
+			t.Errorf("passed on %v, want %v", err, test.err)
+		}
+		if cancelled := context.Cause(ctx) != nil; cancelled != test.cancelled {
+			t.Errorf("%v cancelled the run %t, want %t", test.err, cancelled, test.cancelled)
+		}
+		if test.cancelled && context.Cause(ctx) != test.err {
+			t.Errorf("cancelled with %v, want the collision", context.Cause(ctx))
+		}
+		cancel(nil)
+	}
+}
+
+func TestDirPrefix(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+	defer func(saved map[string]string) { prefixes.dirs = saved }(prefixes.dirs)
+	root := t.TempDir()
+	config.root = root
+	config.DirPrefix = true
+
+	rome := filepath.Join(root, "Rome Trip")
+	oslo := filepath.Join(root, "oslo")
+	for _, dir := range []string{rome, oslo} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(oslo, prefixFileName), []byte("norway\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		layout string
+		dir    string
+		base   string
+		key    string
+	}{
+		{"mirrored", root, filepath.Join(root, "photo"), "photo"},
+		{"mirrored", rome, filepath.Join(rome, "rome-trip-photo"), "photo"},
+		{"mirrored", oslo, filepath.Join(oslo, "norway-photo"), "photo"},
+		{"flat", rome, filepath.Join(root, "Rome Trip__rome-trip-photo"), "Rome Trip__rome-trip-photo"},
+		{"flat", oslo, filepath.Join(root, "oslo__norway-photo"), "oslo__norway-photo"},
+	}
+	for _, test := range tests {
+		config.OutputLayout = test.layout
+		prefixes.dirs = map[string]string{}
+
+		imageData := &ImageData{path: filepath.Join(test.dir, "photo.jpg"), name: "photo"}
+		imageData.outputBase = derivativeBase(imageData)
+		if imageData.outputBase != test.base {
+			t.Errorf("%s: %s derivatives named %q, want %q", test.layout, imageData.path, imageData.outputBase, test.base)
+		}
+		imageData.FullPath = imageData.path
+		imageData.ThumbPath = imageData.outputBase + "-thumbnail.jpg"
+		imageData.DisplayPath = imageData.outputBase + "-display.jpg"
+
+		dir, key := imageDataKey(imageData)
+		if key != test.key {
+			t.Errorf("%s: %s recorded as %q, want %q", test.layout, imageData.path, key, test.key)
+		}
+		writeDirImageData(dir, map[string]*ImageData{key: imageData}, false)
+
+		jsonBytes, err := os.ReadFile(filepath.Join(dir, "images.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var written DirImageData
+		if err := json.Unmarshal(jsonBytes, &written); err != nil {
+			t.Fatal(err)
+		}
+		entry := written.Images[test.key]
+		if entry == nil {
+			t.Errorf("%s: images.json in %s has no %q entry", test.layout, dir, test.key)
+			continue
+		}
+		if entry.ThumbPath != test.base+"-thumbnail.jpg" || entry.DisplayPath != test.base+"-display.jpg" {
+			t.Errorf("%s: images.json records %q and %q, want the %q derivatives", test.layout, entry.ThumbPath, entry.DisplayPath, test.base)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// OSDTiles is an OpenSeadragon inline DZI tile source, what -osd-tile-sources
+// records so a viewer can open the tiles without fetching the .dzi
+type OSDTiles struct {
+	Image osdImage `json:"Image"`
+}
+
+// osdImage mirrors the .dzi Image element, its attributes as strings as
+// OpenSeadragon's own JSON form of a .dzi has them
+type osdImage struct {
+	Xmlns    string  `json:"xmlns"`
+	Url      string  `json:"Url"`
+	Format   string  `json:"Format"`
+	Overlap  string  `json:"Overlap"`
+	TileSize string  `json:"TileSize"`
+	Size     osdSize `json:"Size"`
+}
+
+type osdSize struct {
+	Width  string `json:"Width"`
+	Height string `json:"Height"`
+}
+
+// readTileSource builds imageData's OpenSeadragon tile source from the .dzi
+// dzsave wrote for its tiles, wherever -keep-dzi left it. The Url is the
+// tiles directory, replaced by its -tiles-ref once recorded.
+func readTileSource(imageData *ImageData) (*OSDTiles, error) {
+	descriptorPath := imageData.outputBase + ".dzi"
+	if _, err := os.Stat(descriptorPath); err != nil {
+		descriptorPath = filepath.Join(imageData.Tiles, tileDescriptor)
+	}
+	descriptor, err := os.ReadFile(descriptorPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var dzi dziImage
+	if err := xml.Unmarshal(descriptor, &dzi); err != nil {
+		return nil, fmt.Errorf("%s: %w", descriptorPath, err)
+	}
+	// what OpenSeadragon's DziTileSource needs to address tiles
+	if dzi.Format == "" || dzi.TileSize < 1 || dzi.Overlap < 0 || dzi.Overlap >= dzi.TileSize || dzi.Size.Width < 1 || dzi.Size.Height < 1 {
+		return nil, fmt.Errorf("%s isn't a usable tile source: %+v", descriptorPath, dzi)
+	}
+
+	return &OSDTiles{Image: osdImage{
+		Xmlns:    dzi.XMLName.Space,
+		Url:      imageData.Tiles + "/",
+		Format:   dzi.Format,
+		Overlap:  strconv.Itoa(dzi.Overlap),
+		TileSize: strconv.Itoa(dzi.TileSize),
+		Size:     osdSize{Width: strconv.Itoa(dzi.Size.Width), Height: strconv.Itoa(dzi.Size.Height)},
+	}}, nil
+}
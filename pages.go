@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// multiPageExtensions are the sources -page-previews splits into pages
+var multiPageExtensions = map[string]bool{
+	".tif":  true,
+	".tiff": true,
+	".pdf":  true,
+}
+
+// heifPrimaryField is the vips metadata holding which of a HEIF's images
+// is the primary one, the photo loaded by default
+const heifPrimaryField = "heif-primary"
+
+// isHeif reports a HEIF source, which from an iPhone may hold burst frames
+// besides the photo
+func isHeif(path string) bool {
+	return sourceFormat(path) == "heic"
+}
+
+// pagePreviewDelay is how long in ms the animated preview shows each page
+const pagePreviewDelay = 1000
+
+func isMultiPage(path string) bool {
+	return multiPageExtensions[strings.ToLower(filepath.Ext(path))]
+}
+
+// pdfUnsupported reports a pdf source this libvips was built without a
+// loader for
+func pdfUnsupported(path string) bool {
+	return strings.ToLower(filepath.Ext(path)) == ".pdf" && !vips.IsTypeSupported(vips.ImageTypePDF)
+}
+
+// generatePages writes a full rendition of each page but the primary one,
+// the first unless a HEIF says otherwise, which is the full rendition itself
+func generatePages(imageData *ImageData) error {
+	pagePaths := []string{imageData.FullPath}
+	for page := 0; page < imageData.PageCount; page++ {
+		if page == imageData.primaryPage {
+			continue
+		}
+		params := loaderParams(imageData.path)
+		params.Page.Set(page)
+
+		var image *vips.ImageRef
+		var err error
+		if imageData.source != nil {
+			image, err = vips.LoadImageFromBuffer(imageData.source, params)
+		} else {
+			image, err = vips.LoadImageFromFile(imageData.path, params)
+		}
+		if err != nil {
+			return fmt.Errorf("page %d: %w", page+1, err)
+		}
+
+		pageBytes, err := exportPage(image, imageData.FullFormat)
+		width, height := image.Width(), image.Height()
+		image.Close()
+		if err != nil {
+			return fmt.Errorf("page %d: %w", page+1, err)
+		}
+
+		pagePath := fmt.Sprintf("%s-page-%d%s", imageData.outputBase, page+1, formatExtensions[imageData.FullFormat])
+		outputPaths.claim(pagePath, imageData.path)
+		if err := writeVerified(pagePath, pageBytes, width, height); err != nil {
+			return err
+		}
+		pagePaths = append(pagePaths, pagePath)
+	}
+
+	imageData.PagePaths = pagePaths
+	return nil
+}
+
+func exportPage(image *vips.ImageRef, format string) ([]byte, error) {
+	if err := image.ToColorSpace(vips.InterpretationSRGB); err != nil {
+		return nil, err
+	}
+	return exportFullImage(image, format, renditionQuality(config.FullQuality, format, image))
+}
+
+// generatePagePreview writes an animated webp thumbnail cycling through
+// every page. The pages must all be one size for vips to load them together.
+func generatePagePreview(imageData *ImageData) error {
+	params := loaderParams(imageData.path)
+	params.NumPages.Set(-1)
+
+	var preview *vips.ImageRef
+	var err error
+	if imageData.source != nil {
+		preview, err = vips.LoadThumbnailFromBuffer(imageData.source, config.ThumbMaxWidth, config.ThumbnailHeight, vips.InterestingNone, vips.SizeBoth, params)
+	} else {
+		preview, err = vips.LoadThumbnailFromFile(imageData.path, config.ThumbMaxWidth, config.ThumbnailHeight, vips.InterestingNone, vips.SizeBoth, params)
+	}
+	if err != nil {
+		return err
+	}
+	defer preview.Close()
+
+	if err := preview.ToColorSpace(vips.InterpretationSRGB); err != nil {
+		return err
+	}
+
+	delays := make([]int, preview.Pages())
+	for i := range delays {
+		delays[i] = pagePreviewDelay
+	}
+	if err := preview.SetPageDelay(delays); err != nil {
+		return err
+	}
+
+	previewBytes, err := exportImage(preview, "webp", renditionQuality(config.ThumbQuality, "webp", preview))
+	if err != nil {
+		return err
+	}
+
+	previewPath := imageData.outputBase + "-preview.webp"
+	outputPaths.claim(previewPath, imageData.path)
+	if err := writeVerified(previewPath, previewBytes, preview.Width(), preview.GetPageHeight()); err != nil {
+		return err
+	}
+	imageData.PreviewPath = previewPath
+	// the pages are stacked into one tall image
+	imageData.PreviewWidth = preview.Width()
+	imageData.PreviewHeight = preview.GetPageHeight()
+	return nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// jsonSorts are the -json-sort orders of the images in -json-page-size pages
+var jsonSorts = map[string]bool{
+	"name": true,
+	"date": true,
+}
+
+// dirImageIndexName is what a -json-page-size directory's images.json is
+// replaced by, describing its pages
+const dirImageIndexName = "images-index.json"
+
+// DirImageIndex is images-index.json, images.json with its images split
+// into Pages, files of PageSize images each in Sort order
+type DirImageIndex struct {
+	Meta          RunMeta  `json:"meta"`
+	Name          string   `json:"name"`
+	Count         int      `json:"count"`
+	Cover         string   `json:"cover,omitempty"`
+	ContactSheets []string `json:"contact_sheets,omitempty"`
+	Sort          string   `json:"sort"`
+	PageSize      int      `json:"page_size"`
+	PageCount     int      `json:"page_count"`
+	Pages         []string `json:"pages"`
+}
+
+// DirImagePage is one images-N.json of a paginated directory
+type DirImagePage struct {
+	Page   int          `json:"page"`
+	Images []PagedImage `json:"images"`
+}
+
+// PagedImage is an images.json entry in a page, with the name it's keyed
+// by in images.json
+type PagedImage struct {
+	Name  string     `json:"name"`
+	Image *ImageData `json:"image"`
+}
+
+func isDirImageIndex(jsonPath string) bool {
+	return strings.TrimSuffix(filepath.Base(jsonPath), ".gz") == dirImageIndexName
+}
+
+// pageName is the file name of page n, gzipped like its index
+func pageName(n int, gzipped bool) string {
+	name := fmt.Sprintf("images-%d.json", n)
+	if gzipped {
+		name += ".gz"
+	}
+	return name
+}
+
+// pageOrder is the names of images in -json-sort order. By date, undated
+// images go last, and ties keep name order, so pages don't shuffle between
+// runs.
+func pageOrder(images map[string]*ImageData) []string {
+	names := make([]string, 0, len(images))
+	for name := range images {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if config.JSONSort == "date" {
+		sort.SliceStable(names, func(i, j int) bool {
+			a, b := images[names[i]].CaptureDate, images[names[j]].CaptureDate
+			if a == "" || b == "" {
+				return a != "" && b == ""
+			}
+			return a < b
+		})
+	}
+	return names
+}
+
+// writeDirPages writes dirImageData as the index at indexPath and its
+// pages beside it, removing pages left over from a run with more images
+func writeDirPages(indexPath string, dirImageData DirImageData) error {
+	dir := filepath.Dir(indexPath)
+	gzipped := strings.HasSuffix(indexPath, ".gz")
+	names := pageOrder(dirImageData.Images)
+
+	index := DirImageIndex{
+		Meta:          dirImageData.Meta,
+		Name:          dirImageData.Name,
+		Count:         dirImageData.Count,
+		Cover:         dirImageData.Cover,
+		ContactSheets: dirImageData.ContactSheets,
+		Sort:          config.JSONSort,
+		PageSize:      config.JSONPageSize,
+		Pages:         []string{},
+	}
+	for start := 0; start < len(names); start += config.JSONPageSize {
+		page := DirImagePage{Page: len(index.Pages)}
+		for _, name := range names[start:min(start+config.JSONPageSize, len(names))] {
+			page.Images = append(page.Images, PagedImage{name, dirImageData.Images[name]})
+		}
+
+		name := pageName(page.Page, gzipped)
+		outputPaths.claim(filepath.Join(dir, name), dir)
+		if err := writeJSONFile(filepath.Join(dir, name), page); err != nil {
+			return err
+		}
+		index.Pages = append(index.Pages, name)
+	}
+	index.PageCount = len(index.Pages)
+
+	outputPaths.claim(indexPath, dir)
+	if err := writeJSONFile(indexPath, index); err != nil {
+		return err
+	}
+
+	for n := index.PageCount; ; n++ {
+		stale := filepath.Join(dir, pageName(n, gzipped))
+		if err := os.Remove(stale); err != nil {
+			if !os.IsNotExist(err) {
+				return err
+			}
+			return nil
+		}
+		logger.Infof("Removed stale page %s", stale)
+	}
+}
+
+// writeJSONFile writes v to path as -json-pretty and -json-gzip have it for
+// images.json
+func writeJSONFile(path string, v any) error {
+	var data []byte
+	var err error
+	if config.JSONPretty {
+		data, err = json.MarshalIndent(v, "", "  ")
+	} else {
+		data, err = json.Marshal(v)
+	}
+	if err != nil {
+		return err
+	}
+
+	if strings.HasSuffix(path, ".gz") {
+		var compressed bytes.Buffer
+		gzipWriter := gzip.NewWriter(&compressed)
+		if _, err := gzipWriter.Write(data); err != nil {
+			return err
+		}
+		if err := gzipWriter.Close(); err != nil {
+			return err
+		}
+		data = compressed.Bytes()
+	}
+	return writeFile(path, data)
+}
+
+// readDirPages reassembles the paginated images.json indexed by indexPath,
+// so what reads images.json reads it alike
+func readDirPages(indexPath string) ([]byte, error) {
+	indexJson, err := readJSONFile(indexPath)
+	if err != nil {
+		return nil, err
+	}
+	var index DirImageIndex
+	if err := json.Unmarshal(indexJson, &index); err != nil {
+		return nil, err
+	}
+
+	dirImageData := DirImageData{
+		Meta:          index.Meta,
+		Name:          index.Name,
+		Count:         index.Count,
+		Cover:         index.Cover,
+		ContactSheets: index.ContactSheets,
+		Images:        map[string]*ImageData{},
+	}
+	for _, name := range index.Pages {
+		pagePath := filepath.Join(filepath.Dir(indexPath), filepath.Base(name))
+		pageJson, err := readJSONFile(pagePath)
+		if err != nil {
+			return nil, err
+		}
+		var page DirImagePage
+		if err := json.Unmarshal(pageJson, &page); err != nil {
+			return nil, fmt.Errorf("%s: %w", pagePath, err)
+		}
+		for _, image := range page.Images {
+			dirImageData.Images[image.Name] = image.Image
+		}
+	}
+	return json.Marshal(dirImageData)
+}
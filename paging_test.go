@@ -0,0 +1,35 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPageOrder(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+	images := map[string]*ImageData{
+		"delta":   {CaptureDate: "2024-05-01T10:00:00Z"},
+		"alpha":   {CaptureDate: "2024-05-01T10:00:00Z"},
+		"charlie": {CaptureDate: "2023-01-01T00:00:00Z"},
+		"echo":    {},
+		"bravo":   {},
+		"foxtrot": {CaptureDate: "2024-05-01T10:00:00Z"},
+	}
+
+	tests := []struct {
+		sort  string
+		order []string
+	}{
+		{"name", []string{"alpha", "bravo", "charlie", "delta", "echo", "foxtrot"}},
+		{"date", []string{"charlie", "alpha", "delta", "foxtrot", "bravo", "echo"}},
+	}
+	for _, test := range tests {
+		config.JSONSort = test.sort
+		// map order differs between calls, pages mustn't
+		for i := 0; i < 10; i++ {
+			if order := pageOrder(images); !reflect.DeepEqual(order, test.order) {
+				t.Fatalf("-json-sort %s order %v, want %v", test.sort, order, test.order)
+			}
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// recordedPath is how path is written to images.json: as given, or with
+// -path-base relative to the base and slash separated for the web
+func recordedPath(path string) string {
+	if config.pathBase == "" || path == "" {
+		return path
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	relPath, err := filepath.Rel(config.pathBase, absPath)
+	if err != nil {
+		return path
+	}
+	return filepath.ToSlash(relPath)
+}
+
+// localPath turns a path read back from images.json into one to open
+func localPath(path string) string {
+	if config.pathBase == "" || path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(config.pathBase, filepath.FromSlash(path))
+}
+
+// tilesRefStyles are the -tiles-ref ways of referencing an image's tiles
+var tilesRefStyles = map[string]bool{
+	"path":     true,
+	"relative": true,
+	"url":      true,
+	"iiif":     true,
+}
+
+// tilesRef is how the images.json in dir references imageData's tiles. One
+// that can't be made, outside the served root, falls back to the path.
+func tilesRef(dir string, imageData *ImageData) string {
+	if imageData.Tiles == "" {
+		return ""
+	}
+
+	switch config.TilesRef {
+	case "relative":
+		if relPath, ok := relativeTo(dir, imageData.Tiles); ok {
+			return relPath
+		}
+	case "url":
+		if relPath, ok := relativeTo(servedRoot(), imageData.Tiles); ok {
+			ref := *config.tilesURLBase
+			ref.Path = path.Join("/", ref.Path, relPath)
+			ref.RawPath = ""
+			return ref.String()
+		}
+	case "iiif":
+		// the identifier is a single path segment, its slashes escaped
+		if relPath, ok := relativeTo(servedRoot(), imageData.FullPath); ok {
+			ref := *config.tilesURLBase
+			ref.RawPath = strings.TrimSuffix(ref.EscapedPath(), "/") + "/" + url.PathEscape(relPath)
+			ref.Path = strings.TrimSuffix(ref.Path, "/") + "/" + relPath
+			return ref.String()
+		}
+	default:
+		return recordedPath(imageData.Tiles)
+	}
+
+	logger.Warnf("-tiles-ref %s: %s is outside %s, recording its path", config.TilesRef, imageData.path, servedRoot())
+	return recordedPath(imageData.Tiles)
+}
+
+// servedRoot is the directory -tiles-url-base serves
+func servedRoot() string {
+	if config.pathBase != "" {
+		return config.pathBase
+	}
+	return config.root
+}
+
+// relativeTo is target relative to base and slash separated, ok is false
+// if target isn't under base
+func relativeTo(base string, target string) (string, bool) {
+	absBase, err := filepath.Abs(base)
+	if err != nil {
+		return "", false
+	}
+	absTarget, err := filepath.Abs(target)
+	if err != nil {
+		return "", false
+	}
+	relPath, err := filepath.Rel(absBase, absTarget)
+	if err != nil || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(relPath), true
+}
+
+// withRecordedPaths copies imageData, the images of the images.json in dir,
+// with every path as recordedPath has it and tiles as tilesRef does
+func withRecordedPaths(dir string, imageData map[string]*ImageData) map[string]*ImageData {
+	if config.pathBase == "" && config.TilesRef == "path" {
+		return imageData
+	}
+
+	recorded := make(map[string]*ImageData, len(imageData))
+	for name, data := range imageData {
+		copied := *data
+		copied.FullPath = recordedPath(data.FullPath)
+		copied.ThumbPath = recordedPath(data.ThumbPath)
+		copied.ThumbSquarePath = recordedPath(data.ThumbSquarePath)
+		copied.DisplayPath = recordedPath(data.DisplayPath)
+		copied.Tiles = tilesRef(dir, data)
+		if data.TileSource != nil {
+			tileSource := *data.TileSource
+			tileSource.Image.Url = copied.Tiles + "/"
+			copied.TileSource = &tileSource
+		}
+		copied.DziPath = recordedPath(data.DziPath)
+		copied.PreviewPath = recordedPath(data.PreviewPath)
+		copied.Sizes = nil
+		for name, sized := range data.Sizes {
+			if copied.Sizes == nil {
+				copied.Sizes = make(sizedMap, len(data.Sizes))
+			}
+			sized.Path = recordedPath(sized.Path)
+			copied.Sizes[name] = sized
+		}
+		copied.PagePaths = nil
+		for _, pagePath := range data.PagePaths {
+			copied.PagePaths = append(copied.PagePaths, recordedPath(pagePath))
+		}
+		recorded[name] = &copied
+	}
+	return recorded
+}
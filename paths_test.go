@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/url"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecordedPath(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+	base := t.TempDir()
+
+	tests := []struct {
+		pathBase string
+		path     string
+		recorded string
+	}{
+		{"", filepath.Join(base, "a", "b.jpg"), filepath.Join(base, "a", "b.jpg")},
+		{base, filepath.Join(base, "a", "b.jpg"), "a/b.jpg"},
+		{base, filepath.Join(base, "a", "..", "c", "d_files"), "c/d_files"},
+		{filepath.Join(base, "site"), filepath.Join(base, "originals", "b.jpg"), "../originals/b.jpg"},
+		{base, "", ""},
+	}
+	for _, test := range tests {
+		config.pathBase = test.pathBase
+		recorded := recordedPath(test.path)
+		if recorded != test.recorded {
+			t.Errorf("recordedPath(%q) under %q = %q, want %q", test.path, test.pathBase, recorded, test.recorded)
+		}
+		if test.pathBase != "" && filepath.IsAbs(recorded) {
+			t.Errorf("recordedPath(%q) under %q leaked the absolute path %q", test.path, test.pathBase, recorded)
+		}
+		if test.pathBase != "" && test.path != "" && filepath.Clean(localPath(recorded)) != filepath.Clean(test.path) {
+			t.Errorf("localPath(%q) = %q, want %q", recorded, localPath(recorded), test.path)
+		}
+	}
+}
+
+func TestTilesRef(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+	root := t.TempDir()
+	base, err := url.Parse("https://cdn.example.com/gallery/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(root, "2024", "rome")
+	imageData := &ImageData{
+		path:     filepath.Join(dir, "forum one.jpg"),
+		FullPath: filepath.Join(dir, "forum one.jpg"),
+		Tiles:    filepath.Join(dir, "forum one_files"),
+	}
+	outside := &ImageData{
+		path:     filepath.Join(t.TempDir(), "stray.jpg"),
+		FullPath: "stray.jpg",
+		Tiles:    filepath.Join(filepath.Dir(root), "stray_files"),
+	}
+
+	tests := []struct {
+		tilesRef  string
+		pathBase  string
+		imageData *ImageData
+		ref       string
+	}{
+		{"path", "", imageData, imageData.Tiles},
+		{"path", root, imageData, "2024/rome/forum one_files"},
+		{"relative", "", imageData, "forum one_files"},
+		{"url", "", imageData, "https://cdn.example.com/gallery/2024/rome/forum%20one_files"},
+		{"url", dir, imageData, "https://cdn.example.com/gallery/forum%20one_files"},
+		{"iiif", "", imageData, "https://cdn.example.com/gallery/2024%2Frome%2Fforum%20one.jpg"},
+		{"url", root, outside, "../stray_files"},
+		{"path", "", &ImageData{}, ""},
+	}
+	for _, test := range tests {
+		config.root = root
+		config.pathBase = test.pathBase
+		config.TilesRef = test.tilesRef
+		config.tilesURLBase = base
+		if ref := tilesRef(dir, test.imageData); ref != test.ref {
+			t.Errorf("-tiles-ref %s with base %q = %q, want %q", test.tilesRef, test.pathBase, ref, test.ref)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+	"strconv"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// phashSize is the side of the grayscale image the DCT is taken over
+const phashSize = 32
+
+// phashBits is the side of the low frequency DCT block kept for the hash
+const phashBits = 8
+
+// sourcePerceptualHash hashes imageData's source, shrinking on load instead
+// of decoding it at full size. RAW can't be, so uses the developed image.
+func sourcePerceptualHash(imageData *ImageData, image *vips.ImageRef) (string, error) {
+	if imageData.IsRaw {
+		return perceptualHash(image)
+	}
+
+	var small *vips.ImageRef
+	var err error
+	if imageData.source != nil {
+		small, err = vips.NewThumbnailWithSizeFromBuffer(imageData.source, phashSize, phashSize, vips.InterestingNone, vips.SizeForce)
+	} else {
+		small, err = vips.NewThumbnailWithSizeFromFile(imageData.path, phashSize, phashSize, vips.InterestingNone, vips.SizeForce)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer small.Close()
+
+	return perceptualHash(small)
+}
+
+// perceptualHash is the 64-bit DCT hash of image as hex. Images that look
+// alike end up a small Hamming distance apart even after resaving or light
+// edits. image is left untouched.
+func perceptualHash(image *vips.ImageRef) (string, error) {
+	small, err := image.Copy()
+	if err != nil {
+		return "", err
+	}
+	defer small.Close()
+
+	if err := small.ThumbnailWithSize(phashSize, phashSize, vips.InterestingNone, vips.SizeForce); err != nil {
+		return "", err
+	}
+	if err := small.ToColorSpace(vips.InterpretationBW); err != nil {
+		return "", err
+	}
+	if small.Bands() > 1 {
+		if err := small.ExtractBand(0, 1); err != nil {
+			return "", err
+		}
+	}
+	if err := small.Cast(vips.BandFormatUchar); err != nil {
+		return "", err
+	}
+
+	pixels, err := small.ToBytes()
+	if err != nil {
+		return "", err
+	}
+	if len(pixels) != phashSize*phashSize {
+		return "", fmt.Errorf("unexpected %d bytes for %dx%d grayscale", len(pixels), phashSize, phashSize)
+	}
+
+	var values [phashSize][phashSize]float64
+	for y := 0; y < phashSize; y++ {
+		for x := 0; x < phashSize; x++ {
+			values[y][x] = float64(pixels[y*phashSize+x])
+		}
+	}
+
+	// low frequency DCT-II coefficients, the DC term carries no structure so is skipped
+	coefficients := make([]float64, 0, phashBits*phashBits)
+	for v := 0; v < phashBits; v++ {
+		for u := 0; u < phashBits; u++ {
+			if u == 0 && v == 0 {
+				continue
+			}
+			coefficients = append(coefficients, dct(&values, u, v))
+		}
+	}
+
+	sorted := append([]float64(nil), coefficients...)
+	sort.Float64s(sorted)
+	median := sorted[len(sorted)/2]
+
+	var hash uint64
+	for i, coefficient := range coefficients {
+		if coefficient > median {
+			hash |= 1 << uint(i)
+		}
+	}
+
+	return fmt.Sprintf("%016x", hash), nil
+}
+
+func dct(values *[phashSize][phashSize]float64, u int, v int) float64 {
+	var sum float64
+	for y := 0; y < phashSize; y++ {
+		for x := 0; x < phashSize; x++ {
+			sum += values[y][x] *
+				math.Cos(float64(2*x+1)*float64(u)*math.Pi/(2*phashSize)) *
+				math.Cos(float64(2*y+1)*float64(v)*math.Pi/(2*phashSize))
+		}
+	}
+	return sum
+}
+
+// hashedImage is one entry considered by the near-duplicate report
+type hashedImage struct {
+	path string
+	hash uint64
+}
+
+// reportNearDuplicates logs every pair of images whose hashes are within
+// threshold bits of each other
+func reportNearDuplicates(images []hashedImage, threshold int) {
+	sort.Slice(images, func(i, j int) bool { return images[i].path < images[j].path })
+
+	pairs := 0
+	for i := range images {
+		for j := i + 1; j < len(images); j++ {
+			distance := bits.OnesCount64(images[i].hash ^ images[j].hash)
+			if distance <= threshold {
+				logger.Warnf("Near-duplicate (distance %d): %s and %s", distance, images[i].path, images[j].path)
+				pairs++
+			}
+		}
+	}
+
+	logger.Infof("Found %d near-duplicate pairs among %d images", pairs, len(images))
+}
+
+func parsePerceptualHash(hash string) (uint64, error) {
+	return strconv.ParseUint(hash, 16, 64)
+}
@@ -1,63 +1,334 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/davidbyttow/govips/v2/vips"
+	"golang.org/x/time/rate"
+	"io"
 	"io/fs"
-	"log"
 	"math"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 )
 
 type ImageData struct {
-	FullPath    string `json:"full_path"`
-	ThumbPath   string `json:"thumb_path"`
-	DisplayPath string `json:"display_path"`
-	Width       int    `json:"width"`
-	Height      int    `json:"height"`
-	Tiles       string `json:"tiles,omitempty"`
-	MaxWidth    int    `json:"max_width,omitempty"`
-	MaxHeight   int    `json:"max_height,omitempty"`
-	path        string `json:"-"`
-	name        string `json:"-"`
+	FullPath        string    `json:"full_path"`
+	ThumbPath       string    `json:"thumb_path"`
+	ThumbFormat     string    `json:"thumb_format,omitempty"`
+	ThumbWidth      int       `json:"thumb_width,omitempty"`
+	ThumbHeight     int       `json:"thumb_height,omitempty"`
+	CheckerThumb    bool      `json:"checker_thumb,omitempty"`
+	ThumbSquarePath string    `json:"thumb_square_path,omitempty"`
+	SquareWidth     int       `json:"thumb_square_width,omitempty"`
+	SquareHeight    int       `json:"thumb_square_height,omitempty"`
+	DisplayPath     string    `json:"display_path"`
+	DisplayWidth    int       `json:"display_width,omitempty"`
+	DisplayHeight   int       `json:"display_height,omitempty"`
+	DisplayFormat   string    `json:"display_format,omitempty"`
+	FullFormat      string    `json:"full_format,omitempty"`
+	SourceFormat    string    `json:"source_format,omitempty"`
+	Width           int       `json:"width"`
+	Height          int       `json:"height"`
+	Cropped         bool      `json:"cropped,omitempty"`
+	Crop            *CropRect `json:"crop,omitempty"`
+	Focal           *Focal    `json:"focal,omitempty"`
+	Trim            *TrimBox  `json:"trim,omitempty"`
+	PageCount       int       `json:"page_count,omitempty"`
+	FrameCount      int       `json:"frame_count,omitempty"`
+	PagePaths       []string  `json:"page_paths,omitempty"`
+	PreviewPath     string    `json:"preview_path,omitempty"`
+	PreviewWidth    int       `json:"preview_width,omitempty"`
+	PreviewHeight   int       `json:"preview_height,omitempty"`
+	Sizes           sizedMap  `json:"sizes,omitempty"`
+	Tiles           string    `json:"tiles,omitempty"`
+	TileLevels      int       `json:"tile_levels,omitempty"`
+	DziPath         string    `json:"dzi_path,omitempty"`
+	TileSource      *OSDTiles `json:"tile_source,omitempty"`
+	ThumbSize       int64     `json:"thumb_size,omitempty"`
+	DisplaySize     int64     `json:"display_size,omitempty"`
+	FullSize        int64     `json:"full_size,omitempty"`
+	TilesSize       int64     `json:"tiles_size,omitempty"`
+	MaxWidth        int       `json:"max_width,omitempty"`
+	MaxHeight       int       `json:"max_height,omitempty"`
+	HasAlpha        bool      `json:"has_alpha,omitempty"`
+	OriginalName    string    `json:"original_name,omitempty"`
+	Slug            string    `json:"slug,omitempty"`
+	IsRaw           bool      `json:"is_raw,omitempty"`
+	PHash           string    `json:"phash,omitempty"`
+	Title           string    `json:"title,omitempty"`
+	Caption         string    `json:"caption,omitempty"`
+	Tags            []string  `json:"tags,omitempty"`
+	CaptureDate     string    `json:"capture_date,omitempty"`
+	path            string    `json:"-"`
+	name            string    `json:"-"`
+	outputBase      string    `json:"-"`
+	primaryPage     int       `json:"-"`
+	focus           *Focal    `json:"-"`
+	whiteGains      []float64 `json:"-"`
+	thumbBytes      int       `json:"-"`
+	displayBytes    int       `json:"-"`
+	fullBytes       int       `json:"-"`
+	source          []byte    `json:"-"`
 }
 
-var logger = log.Default()
+// DirImageData is the envelope written to each directory's images.json.
+// Name, Count and Cover are there from schema version 2.
+type DirImageData struct {
+	Meta          RunMeta               `json:"meta"`
+	Name          string                `json:"name"`
+	Count         int                   `json:"count"`
+	Cover         string                `json:"cover,omitempty"`
+	ContactSheets []string              `json:"contact_sheets,omitempty"`
+	Images        map[string]*ImageData `json:"images"`
+}
+
+// RunMeta records what produced a gallery so it can be audited for reprocessing
+type RunMeta struct {
+	SchemaVersion int    `json:"schema_version"`
+	Version       string `json:"version"`
+	VipsVersion   string `json:"vips_version"`
+	Params        Config `json:"params"`
+}
+
+func newRunMeta() RunMeta {
+	return RunMeta{
+		SchemaVersion: schemaVersion,
+		Version:       version,
+		VipsVersion:   vips.Version,
+		Params:        config,
+	}
+}
+
+// pathSet records which source claimed each output path during a run
+type pathSet struct {
+	sync.Mutex
+	sources map[string]string
+}
+
+var outputPaths = pathSet{sources: map[string]string{}}
+
+// set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+const schemaVersion = 2
+
+// joins source directories in flat layout names, a/b/photo.jpg -> a__b__photo
+const flatPathSeparator = "__"
+
+// deepest -shard-depth, four levels of 256 directories is far more than enough
+const maxShardDepth = 4
 
 const thumbnailHeight = 400
 const slideHeight = 2000
+
+// unboundedWidth is the default max width, leaving only height to constrain
+// thumbnails and display images
+const unboundedWidth = math.MaxInt16
 const tileMinDimension = 4100
 
 func main() {
+	registerFlags()
+	flag.Usage = usage
 	flag.Parse()
+	if err := applyEnvironment(); err != nil {
+		logger.Fatal(err)
+	}
+	if err := applyProfile(config.Profile); err != nil {
+		logger.Fatal(err)
+	}
+	if err := config.validate(); err != nil {
+		logger.Fatal(err)
+	}
+	logger.level = logLevels[config.LogLevel]
+	// merging only writes out what earlier runs' -manifest files recorded
+	if config.MergeManifests {
+		vips.Startup(nil)
+		err := mergeManifests(flag.Args(), config.MergeOutput)
+		vips.Shutdown()
+		if err != nil {
+			logger.Fatal(err)
+		}
+		return
+	}
+
 	if len(flag.Args()) != 1 {
 		panic("Must provide a directory")
 	}
 	root := flag.Args()[0]
+	config.root = root
+
+	// archives are unpacked only as far as the output needs
+	archive := isTarArchive(root)
+	if archive {
+		if config.OutputDir == "" {
+			logger.Fatal("-output-dir is required for a tar archive input")
+		}
+		if config.RenameSource {
+			logger.Fatal("-rename-source can't rename files inside a tar archive")
+		}
+		if config.RetryFailed != "" {
+			logger.Fatal("-retry-failed can't reread images inside a tar archive")
+		}
+		if config.Schedule == "largest-first" {
+			logger.Fatal("-schedule largest-first would hold a whole tar archive in memory")
+		}
+		if config.Clean {
+			logger.Fatal("-clean can't tell which of an archive's sources are gone")
+		}
+		config.root = config.OutputDir
+	}
+
+	if config.ServeOnly {
+		logger.Fatal(serveGallery(config.root, config.Serve))
+	}
+
+	if config.MetadataCSV != "" {
+		metadata, err := loadMetadataCSV(config.MetadataCSV)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		galleryMetadata = metadata
+	}
+
+	// an interrupted run still reports what failed before it stopped
+	if config.ErrorReport != "" {
+		interrupts := make(chan os.Signal, 1)
+		signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-interrupts
+			if err := failures.writeReport(config.ErrorReport); err != nil {
+				logger.Error(err)
+			}
+			os.Exit(130)
+		}()
+	}
 
-	var imageDataMap = map[string]map[string]*ImageData{}
+	var imageDataMap = dirManifests{}
 	var results = make(chan *ImageData, 100)
 
-	logger.Printf("Building image file list...")
+	logger.Infof("Building image file list...")
 
-	images, errc := buildImageList(root)
+	if config.MaxOpenFiles > 0 {
+		fileSlots = make(chan struct{}, config.MaxOpenFiles)
+	}
+	if config.WriteRate > 0 {
+		writeLimiter = rate.NewLimiter(rate.Limit(config.WriteRate), 1)
+	}
+
+	// -fail-fast cancels with the first failure as the cause, as does a
+	// -rename-on-collision error
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
 
-	vips.Startup(nil)
-	vips.LoggingSettings(nil, vips.LogLevelMessage)
+	var images <-chan *ImageData
+	var errc <-chan error
+	if archive {
+		images, errc = buildTarImageList(ctx, root)
+	} else if config.RetryFailed != "" {
+		images, errc = buildRetryImageList(ctx, config.RetryFailed)
+	} else {
+		images, errc = buildImageList(ctx, root)
+	}
+	errc = cancelOnCollision(errc, cancel)
+
+	workers := config.Workers
+	if workers == 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	// negative cache limits keep the govips defaults
+	vipsConfig := &vips.Config{ConcurrencyLevel: defaultVipsConcurrency, MaxCacheFiles: -1, MaxCacheMem: -1, MaxCacheSize: -1}
+	if config.VipsConcurrency > 0 {
+		vipsConfig.ConcurrencyLevel = config.VipsConcurrency
+	}
+	// every worker running vips at its default concurrency oversubscribes
+	// the cores workers times over
+	if config.WorkerAffinity {
+		vipsConfig.ConcurrencyLevel = max(1, runtime.GOMAXPROCS(0)/workers)
+	}
+	// the vips commands run for tiles read the same settings
+	if vipsConfig.ConcurrencyLevel != defaultVipsConcurrency {
+		os.Setenv("VIPS_CONCURRENCY", strconv.Itoa(vipsConfig.ConcurrencyLevel))
+	}
+	// vips only reads the disc threshold from the environment
+	if config.VipsDiscThreshold != "" {
+		os.Setenv("VIPS_DISC_THRESHOLD", config.VipsDiscThreshold)
+	}
+	discThreshold := os.Getenv("VIPS_DISC_THRESHOLD")
+	if discThreshold == "" {
+		discThreshold = defaultVipsDiscThreshold
+	}
+	logger.Infof("Thread budget: %d workers x %d vips threads, disc threshold %s", workers, vipsConfig.ConcurrencyLevel, discThreshold)
+
+	vips.Startup(vipsConfig)
+	vips.LoggingSettings(nil, vipsLogLevels[logger.level])
 	defer vips.Shutdown()
 
+	if config.Clean {
+		if err := cleanOrphans(root, images, errc); err != nil {
+			logger.Fatal(err)
+		}
+		return
+	}
+
+	if config.CountOnly {
+		countImages(images).print()
+		if err := <-errc; err != nil {
+			logger.Fatal(err)
+		}
+		return
+	}
+
+	var bench *benchmark
+	if config.Benchmark > 0 {
+		var err error
+		bench, err = startBenchmark()
+		if err != nil {
+			logger.Fatal(err)
+		}
+		images = bench.sample(ctx, images, config.Benchmark)
+	}
+
+	if config.Schedule == "largest-first" {
+		images = largestFirst(ctx, images)
+	}
+	// archived images hold their bytes, queueing them would undo streaming
+	if !archive {
+		images = prioritized(ctx, images)
+	}
+
+	// -max-runtime only stops the workers, the walk carries on so what's
+	// left can be counted
+	workCtx := ctx
+	if config.MaxRuntime > 0 {
+		var stop context.CancelFunc
+		workCtx, stop = context.WithTimeoutCause(ctx, config.MaxRuntime, errMaxRuntime)
+		defer stop()
+	}
+
 	var wg sync.WaitGroup
-	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+	for i := 0; i < workers; i++ {
 		wg.Add(1)
 		go func() {
-			processor(i, images, results)
+			processor(workCtx, cancel, i, images, results)
 			wg.Done()
 		}()
 	}
@@ -67,250 +338,1624 @@ func main() {
 		close(results)
 	}()
 
-	for result := range results {
-		resultDir := filepath.Dir(result.path)
-		if _, exists := imageDataMap[resultDir]; !exists {
-			imageDataMap[resultDir] = map[string]*ImageData{}
-		}
-		imageDataMap[resultDir][result.name] = result
+	// nothing of a benchmark is kept but its report
+	if bench != nil {
+		bench.finish(results)
+		if err := <-errc; err != nil {
+			logger.Fatal(err)
+		}
+		return
+	}
+
+	// directories already written this run, later batches merge into them
+	flushed := map[string]bool{}
+	flush := func() {
+		imageDataMap.write(func(dir string) bool {
+			// the flat layout's one images.json also holds the directories left out
+			onlyDirsFlat := config.onlyDirs != nil && config.OutputLayout == "flat"
+			merge := config.Since > 0 || config.RetryFailed != "" || onlyDirsFlat || flushed[dir]
+			flushed[dir] = true
+			return merge
+		})
+		imageDataMap = dirManifests{}
+	}
+
+	var manifest *manifestWriter
+	if config.Manifest != "" {
+		var err error
+		manifest, err = openManifest(config.Manifest)
+		if err != nil {
+			logger.Fatalf("-manifest %s: %s", config.Manifest, err)
+		}
+	}
+
+	if config.Events != "" {
+		eventLog, err := openEventLog(config.Events)
+		if err != nil {
+			logger.Fatalf("-events %s: %s", config.Events, err)
+		}
+		defer eventLog.Close()
+	}
+
+	var index *sqliteIndex
+	if config.SQLite != "" {
+		var err error
+		index, err = openSQLiteIndex(config.SQLite)
+		if err != nil {
+			logger.Fatalf("-sqlite %s: %s", config.SQLite, err)
+		}
+	}
+
+	var imageCatalog *catalog
+	if config.Catalog != "" {
+		imageCatalog = &catalog{}
+	}
+
+	var hashedImages []hashedImage
+
+	var links *derivativeLinks
+	if config.DedupeDerivatives {
+		links = newDerivativeLinks()
+	}
+
+	batched := 0
+	for result := range results {
+		if result.PHash != "" {
+			if hash, err := parsePerceptualHash(result.PHash); err == nil {
+				hashedImages = append(hashedImages, hashedImage{path: result.path, hash: hash})
+			}
+		}
+
+		if links != nil {
+			links.dedupe(result)
+		}
+
+		if index != nil {
+			index.add(result)
+		}
+
+		if manifest != nil {
+			if err := manifest.add(result); err != nil {
+				logger.Errorf("-manifest %s: %s", config.Manifest, err)
+			}
+		}
+		if imageCatalog != nil {
+			imageCatalog.add(result)
+		}
+
+		resultDir, resultName := imageDataKey(result)
+		imageDataMap.add(resultDir, resultName, result)
+
+		// bound memory on huge trees by flushing as we go
+		batched++
+		if config.BatchSize > 0 && batched == config.BatchSize {
+			logger.Infof("Flushing batch of %d images", batched)
+			flush()
+			vips.ClearCache()
+			batched = 0
+		}
+	}
+
+	if context.Cause(workCtx) == errMaxRuntime && context.Cause(ctx) == nil {
+		remaining := 0
+		for imageData := range images {
+			remaining++
+			if !archive {
+				failures.recordUnprocessed(imageData.path)
+			}
+		}
+		switch {
+		case archive:
+			logger.Warnf("Stopped after -max-runtime %s with %d images of the archive unprocessed", config.MaxRuntime, remaining)
+		case config.ErrorReport != "":
+			logger.Warnf("Stopped after -max-runtime %s with %d images unprocessed, -retry-failed %s processes them", config.MaxRuntime, remaining, config.ErrorReport)
+		default:
+			logger.Warnf("Stopped after -max-runtime %s with %d images unprocessed, rerun with -error-report to list them for -retry-failed", config.MaxRuntime, remaining)
+		}
+	}
+
+	// workers have all stopped, so vips can go down before exiting
+	if err := context.Cause(ctx); err != nil {
+		if config.ErrorReport != "" {
+			if err := failures.writeReport(config.ErrorReport); err != nil {
+				logger.Error(err)
+			}
+		}
+		vips.Shutdown()
+		var tooMany *tooManyFailures
+		if errors.As(err, &tooMany) {
+			logger.Fatalf("Stopping with %s: %s", err, failures.byStage())
+		}
+		logger.Fatalf("Stopping at the first failure: %s", err)
+	}
+
+	flush()
+
+	if manifest != nil {
+		if err := manifest.close(); err != nil {
+			logger.Errorf("-manifest %s: %s", config.Manifest, err)
+		}
+	}
+
+	if index != nil {
+		if err := index.close(); err != nil {
+			logger.Errorf("-sqlite %s: %s", config.SQLite, err)
+		}
+	}
+
+	if imageCatalog != nil {
+		if err := imageCatalog.write(config.Catalog); err != nil {
+			logger.Errorf("-catalog %s: %s", config.Catalog, err)
+		}
+	}
+
+	if config.ChecksumManifest != "" {
+		changes, err := checksums.write(config.ChecksumManifest, config.root)
+		if err != nil {
+			logger.Errorf("-checksum-manifest %s: %s", config.ChecksumManifest, err)
+		} else {
+			logger.Infof("%d derivatives new, %d changed and %d removed in %s", changes.added, len(changes.changed), len(changes.removed), config.ChecksumManifest)
+			if config.PurgeList != "" {
+				if err := writePurgeList(config.PurgeList, changes); err != nil {
+					logger.Errorf("-purge-list %s: %s", config.PurgeList, err)
+				}
+			}
+		}
+	}
+
+	if config.DirSummary != "" {
+		if err := dirStats.writeReport(config.DirSummary); err != nil {
+			logger.Errorf("-dir-summary %s: %s", config.DirSummary, err)
+		}
+	}
+
+	if skipped := skippedImages.Load(); skipped > 0 {
+		logger.Warnf("Skipped %d degenerate images", skipped)
+	}
+	if unverified := unverifiedOutputs.Load(); unverified > 0 {
+		logger.Errorf("%d renditions failed -verify-outputs", unverified)
+	}
+
+	if config.PHash {
+		reportNearDuplicates(hashedImages, config.PHashThreshold)
+	}
+
+	if config.ErrorReport != "" {
+		if err := failures.writeReport(config.ErrorReport); err != nil {
+			logger.Error(err)
+		}
+	}
+
+	if err := <-errc; err != nil {
+		logger.Fatal(err)
+	}
+	if failed := failures.count(); failed > 0 {
+		logger.Fatalf("%d failures processing images", failed)
+	}
+
+	if config.Serve != "" {
+		vips.Shutdown()
+		logger.Fatal(serveGallery(config.root, config.Serve))
+	}
+}
+
+// errMaxRuntime stops the workers once -max-runtime has passed
+var errMaxRuntime = errors.New("-max-runtime reached")
+
+// defaultVipsConcurrency is the vips threads per operation govips starts with
+const defaultVipsConcurrency = 1
+
+// defaultVipsDiscThreshold is the decoded size vips goes to disk above
+const defaultVipsDiscThreshold = "100m"
+
+// skipFileNames are files beside sources that never are one
+var skipFileNames = map[string]bool{
+	".DS_Store":    true,
+	ignoreFileName: true,
+	prefixFileName: true,
+}
+
+// skipExtensions mark what the gallery writes or reads beside sources that
+// isn't an image: images.json, tile descriptors, reports and sidecars
+var skipExtensions = map[string]bool{
+	".html":               true,
+	".dzi":                true,
+	".json":               true,
+	".xml":                true,
+	".csv":                true,
+	prioritySidecarSuffix: true,
+}
+
+// derivativeSuffixes end the names of the derivatives of outputBase, before
+// their extension
+var derivativeSuffixes = []string{"-thumbnail-square", "-thumbnail", "-display", "-trimmed", "-cropped", "-preview"}
+
+// generatedNames match the other base names earlier runs write, page
+// renditions and contact sheets
+var generatedNames = regexp.MustCompile(`-page-[0-9]+$|^contact-sheet(-[0-9]+)?$`)
+
+// skippedName reports whether the file name is one the gallery wrote or
+// reads rather than a source, going by the exact names its generators give
+func skippedName(name string) bool {
+	if reason := skipReason(name); reason != "" {
+		logger.Debugf("Skipping %s, %s", name, reason)
+		return true
+	}
+	return false
+}
+
+func skipReason(name string) string {
+	if skipFileNames[name] {
+		return "a gallery settings file"
+	}
+	if skipExtensions[strings.ToLower(filepath.Ext(strings.TrimSuffix(name, ".gz")))] {
+		return "not an image"
+	}
+
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	for _, suffix := range derivativeSuffixes {
+		if strings.HasSuffix(base, suffix) {
+			return "named as a " + suffix[1:] + " derivative"
+		}
+	}
+	if generatedNames.MatchString(base) {
+		return "named as a page or contact sheet"
+	}
+	if sizedName(name) {
+		return "named as a -size rendition"
+	}
+	return ""
+}
+
+func buildImageList(ctx context.Context, root string) (<-chan *ImageData, <-chan error) {
+	images := make(chan *ImageData, 100)
+	errc := make(chan error, 1)
+
+	ignores := newIgnoreRules(root)
+
+	var modifiedAfter time.Time
+	if config.Since > 0 {
+		modifiedAfter = time.Now().Add(-config.Since)
+	}
+
+	visited := visitedDirs{keys: map[any]bool{}}
+
+	var walk func(root string) error
+	visit := func(path string, d fs.DirEntry, err error) error {
+		// unreadable directories end the walk with their error, d may be nil
+		if err != nil {
+			return err
+		}
+
+		// don't process non-images or already generated images
+		if !d.IsDir() && skippedName(d.Name()) {
+			return nil
+		}
+
+		// the walk doesn't follow symlinks, resolve them to their targets here
+		linkedDir := false
+		if config.FollowSymlinks && d.Type()&fs.ModeSymlink != 0 {
+			info, err := os.Stat(path)
+			if err != nil {
+				logger.Warnf("Skipping broken symlink %s: %s", path, err)
+				return nil
+			}
+			d = fs.FileInfoToDirEntry(info)
+			linkedDir = d.IsDir()
+		}
+
+		if ignores.ignored(path, d.IsDir()) || globbedOut(root, path, d.IsDir()) || dirFilteredOut(root, path, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if d.IsDir() {
+			// skip dz tiles generated externally or previously, and the
+			// shared copies of -dedupe-derivatives
+			if strings.HasSuffix(d.Name(), "_files") || d.Name() == dedupeDirName {
+				return filepath.SkipDir
+			}
+			if linkedDir {
+				// the trailing separator makes the walk resolve the link while still reporting paths beneath it
+				return walk(path + string(filepath.Separator))
+			}
+			if config.FollowSymlinks && !visited.first(path) {
+				logger.Infof("Skipping %s, its target was already walked", path)
+				return filepath.SkipDir
+			}
+			// nothing else to do with directories
+			return nil
+		} else {
+			// incremental runs only pick up recent changes
+			if !modifiedAfter.IsZero() {
+				info, err := d.Info()
+				if err != nil {
+					return err
+				}
+				if info.ModTime().Before(modifiedAfter) {
+					return nil
+				}
+			}
+
+			if isRaw(path) && !rawToolAvailable() {
+				return nil
+			}
+
+			ext := filepath.Ext(d.Name())
+			name := strings.TrimSuffix(d.Name(), ext)
+
+			var imageData = ImageData{
+				path: path,
+				name: name,
+			}
+
+			// slugs are assigned during the walk so collision suffixes follow the stable listing order
+			if config.SlugifyNames {
+				imageData.OriginalName = d.Name()
+				imageData.Slug = slugs.assign(filepath.Dir(path), name)
+				imageData.name = imageData.Slug
+			}
+			if keep, err := sourceNames.resolve(&imageData); !keep {
+				return err
+			}
+
+			select {
+			case images <- &imageData:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		return nil
+	}
+
+	walk = func(root string) error {
+		if config.WalkConcurrency > 1 {
+			return walkDirConcurrently(root, config.WalkConcurrency, visit)
+		}
+		return filepath.WalkDir(root, visit)
+	}
+
+	go func() {
+		defer close(images)
+		errc <- walk(root)
+	}()
+
+	return images, errc
+}
+
+// visitedDirs guards a symlink-following walk against loops
+type visitedDirs struct {
+	sync.Mutex
+	keys map[any]bool
+}
+
+// first reports whether dir's target hasn't been walked before, marking it walked
+func (v *visitedDirs) first(dir string) bool {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return true
+	}
+	key := fileKey(dir, info)
+
+	v.Lock()
+	defer v.Unlock()
+
+	if v.keys[key] {
+		return false
+	}
+	v.keys[key] = true
+	return true
+}
+
+func processor(ctx context.Context, cancel context.CancelCauseFunc, i int, images <-chan *ImageData, results chan<- *ImageData) {
+	for {
+		if config.maxFailures != nil {
+			if err := config.maxFailures.exceeded(failures.count(), int(finishedImages.Load())); err != nil {
+				cancel(err)
+				return
+			}
+		}
+
+		var image *ImageData
+		select {
+		case image = <-images:
+		case <-ctx.Done():
+			return
+		}
+		if image == nil {
+			return
+		}
+		logger.Infof("%d - %s", i, image.path)
+		events.emit(Event{Type: eventImageStarted, Worker: i, Path: image.path})
+
+		summary, err := processImage(image)
+		finishedImages.Add(1)
+		// archived bytes aren't needed once processed
+		image.source = nil
+		var skipped *skipError
+		if errors.As(err, &skipped) {
+			logger.Warnf("%d - skipped %s: %s", i, image.path, skipped)
+			events.emit(Event{Type: eventImageSkipped, Worker: i, Path: image.path, Error: skipped.Error()})
+			skippedImages.Add(1)
+			continue
+		}
+		if err != nil {
+			logger.Errorf("%d - failed %s: %s", i, image.path, err)
+			failed := Event{Type: eventImageFailed, Worker: i, Path: image.path, Error: err.Error()}
+			var failedStage *stageError
+			if errors.As(err, &failedStage) {
+				failed.Stage = failedStage.stage
+				failed.Error = failedStage.err.Error()
+			}
+			events.emit(failed)
+			failures.record(image.path, err)
+			if config.FailFast {
+				cancel(fmt.Errorf("%s: %w", image.path, err))
+				return
+			}
+			continue
+		}
+		logger.Infof("%d - done %s", i, summary)
+		events.emit(Event{Type: eventImageCompleted, Worker: i, Path: image.path, Elapsed: summary.elapsed.Seconds()})
+		results <- image
+	}
+}
+
+// reframed reports whether the full rendition was cropped or trimmed from
+// the source, so everything else has to be made from it
+func (d *ImageData) reframed() bool {
+	return d.Cropped || d.Trim != nil
+}
+
+// processImage writes imageData's derivatives. An error means the image
+// couldn't be processed at all, failed derivatives are only recorded.
+func processImage(imageData *ImageData) (processSummary, error) {
+	start := time.Now()
+
+	// rows are keyed by the original name, look it up before any rename
+	applyMetadata(imageData)
+	imageData.Tags = mergeTags(imageData.Tags, config.Tags)
+	// as are the crop and focal point sidecars
+	imageData.Crop = readCropSidecar(imageData)
+	imageData.Focal = readFocalSidecar(imageData)
+
+	if config.RenameSource && imageData.Slug != "" {
+		if err := renameSource(imageData); err != nil {
+			logger.Error(err)
+		}
+	}
+
+	if config.ResumeFromJSON && resumeImage(imageData) {
+		// a converted full rendition -auto-wb-full balanced needs no more
+		if !config.AutoWBFull || imageData.FullPath == imageData.path {
+			gains, err := sampledWhiteBalanceGains(imageData.FullPath)
+			if err != nil {
+				logger.Errorf("%s: white balance: %s", imageData.path, err)
+			}
+			imageData.whiteGains = gains
+		}
+		generateDerivatives(imageData, imageData.DisplayPath != imageData.FullPath, false)
+		return newProcessSummary(imageData, time.Since(start)), nil
+	}
+
+	// vips loads lazily, so other than developed RAW this only reads the
+	// header. Pixels are decoded in full only to convert the full rendition,
+	// the other derivatives shrink on load from the file themselves.
+	// zero byte files are stray placeholders rather than broken images
+	if sourceEmpty(imageData) {
+		return processSummary{}, &skipError{"empty file"}
+	}
+	if pdfUnsupported(imageData.path) {
+		return processSummary{}, &skipError{"this libvips has no pdf loader"}
+	}
+	if svgUnsupported(imageData.path) {
+		return processSummary{}, &skipError{"this libvips has no svg loader"}
+	}
+	if layeredUnsupported(imageData.path) {
+		return processSummary{}, &skipError{"this libvips has no magick loader for psd and psb"}
+	}
+
+	var image *vips.ImageRef
+	var err error
+	if isRaw(imageData.path) {
+		imageData.IsRaw = true
+		image, err = loadRawImage(imageData.path)
+	} else {
+		image, err = loadSource(imageData)
+	}
+	if err != nil {
+		return processSummary{}, &stageError{"load", err}
+	}
+	if err := degenerateSize(image.Width(), image.Height()); err != nil {
+		image.Close()
+		return processSummary{}, err
+	}
+
+	// gigapixel sources are only streamed, skipping what needs them in memory
+	huge := decodeTooLarge(image)
+	if huge {
+		logger.Warnf("%s is %dx%d, above -max-decode-pixels: streaming it without perceptual hash, crop or trim", imageData.path, image.Width(), image.Height())
+		imageData.Crop = nil
+	}
+
+	if config.PHash && !huge {
+		hash, err := sourcePerceptualHash(imageData, image)
+		if err != nil {
+			logger.Errorf("%s: perceptual hash: %s", imageData.path, err)
+		}
+		imageData.PHash = hash
+	}
+
+	imageData.CaptureDate = captureDate(image)
+	imageData.SourceFormat = sourceType(imageData, image)
+
+	// the loaders report the pages in the file, only the first is loaded
+	if isMultiPage(imageData.path) && image.Pages() > 1 {
+		imageData.PageCount = image.Pages()
+	}
+	// HEIF loads its primary image, bursts hold more, split like pages when asked
+	if isHeif(imageData.path) && image.Pages() > 1 {
+		imageData.FrameCount = image.Pages()
+		if config.HeicAllFrames {
+			imageData.PageCount = image.Pages()
+			imageData.primaryPage = image.GetInt(heifPrimaryField)
+		}
+	}
+
+	sourceWidth, sourceHeight := image.Width(), image.Height()
+	if imageData.Crop != nil {
+		if err := applyCrop(imageData, image); err != nil {
+			image.Close()
+			return processSummary{}, &stageError{"crop", err}
+		}
+	}
+
+	if config.TrimBorders && !huge {
+		trim, err := trimBorders(imageData, image)
+		if err != nil {
+			image.Close()
+			return processSummary{}, &stageError{"trim", err}
+		}
+		imageData.Trim = trim
+	}
+	imageData.focus = renditionFocus(imageData, sourceWidth, sourceHeight)
+
+	// one correction for every rendition, measured on the framed source
+	if !huge {
+		gains, err := whiteBalanceGains(image)
+		if err != nil {
+			logger.Errorf("%s: white balance: %s", imageData.path, err)
+		}
+		imageData.whiteGains = gains
+	}
+
+	// transparent sources keep their alpha when asked to, else everything is flattened
+	imageData.HasAlpha = image.HasAlpha()
+	imageData.ThumbFormat = outputFormat(config.ThumbFormat, imageData.HasAlpha)
+	imageData.DisplayFormat = outputFormat(config.DisplayFormat, imageData.HasAlpha)
+	imageData.FullFormat = fullFormat(imageData.path, imageData.HasAlpha)
+
+	imageData.outputBase = derivativeBase(imageData)
+	if err := makeDirs(filepath.Dir(imageData.outputBase)); err != nil {
+		image.Close()
+		return processSummary{}, &stageError{"output", err}
+	}
+	imageData.ThumbPath = imageData.outputBase + "-thumbnail" + formatExtensions[imageData.ThumbFormat]
+	imageData.DisplayPath = imageData.outputBase + "-display" + formatExtensions[imageData.DisplayFormat]
+	imageData.FullPath = imageData.path
+
+	// sources are served as-is when already in the full format, anything else
+	// (png is nice but way too big, RAW can't be read) gets a converted rendition
+	retype := sourceFormat(imageData.path) != imageData.FullFormat
+	if retype || imageData.reframed() {
+		imageData.FullPath = imageData.outputBase + formatExtensions[imageData.FullFormat]
+		if retype {
+			logger.Infof("Retyping image to %s: %s", imageData.FullFormat, imageData.path)
+		} else if imageData.Cropped {
+			// the reframed rendition would otherwise have the source's own name
+			imageData.FullPath = imageData.outputBase + "-cropped" + formatExtensions[imageData.FullFormat]
+		} else {
+			imageData.FullPath = imageData.outputBase + "-trimmed" + formatExtensions[imageData.FullFormat]
+		}
+
+		convertStart := time.Now()
+		var err error
+		if huge {
+			err = convertStreaming(imageData, image)
+		} else {
+			err = convertFormat(imageData, image)
+		}
+		if err != nil {
+			image.Close()
+			return processSummary{}, &stageError{"convert", err}
+		}
+		events.emit(Event{Type: eventDerivativeWritten, Path: imageData.path, Stage: "convert", Output: imageData.FullPath, Elapsed: time.Since(convertStart).Seconds()})
+	} else if imageData.source != nil {
+		if err := writeSource(imageData); err != nil {
+			image.Close()
+			return processSummary{}, &stageError{"output", err}
+		}
+	}
+	// a streamed source is measured on what the renditions shrink on load from
+	if huge {
+		gains, err := sampledWhiteBalanceGains(imageData.FullPath)
+		if err != nil {
+			logger.Errorf("%s: white balance: %s", imageData.path, err)
+		}
+		imageData.whiteGains = gains
+	}
+
+	// these get updated if a lower-res slide image is generated
+	width, height := image.Width(), image.Height()
+	imageData.Height = height
+	imageData.Width = width
+
+	// these are for the deepzoom plugin
+	imageData.MaxHeight = height
+	imageData.MaxWidth = width
+
+	// drop the source buffer before the derivatives load their own
+	image.Close()
+
+	slide := width > config.SlideMinSource || height > config.SlideMinSource
+	tiles := width > config.TileMinDimension || height > config.TileMinDimension
+	generateDerivatives(imageData, slide, tiles)
+
+	// only now, the derivatives above may still have read the source
+	if config.DeleteOriginalPNG {
+		if err := deleteOriginalPNG(imageData); err != nil {
+			logger.Error(err)
+		}
+	}
+
+	return newProcessSummary(imageData, time.Since(start)), nil
+}
+
+// generateDerivatives writes the thumbnail, and the slide image and tiles
+// when asked for and not skipped, waiting for all of them
+func generateDerivatives(imageData *ImageData, slide bool, tiles bool) {
+	var wg sync.WaitGroup
+	generate := func(stage string, generator func(*ImageData) error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			if err := generator(imageData); err != nil {
+				var failed *stageError
+				if !errors.As(err, &failed) {
+					err = &stageError{stage, err}
+				}
+				logger.Errorf("%s: %s", imageData.path, err)
+				failures.record(imageData.path, err)
+				return
+			}
+			events.emit(Event{Type: eventDerivativeWritten, Path: imageData.path, Stage: stage, Output: derivativeOutput(imageData, stage), Elapsed: time.Since(start).Seconds()})
+		}()
+	}
+
+	// the thumbnail can come from the display image rather than its own decode
+	derived := config.ThumbsFromDisplay && slide && !config.SkipSlides
+
+	// the grid thumbnail, -sizes-only has the smallest -size stand in for it
+	if !derived && !config.SizesOnly {
+		generate("thumbnail", generateThumbnail)
+	}
+
+	if config.SquareThumbs {
+		if config.thumbRatio == 0 && nearSquare(imageData.MaxWidth, imageData.MaxHeight) {
+			// the main thumbnail already looks square, so stands in for it
+			imageData.ThumbSquarePath = imageData.ThumbPath
+		} else {
+			imageData.ThumbSquarePath = imageData.outputBase + "-thumbnail-square" + formatExtensions[imageData.ThumbFormat]
+			generate("square-thumbnail", generateSquareThumbnail)
+		}
+	}
+
+	// the slide image, the full rendition stands in for it when skipped
+	if config.SizesOnly {
+		// the largest -size stands in for it
+	} else if config.SkipSlides {
+		imageData.DisplayPath = imageData.FullPath
+	} else if derived {
+		generate("display", generateSlideAndThumbnail)
+	} else if slide {
+		generate("display", generateSlideImage)
+	}
+
+	// resumed pages were already written out, HEIF frames only have pages
+	// with -heic-all-frames
+	if (config.PagePreviews || imageData.FrameCount > 1) && imageData.PageCount > 1 {
+		if len(imageData.PagePaths) == 0 {
+			generate("pages", generatePages)
+		}
+		if config.PagePreviews {
+			generate("page-preview", generatePagePreview)
+		}
+	}
+
+	if len(config.Sizes) > 0 {
+		generate("sizes", generateSizes)
+	}
+
+	// generate tiles if necessary
+	if !config.SkipTiles && tiles {
+		generate("tiles", generateImageTiles)
+	}
+
+	wg.Wait()
+
+	// renditions standing in for others have their dimensions too
+	if imageData.ThumbSquarePath != "" && imageData.ThumbSquarePath == imageData.ThumbPath {
+		imageData.SquareWidth = imageData.ThumbWidth
+		imageData.SquareHeight = imageData.ThumbHeight
+	}
+	if config.SizesOnly {
+		standInSizes(imageData)
+	}
+	// kept and resumed tiles have a descriptor as much as generated ones
+	if config.OSDTileSources && imageData.Tiles != "" {
+		tileSource, err := readTileSource(imageData)
+		if err != nil {
+			logger.Errorf("-osd-tile-sources %s: %s", imageData.path, err)
+		}
+		imageData.TileSource = tileSource
+	}
+	if imageData.DisplayPath == imageData.FullPath {
+		imageData.DisplayWidth = imageData.MaxWidth
+		imageData.DisplayHeight = imageData.MaxHeight
+	}
+
+	if config.FileSizes {
+		recordFileSizes(imageData)
+	}
+}
+
+// recordFileSizes sets the size in bytes of each derivative on disk, those
+// that failed or weren't made are left at 0
+func recordFileSizes(imageData *ImageData) {
+	imageData.ThumbSize = fileSize(imageData.ThumbPath)
+	imageData.DisplaySize = fileSize(imageData.DisplayPath)
+	imageData.FullSize = fileSize(imageData.FullPath)
+	imageData.TilesSize = 0
+	if imageData.Tiles != "" {
+		imageData.TilesSize = treeSize(imageData.Tiles)
+	}
+}
+
+// nearSquare reports whether width by height is within -square-tolerance of
+// a square
+func nearSquare(width int, height int) bool {
+	if config.SquareTolerance <= 0 || width <= 0 || height <= 0 {
+		return false
+	}
+	return math.Abs(float64(width)/float64(height)-1) <= config.SquareTolerance
+}
+
+// degenerateSize is the skip for a source narrower or shorter than
+// -min-dimension, such as a tracking pixel, nil for any other size
+func degenerateSize(width int, height int) error {
+	if width < config.MinDimension || height < config.MinDimension {
+		return &skipError{fmt.Sprintf("%dx%d is below -min-dimension %d", width, height, config.MinDimension)}
+	}
+	return nil
+}
+
+// imageDataKey is the directory whose images.json records imageData and
+// the name it's recorded under
+func imageDataKey(imageData *ImageData) (string, string) {
+	// everything lands in one images.json keyed by the path-encoded names
+	if config.OutputLayout == "flat" {
+		return config.root, filepath.Base(imageData.outputBase)
+	}
+	return filepath.Dir(imageData.path), imageData.name
+}
+
+// derivativeBase is the path derivatives are named from, a sibling of the
+// source in the mirrored layout. The flat layout puts everything in the root
+// with the source's directories encoded into the name to keep it unique.
+func derivativeBase(imageData *ImageData) string {
+	dir := filepath.Dir(imageData.path)
+	name := imageData.name
+	if prefix := prefixes.of(dir); prefix != "" {
+		name = prefix + "-" + name
+	}
+	if config.OutputLayout != "flat" {
+		return benchmarkPath(filepath.Join(dir, shardDir(name), name))
+	}
+
+	relDir, err := filepath.Rel(config.root, dir)
+	if err == nil && relDir != "." {
+		name = strings.ReplaceAll(filepath.ToSlash(relDir), "/", flatPathSeparator) + flatPathSeparator + name
+	}
+	return benchmarkPath(filepath.Join(config.root, shardDir(name), name))
+}
+
+// shardDir is the -shard-depth subdirectory for derivatives named name, two
+// hex characters of its hash per level, e.g. ab/cd. Empty when not sharding.
+func shardDir(name string) string {
+	if config.ShardDepth == 0 {
+		return ""
+	}
+
+	hash := fmt.Sprintf("%x", sha1.Sum([]byte(name)))
+	levels := make([]string, config.ShardDepth)
+	for i := range levels {
+		levels[i] = hash[2*i : 2*i+2]
+	}
+	return filepath.Join(levels...)
+}
+
+// convertFormat writes the source out as the full rendition in its full format
+func convertFormat(imageData *ImageData, image *vips.ImageRef) error {
+	// for web viewing/consistency with generated tiles
+	err := image.ToColorSpace(vips.InterpretationSRGB)
+	if err != nil {
+		return err
+	}
+
+	// sources served as-is are never touched, so only conversions can be
+	// balanced or stretched
+	if config.AutoWBFull {
+		if err := whiteBalance(image, imageData.whiteGains); err != nil {
+			return err
+		}
+		// the renditions made from it are balanced already
+		imageData.whiteGains = nil
+	}
+	if config.AutoLevelsFull {
+		if err := autoLevels(image); err != nil {
+			return err
+		}
+	}
+
+	var imageBytes []byte
+	if config.RecompressFull {
+		imageBytes, err = exportRecompressed(image, imageData.FullFormat, imageData.path)
+	} else {
+		imageBytes, err = exportFullImage(image, imageData.FullFormat, renditionQuality(config.FullQuality, imageData.FullFormat, image))
+	}
+	if err != nil {
+		return err
+	}
+
+	outputPaths.claim(imageData.FullPath, imageData.path)
+	err = writeVerified(imageData.FullPath, imageBytes, image.Width(), image.Height())
+	if err != nil {
+		return err
+	}
+	imageData.fullBytes = len(imageBytes)
+	return nil
+}
+
+// decodeTooLarge reports a source above -max-decode-pixels
+func decodeTooLarge(image *vips.ImageRef) bool {
+	return config.MaxDecodePixels > 0 && int64(image.Width())*int64(image.Height()) > config.MaxDecodePixels
+}
+
+// convertStreaming is convertFormat for sources above -max-decode-pixels,
+// shelling out to vips, which reads the source sequentially instead of
+// decoding it whole. It neither levels nor recompresses, nor embeds the
+// -copyright.
+func convertStreaming(imageData *ImageData, image *vips.ImageRef) error {
+	if imageData.source != nil || imageData.IsRaw || svgRasterWidth(imageData.path) > 0 {
+		return errors.New("only a plain file above -max-decode-pixels can be streamed")
 	}
 
-	for dir, imageData := range imageDataMap {
-		go writeDirImageData(dir, imageData)
+	var options []string
+	if imageData.FullFormat == "png" {
+		options = append(options, "compression=6")
+	} else {
+		options = append(options, fmt.Sprintf("Q=%d", renditionQuality(config.FullQuality, imageData.FullFormat, image)))
+	}
+	if config.StripMetadata {
+		options = append(options, "strip")
 	}
 
-	if err := <-errc; err != nil {
-		logger.Fatal(err)
+	outputPaths.claim(imageData.FullPath, imageData.path)
+	target := fmt.Sprintf("%s[%s]", imageData.FullPath, strings.Join(options, ","))
+	err := verified(imageData.FullPath, image.Width(), image.Height(), func() error {
+		return runCommand(exec.Command("vips", "colourspace", loaderArg(imageData.path), target, "srgb"))
+	})
+	if err != nil {
+		return err
+	}
+	if err := applyMode(imageData.FullPath, config.FileMode); err != nil {
+		logger.Error(err)
 	}
+	checksums.recordFile(imageData.FullPath)
+	imageData.fullBytes = int(fileSize(imageData.FullPath))
+	return nil
 }
 
-func buildImageList(root string) (<-chan *ImageData, <-chan error) {
-	skipFileNames := []string{".DS_Store", "thumbnail", "display", "html", "dzi", "json", "xml"}
-	images := make(chan *ImageData, 100)
-	errc := make(chan error, 1)
-
-	go func() {
-		defer close(images)
-		errc <- filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
-			for _, skipFileName := range skipFileNames {
-				// don't process non-images or already generated images
-				if strings.Contains(d.Name(), skipFileName) {
-					return nil
-				}
-			}
-
-			if d.IsDir() {
-				// skip dz tiles generated externally or previously
-				if strings.HasSuffix(d.Name(), "_files") {
-					return filepath.SkipDir
-				}
-				// nothing else to do with directories
-				return nil
-			} else {
-				ext := filepath.Ext(d.Name())
-				name := strings.TrimSuffix(d.Name(), ext)
+// loadThumbnail shrinks the image at path to fit width by height as vips
+// thumbnail does, in linear light with -linear-resize
+func loadThumbnail(path string, width int, height int, crop vips.Interesting) (*vips.ImageRef, error) {
+	if !config.LinearResize {
+		return vips.LoadThumbnailFromFile(path, width, height, crop, vips.SizeBoth, loaderParams(path))
+	}
 
-				var imageData = ImageData{
-					path: path,
-					name: name,
-				}
+	// there's no shrink on load in linear light, the source decodes in full
+	image, err := vips.LoadImageFromFile(path, loaderParams(path))
+	if err != nil {
+		return nil, err
+	}
+	if err := thumbnailLinear(image, width, height, crop, vips.SizeBoth); err != nil {
+		image.Close()
+		return nil, err
+	}
+	return image, nil
+}
 
-				images <- &imageData
-			}
+// thumbnailLinear is ThumbnailWithSize resampling in scRGB, where averaging
+// pixels doesn't darken fine bright detail as it does in gamma encoded sRGB
+func thumbnailLinear(image *vips.ImageRef, width int, height int, crop vips.Interesting, size vips.Size) error {
+	if err := image.ToColorSpace(vips.InterpretationScRGB); err != nil {
+		return err
+	}
+	if err := image.ThumbnailWithSize(width, height, crop, size); err != nil {
+		return err
+	}
+	return image.ToColorSpace(vips.InterpretationSRGB)
+}
 
-			return nil
-		})
-	}()
+// thumbnailBox is the width and crop thumbnails are made with: fit within
+// -thumb-max-width, unless cropped to a fixed ratio box
+func thumbnailBox() (int, vips.Interesting) {
+	if config.thumbRatio <= 0 {
+		return config.ThumbMaxWidth, vips.InterestingNone
+	}
 
-	return images, errc
+	width := int(math.Round(float64(config.ThumbnailHeight) * config.thumbRatio))
+	return width, thumbnailCrop()
 }
 
-func processor(i int, images <-chan *ImageData, results chan<- *ImageData) {
-	for image := range images {
-		logger.Printf("%d - %s", i, image.path)
-
-		processImage(image)
-		results <- image
+// thumbnailCrop is the strategy for thumbnails cropped to a box
+func thumbnailCrop() vips.Interesting {
+	if config.Interesting != "none" {
+		return interestingStrategies[config.Interesting]
 	}
+	return thumbGravities[config.ThumbGravity]
 }
 
-func processImage(imageData *ImageData) {
-	jpgExportParams := &vips.JpegExportParams{
-		StripMetadata:      true,
-		Quality:            75,
-		Interlace:          true,
-		OptimizeCoding:     true,
-		SubsampleMode:      vips.VipsForeignSubsampleAuto,
-		TrellisQuant:       true,
-		OvershootDeringing: true,
-		OptimizeScans:      true,
-		QuantTable:         3,
+func generateThumbnail(imageData *ImageData) error {
+	width, crop := thumbnailBox()
+	var thumbnail *vips.ImageRef
+	var err error
+	if config.thumbRatio > 0 && config.ThumbBackground == "blur" {
+		thumbnail, err = blurFilled(imageData, func(crop vips.Interesting) (*vips.ImageRef, error) {
+			return loadThumbnail(imageData.FullPath, width, config.ThumbnailHeight, crop)
+		})
+	} else if config.thumbRatio > 0 {
+		thumbnail, err = loadBoxedThumbnail(imageData, width, config.ThumbnailHeight)
+	} else {
+		thumbnail, err = loadThumbnail(imageData.FullPath, width, config.ThumbnailHeight, crop)
 	}
-
-	dir := filepath.Dir(imageData.path)
-
-	image, err := vips.NewImageFromFile(imageData.path)
-	defer image.Close()
 	if err != nil {
-		panic(err)
+		return err
 	}
+	defer thumbnail.Close()
 
-	// png is nice but way too big
-	if filepath.Ext(imageData.path) == ".png" {
-		logger.Printf("Retyping image to jpg: %s", imageData.path)
-
-		err := convertToJPG(imageData, image, jpgExportParams)
-		if err != nil {
-			panic(err)
+	if err := whiteBalance(thumbnail, imageData.whiteGains); err != nil {
+		return err
+	}
+	if config.AutoLevels {
+		if err := autoLevels(thumbnail); err != nil {
+			return err
 		}
 	}
 
-	ext := ".jpg"
-	imageData.ThumbPath = filepath.Join(dir, imageData.name+"-thumbnail"+ext)
-	imageData.DisplayPath = filepath.Join(dir, imageData.name+"-display"+ext)
-	imageData.FullPath = filepath.Join(dir, imageData.name+ext)
-
-	// these get updated if a lower-res slide image is generated
-	imageData.Height = image.Height()
-	imageData.Width = image.Width()
-
-	// these are for the deepzoom plugin
-	imageData.MaxHeight = image.Height()
-	imageData.MaxWidth = image.Width()
-
-	var wg sync.WaitGroup
+	return writeThumbnail(imageData, thumbnail)
+}
 
-	// the grid thumbnail
-	go generateThumbnail(&wg, imageData, jpgExportParams)
+// generateThumbnailFrom downscales the thumbnail from an already decoded
+// larger rendition, left untouched, instead of decoding the full one again
+func generateThumbnailFrom(imageData *ImageData, larger *vips.ImageRef) error {
+	width, crop := thumbnailBox()
+	if config.thumbRatio > 0 && config.ThumbBackground == "blur" {
+		thumbnail, err := blurFilled(imageData, func(crop vips.Interesting) (*vips.ImageRef, error) {
+			return shrunkCopy(larger, width, config.ThumbnailHeight, crop)
+		})
+		if err != nil {
+			return err
+		}
+		defer thumbnail.Close()
+		return writeThumbnail(imageData, thumbnail)
+	}
 
-	// the slide image
-	if image.Width() > slideHeight || image.Height() > slideHeight {
-		go generateSlideImage(&wg, imageData, jpgExportParams)
+	thumbnail, err := larger.Copy()
+	if err != nil {
+		return err
 	}
+	defer thumbnail.Close()
 
-	// generate tiles if necessary
-	if image.Width() > tileMinDimension || image.Height() > tileMinDimension {
-		go generateImageTiles(&wg, imageData)
+	// a focal point crops the box itself once the rendition covers it
+	boxWidth, boxHeight := width, config.ThumbnailHeight
+	focused := config.thumbRatio > 0 && imageData.focus != nil
+	if focused {
+		boxWidth, boxHeight = coverBox(imageData, width, config.ThumbnailHeight)
+		crop = vips.InterestingNone
+	}
+	if config.LinearResize {
+		err = thumbnailLinear(thumbnail, boxWidth, boxHeight, crop, vips.SizeBoth)
+	} else {
+		err = thumbnail.ThumbnailWithSize(boxWidth, boxHeight, crop, vips.SizeBoth)
+	}
+	if err != nil {
+		return err
+	}
+	if focused {
+		if err := cropAround(thumbnail, imageData.focus, width, config.ThumbnailHeight); err != nil {
+			return err
+		}
 	}
 
-	wg.Wait()
+	return writeThumbnail(imageData, thumbnail)
 }
 
-func convertToJPG(imageData *ImageData, image *vips.ImageRef, jpegExportParams *vips.JpegExportParams) error {
-	ext := ".jpg"
-	// vips image to jpg
-	jpgFile := fmt.Sprintf("%s%s", imageData.name, ext)
-	path := filepath.Join(imageData.FullPath, jpgFile)
-
-	// for web viewing/consistency with generated tiles
-	err := image.ToColorSpace(vips.InterpretationSRGB)
+// generateSquareThumbnail writes the -square-thumbs variant, cropped to a
+// square whatever the aspect of the main thumbnail
+func generateSquareThumbnail(imageData *ImageData) error {
+	size := config.ThumbnailHeight
+	thumbnail, err := loadBoxedThumbnail(imageData, size, size)
 	if err != nil {
 		return err
 	}
+	defer thumbnail.Close()
 
-	jpgImageBytes, _, err := image.ExportJpeg(jpegExportParams)
-	if err != nil {
+	if err := whiteBalance(thumbnail, imageData.whiteGains); err != nil {
+		return err
+	}
+	if config.AutoLevels {
+		if err := autoLevels(thumbnail); err != nil {
+			return err
+		}
+	}
+	if _, err := checkerThumbnail(thumbnail); err != nil {
+		return err
+	}
+	if err := frameThumbnail(thumbnail); err != nil {
 		return err
 	}
 
-	err = os.WriteFile(path, jpgImageBytes, 0644)
+	thumbnailBytes, err := exportImage(thumbnail, imageData.ThumbFormat, renditionQuality(config.ThumbQuality, imageData.ThumbFormat, thumbnail))
 	if err != nil {
 		return err
 	}
+	outputPaths.claim(imageData.ThumbSquarePath, imageData.path)
+	if err := writeVerified(imageData.ThumbSquarePath, thumbnailBytes, thumbnail.Width(), thumbnail.Height()); err != nil {
+		return err
+	}
+	imageData.SquareWidth = thumbnail.Width()
+	imageData.SquareHeight = thumbnail.Height()
 	return nil
 }
 
-func generateThumbnail(wg *sync.WaitGroup, imageData *ImageData, jpgExportParams *vips.JpegExportParams) error {
-	wg.Add(1)
-	defer wg.Done()
+// frameThumbnail adds the -thumb-border, if any
+func frameThumbnail(thumbnail *vips.ImageRef) error {
+	// polaroid-style frame, centred on a larger canvas
+	if border := config.ThumbBorder; border > 0 {
+		return thumbnail.EmbedBackground(border, border, thumbnail.Width()+2*border, thumbnail.Height()+2*border, config.thumbBorderColor)
+	}
+	return nil
+}
 
-	thumbnail, err := vips.NewThumbnailFromFile(imageData.FullPath, math.MaxInt16, thumbnailHeight, vips.InterestingNone)
+// writeThumbnail frames and saves a thumbnail sized by thumbnailBox
+func writeThumbnail(imageData *ImageData, thumbnail *vips.ImageRef) error {
+	checkered, err := checkerThumbnail(thumbnail)
 	if err != nil {
 		return err
 	}
-	defer thumbnail.Close()
+	imageData.CheckerThumb = checkered
+	if err := frameThumbnail(thumbnail); err != nil {
+		return err
+	}
+
+	imageData.ThumbWidth = thumbnail.Width()
+	imageData.ThumbHeight = thumbnail.Height()
 
-	thumbnailBytes, _, err := thumbnail.ExportJpeg(jpgExportParams)
+	thumbnailBytes, err := exportImage(thumbnail, imageData.ThumbFormat, renditionQuality(config.ThumbQuality, imageData.ThumbFormat, thumbnail))
 	if err != nil {
 		return err
 	}
-	err = os.WriteFile(imageData.ThumbPath, thumbnailBytes, 0644)
+	outputPaths.claim(imageData.ThumbPath, imageData.path)
+	err = writeVerified(imageData.ThumbPath, thumbnailBytes, thumbnail.Width(), thumbnail.Height())
 	if err != nil {
 		return err
 	}
+	imageData.thumbBytes = len(thumbnailBytes)
 
 	return nil
 }
 
-func generateSlideImage(wg *sync.WaitGroup, imageData *ImageData, jpgExportParams *vips.JpegExportParams) error {
-	wg.Add(1)
-	defer wg.Done()
+func generateSlideImage(imageData *ImageData) error {
+	display, err := loadThumbnail(imageData.FullPath, config.SlideMaxWidth, config.SlideHeight, vips.InterestingNone)
+	if err != nil {
+		return err
+	}
+	defer display.Close()
+
+	return writeSlideImage(imageData, display)
+}
 
-	display, err := vips.NewThumbnailFromFile(imageData.FullPath, math.MaxInt16, slideHeight, vips.InterestingNone)
+// generateSlideAndThumbnail decodes the full rendition once, for the display
+// image, and derives the thumbnail from that
+func generateSlideAndThumbnail(imageData *ImageData) error {
+	display, err := loadThumbnail(imageData.FullPath, config.SlideMaxWidth, config.SlideHeight, vips.InterestingNone)
 	if err != nil {
 		return err
 	}
 	defer display.Close()
 
-	displayBytes, _, err := display.ExportJpeg(jpgExportParams)
+	if err := writeSlideImage(imageData, display); err != nil {
+		return err
+	}
+	if err := generateThumbnailFrom(imageData, display); err != nil {
+		return &stageError{"thumbnail", err}
+	}
+	return nil
+}
+
+// writeSlideImage balances, levels and saves a display image, recording its
+// size
+func writeSlideImage(imageData *ImageData, display *vips.ImageRef) error {
+	if err := whiteBalance(display, imageData.whiteGains); err != nil {
+		return err
+	}
+	if config.AutoLevels {
+		if err := autoLevels(display); err != nil {
+			return err
+		}
+	}
+
+	displayBytes, err := exportImage(display, imageData.DisplayFormat, renditionQuality(config.DisplayQuality, imageData.DisplayFormat, display))
 	if err != nil {
 		return err
 	}
 
-	err = os.WriteFile(imageData.DisplayPath, displayBytes, 0644)
+	outputPaths.claim(imageData.DisplayPath, imageData.path)
+	err = writeVerified(imageData.DisplayPath, displayBytes, display.Width(), display.Height())
 	if err != nil {
 		return err
 	}
+	imageData.displayBytes = len(displayBytes)
 
 	imageData.Height = display.Height()
 	imageData.Width = display.Width()
+	imageData.DisplayHeight = display.Height()
+	imageData.DisplayWidth = display.Width()
 	return nil
 }
 
-func generateImageTiles(wg *sync.WaitGroup, imageData *ImageData) {
-	wg.Add(1)
-	defer wg.Done()
+func generateImageTiles(imageData *ImageData) error {
+	imageBaseDir := imageData.outputBase
+
+	// vips can't read RAW, tile the developed full rendition instead, as
+	// reframed and rasterized svg sources are
+	source := imageData.path
+	if imageData.IsRaw || imageData.reframed() || svgRasterWidth(imageData.path) > 0 {
+		source = imageData.FullPath
+	} else if imageData.source != nil && imageData.FullPath != imageData.path {
+		// converted archive sources were never written out, dzsave needs a file
+		staged, err := stageSource(imageData)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(staged)
+		source = staged
+	}
+	scale := tileScale(imageData.MaxWidth, imageData.MaxHeight)
+
+	// a finished pyramid from an earlier run is the most expensive thing to
+	// redo, as long as it was tiled at the size this run would tile at
+	if !config.Force {
+		width, height, complete := existingTiles(imageBaseDir, imageData.path)
+		wantWidth := float64(imageData.MaxWidth) * scale
+		wantHeight := float64(imageData.MaxHeight) * scale
+		if complete && math.Abs(float64(width)-wantWidth) <= 1 && math.Abs(float64(height)-wantHeight) <= 1 {
+			logger.Infof("Keeping existing tiles for %s", imageData.path)
+			return keepTiles(imageData, width, height)
+		}
+	}
+
+	logger.Infof("Generating tiles for %s", imageData.path)
+
+	// resample first so the deepest level is crisp, or the pyramid isn't huge
+	if scale != 1 {
+		resized, err := resampleForTiles(imageData, source, scale)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(resized)
+		source = resized
+	}
 
-	logger.Printf("Generating tiles for %s", imageData.path)
+	// an interrupted run leaves a partial tree, start it over
+	if err := os.RemoveAll(imageBaseDir + "_files"); err != nil {
+		return err
+	}
 
 	// Shell out because govips doesn't have a dzsave binding
-	imageBaseDir := filepath.Join(filepath.Dir(imageData.path), imageData.name)
-	vipsDzCmd := exec.Command("vips", "dzsave", imageData.path, imageBaseDir, "--centre")
-	err := vipsDzCmd.Run()
+	outputPaths.claim(imageBaseDir+"_files", imageData.path)
+	dzArgs := []string{"dzsave", loaderArg(source), imageBaseDir, "--centre"}
+	if imageData.HasAlpha && alphaFormats[imageData.FullFormat] {
+		// default jpeg tiles would flatten the alpha
+		dzArgs = append(dzArgs, "--suffix", formatExtensions[imageData.FullFormat])
+	}
+	vipsDzCmd := exec.Command("vips", dzArgs...)
+	err := runCommand(vipsDzCmd)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
+	// dzsave can exit cleanly with levels missing, e.g. on a full disk
+	levels := tileLevels(imageBaseDir + "_files")
+	if wantLevels := pyramidLevels(imageData.MaxWidth, imageData.MaxHeight); levels != wantLevels {
+		if config.StrictTiles {
+			return fmt.Errorf("incomplete tile pyramid, %d of %d levels", levels, wantLevels)
+		}
+		logger.Warnf("Incomplete tile pyramid for %s, %d of %d levels", imageData.path, levels, wantLevels)
+	}
+	imageData.TileLevels = levels
+
+	imageData.Tiles = imageBaseDir + "_files"
+
+	if err := applyModes(imageData.Tiles); err != nil {
+		logger.Error(err)
+	}
+
+	// DZI-configured viewers load the descriptor, otherwise it's unnecessary
+	if config.KeepDzi {
+		imageData.DziPath = imageBaseDir + ".dzi"
+		if err := applyMode(imageData.DziPath, config.FileMode); err != nil {
+			logger.Error(err)
+		}
+	} else {
+		// but it marks the pyramid complete for later runs
+		err = os.Rename(imageBaseDir+".dzi", filepath.Join(imageData.Tiles, tileDescriptor))
+		if err != nil {
+			logger.Error(err)
+		}
+	}
+
+	checksums.recordDir(imageData.Tiles)
+	if imageData.DziPath != "" {
+		checksums.recordFile(imageData.DziPath)
+	}
+	return nil
+}
+
+// keepTiles records a complete existing pyramid of width by height px in
+// place of generating one, moving its descriptor to where -keep-dzi wants it
+func keepTiles(imageData *ImageData, width int, height int) error {
+	imageBaseDir := imageData.outputBase
+	outputPaths.claim(imageBaseDir+"_files", imageData.path)
+
 	imageData.Tiles = imageBaseDir + "_files"
+	imageData.TileLevels = pyramidLevels(width, height)
+	imageData.MaxWidth = width
+	imageData.MaxHeight = height
+
+	outer := imageBaseDir + ".dzi"
+	inner := filepath.Join(imageData.Tiles, tileDescriptor)
+	if config.KeepDzi {
+		imageData.DziPath = outer
+		if _, err := os.Stat(outer); err != nil {
+			return os.Rename(inner, outer)
+		}
+	} else if _, err := os.Stat(outer); err == nil {
+		return os.Rename(outer, inner)
+	}
+	return nil
+}
+
+// tileScale is the factor tiled images are resampled by before dzsave, per
+// -tile-upscale-to and -tile-max-level
+func tileScale(width int, height int) float64 {
+	longEdge := float64(max(width, height))
+	scale := 1.0
+
+	if config.TileUpscaleTo > 0 && longEdge < float64(config.TileUpscaleTo) {
+		scale = float64(config.TileUpscaleTo) / longEdge
+	}
+
+	// a deepzoom pyramid has ceil(log2(long edge)) + 1 levels
+	if config.TileMaxLevel > 0 {
+		maxEdge := math.Exp2(float64(config.TileMaxLevel - 1))
+		if longEdge*scale > maxEdge {
+			scale = maxEdge / longEdge
+		}
+	}
+
+	return scale
+}
+
+// resampleForTiles writes a resampled copy of the source to a temp file for
+// dzsave, recording the dimensions the tiles will actually have
+func resampleForTiles(imageData *ImageData, source string, scale float64) (string, error) {
+	tmp, err := os.CreateTemp("", "tiles-*.v")
+	if err != nil {
+		return "", err
+	}
+	tmp.Close()
+
+	logger.Infof("Resampling %s by %.3f for tiles", imageData.path, scale)
+
+	vipsResizeCmd := exec.Command("vips", "resize", loaderArg(source), tmp.Name(), fmt.Sprintf("%f", scale))
+	if err := runCommand(vipsResizeCmd); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
 
-	// delete the unnecessary generated meta files
-	err = os.Remove(imageBaseDir + ".dzi")
+	resized, err := vips.NewImageFromFile(tmp.Name())
 	if err != nil {
-		logger.Println(err)
+		os.Remove(tmp.Name())
+		return "", err
 	}
+	defer resized.Close()
+
+	imageData.MaxWidth = resized.Width()
+	imageData.MaxHeight = resized.Height()
+
+	return tmp.Name(), nil
 }
 
-func writeDirImageData(dir string, imageData map[string]*ImageData) {
-	logger.Printf("Saving JSON to %s/images.json", dir)
+// writeDirImageData saves a directory's images.json. With merge, entries
+// already in the file are kept unless imageData replaces them, for runs that
+// only saw part of the directory at a time.
+func writeDirImageData(dir string, imageData map[string]*ImageData, merge bool) {
+	jsonPath := filepath.Join(dir, dirImageDataName())
+	logger.Infof("Saving JSON to %s", jsonPath)
+
+	// relative to -path-base before merging, the existing entries already are
+	imageData = withRecordedPaths(dir, imageData)
+	if merge {
+		imageData = mergeDirImageData(jsonPath, imageData)
+	}
+
+	dirImageData := DirImageData{
+		Meta:   newRunMeta(),
+		Name:   dirDisplayName(dir),
+		Count:  len(imageData),
+		Cover:  coverImage(imageData),
+		Images: imageData,
+	}
+	// deferred first, so it runs once the file is closed
+	defer events.emit(Event{Type: eventDirFlushed, Dir: dir, Count: len(imageData)})
+
+	if config.DirSummary != "" {
+		dirStats.record(dir, imageData)
+	}
+
+	if config.ContactSheet {
+		sheets, err := writeContactSheets(dir, imageData)
+		if err != nil {
+			logger.Errorf("Contact sheet for %s: %s", dir, err)
+		}
+		for _, sheet := range sheets {
+			dirImageData.ContactSheets = append(dirImageData.ContactSheets, recordedPath(sheet))
+		}
+	}
+
+	if config.JSONPageSize > 0 {
+		if err := writeDirPages(jsonPath, dirImageData); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	acquireFileSlot()
+	defer releaseFileSlot()
 
-	logger.Printf("Opening JSON file %s", dir)
-	jsonFile, err := os.Create(filepath.Join(dir, "images.json"))
+	logger.Infof("Opening JSON file %s", dir)
+	outputPaths.claim(jsonPath, dir)
+	jsonFile, err := createFile(jsonPath)
+	if err != nil {
+		panic(err)
+	}
 
 	defer func() {
-		logger.Printf("Closing JSON file for %s", dir)
+		logger.Infof("Closing JSON file for %s", dir)
 		err := jsonFile.Close()
 		if err != nil {
-			logger.Println(err)
+			logger.Error(err)
 			return
 		}
 	}()
 
-	imageJson, err := json.MarshalIndent(imageData, "", "  ")
+	var jsonWriter io.Writer = jsonFile
+	var gzipWriter *gzip.Writer
+	if config.JSONGzip {
+		gzipWriter = gzip.NewWriter(jsonFile)
+		jsonWriter = gzipWriter
+	}
+
+	buffered := bufio.NewWriter(jsonWriter)
+	err = encodeDirImageData(buffered, dirImageData)
 	if err != nil {
 		panic(err)
 	}
-	_, err = jsonFile.Write(imageJson)
+	err = buffered.Flush()
 	if err != nil {
 		panic(err)
 	}
+
+	if gzipWriter != nil {
+		err = gzipWriter.Close()
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+// encodeDirImageData streams dirImageData to w an image at a time, byte for
+// byte what marshalling it whole gives, so a directory of tens of thousands
+// of images is never held serialized in memory
+func encodeDirImageData(w io.Writer, dirImageData DirImageData) error {
+	images := dirImageData.Images
+	dirImageData.Images = map[string]*ImageData{}
+
+	var envelope []byte
+	var err error
+	if config.JSONPretty {
+		envelope, err = json.MarshalIndent(dirImageData, "", "  ")
+	} else {
+		envelope, err = json.Marshal(dirImageData)
+	}
+	if err != nil {
+		return err
+	}
+	if len(images) == 0 {
+		_, err = w.Write(envelope)
+		return err
+	}
+
+	// the envelope ends with its empty images object, which the entries go in
+	closing := []byte("}")
+	if config.JSONPretty {
+		closing = []byte("\n}")
+	}
+	envelope = bytes.TrimSuffix(envelope, append([]byte("{}"), closing...))
+	if _, err := w.Write(envelope); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(images))
+	for name := range images {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for i, name := range names {
+		separator := ","
+		if i == 0 {
+			separator = "{"
+		}
+		if config.JSONPretty {
+			separator += "\n    "
+		}
+
+		key, err := json.Marshal(name)
+		if err != nil {
+			return err
+		}
+		key = append(key, ':')
+		var entry []byte
+		if config.JSONPretty {
+			entry, err = json.MarshalIndent(images[name], "    ", "  ")
+			key = append(key, ' ')
+		} else {
+			entry, err = json.Marshal(images[name])
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, err := io.WriteString(w, separator); err != nil {
+			return err
+		}
+		if _, err := w.Write(append(key, entry...)); err != nil {
+			return err
+		}
+	}
+
+	if config.JSONPretty {
+		_, err = io.WriteString(w, "\n  }\n}")
+	} else {
+		_, err = io.WriteString(w, "}}")
+	}
+	return err
+}
+
+// dirImageDataName is the file name of each directory's images.json
+func dirImageDataName() string {
+	name := "images.json"
+	if config.JSONPageSize > 0 {
+		name = dirImageIndexName
+	}
+	if config.JSONGzip {
+		return name + ".gz"
+	}
+	return name
+}
+
+// readDirImageData reads back a file written by writeDirImageData,
+// decompressing it if it is the gzip variant and joining its pages if it is
+// an images-index.json
+func readDirImageData(jsonPath string) ([]byte, error) {
+	if isDirImageIndex(jsonPath) {
+		return readDirPages(jsonPath)
+	}
+	return readJSONFile(jsonPath)
+}
+
+// readJSONFile reads the file at jsonPath, decompressing it if it ends in .gz
+func readJSONFile(jsonPath string) ([]byte, error) {
+	if !strings.HasSuffix(jsonPath, ".gz") {
+		return os.ReadFile(jsonPath)
+	}
+
+	jsonFile, err := os.Open(jsonPath)
+	if err != nil {
+		return nil, err
+	}
+	defer jsonFile.Close()
+
+	gzipReader, err := gzip.NewReader(jsonFile)
+	if err != nil {
+		return nil, err
+	}
+	defer gzipReader.Close()
+
+	return io.ReadAll(gzipReader)
+}
+
+// mergeDirImageData overlays imageData onto the entries already recorded in
+// jsonPath. A missing or unreadable file just yields imageData.
+func mergeDirImageData(jsonPath string, imageData map[string]*ImageData) map[string]*ImageData {
+	existingJson, err := readDirImageData(jsonPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Error(err)
+		}
+		return imageData
+	}
+
+	var existing DirImageData
+	if err := json.Unmarshal(existingJson, &existing); err != nil {
+		logger.Warnf("Not merging unreadable %s: %s", jsonPath, err)
+		return imageData
+	}
+	if existing.Images == nil {
+		return imageData
+	}
+
+	for name, data := range imageData {
+		existing.Images[name] = data
+	}
+	return existing.Images
+}
+
+// claim records that source is about to write path. With -detect-collisions a
+// claim by another source on the same path within a run is logged, as it
+// means two sources map to the same derivative name and one output is being
+// lost. The same source claiming again, like a directory's images.json
+// flushed once per -batch-size, is no collision.
+func (s *pathSet) claim(path string, source string) {
+	if !config.DetectCollisions {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if previous, exists := s.sources[path]; exists {
+		if previous != source {
+			logger.Errorf("Output path collision on %s: claimed by %s and %s", path, previous, source)
+		}
+		return
+	}
+	s.sources[path] = source
 }
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSkippedName(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+	config.Sizes = sizeList{{Name: "small", Width: 320}}
+
+	tests := []struct {
+		name    string
+		skipped bool
+	}{
+		{"photo.jpg", false},
+		{"uncropped.jpg", false},
+		{"preview.png", false},
+		{"my-page-1a.jpg", false},
+		{"thumbnails.jpg", false},
+		{"report.csv.jpg", false},
+		{"photo-thumbnail.jpg", true},
+		{"photo-thumbnail-square.webp", true},
+		{"photo-cropped.jpg", true},
+		{"scan-page-2.jpg", true},
+		{"photo-small.jpg", true},
+		{"contact-sheet.jpg", true},
+		{"contact-sheet-3.jpg", true},
+		{"images.json", true},
+		{"images.json.gz", true},
+		{"photo.priority", true},
+		{"photo.crop.json", true},
+		{".DS_Store", true},
+	}
+	for _, test := range tests {
+		if skipped := skippedName(test.name); skipped != test.skipped {
+			t.Errorf("skippedName(%q) = %t, want %t", test.name, skipped, test.skipped)
+		}
+	}
+}
+
+func TestDegenerateSize(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+
+	tests := []struct {
+		minDimension int
+		width        int
+		height       int
+		skipped      bool
+	}{
+		{2, 1, 1, true},
+		{2, 1, 600, true},
+		{2, 800, 1, true},
+		{2, 2, 2, false},
+		{2, 800, 600, false},
+		{1, 1, 1, false},
+		{100, 99, 600, true},
+	}
+	for _, test := range tests {
+		config.MinDimension = test.minDimension
+		err := degenerateSize(test.width, test.height)
+		var skip *skipError
+		if skipped := errors.As(err, &skip); skipped != test.skipped {
+			t.Errorf("%dx%d with -min-dimension %d skipped %t, want %t", test.width, test.height, test.minDimension, skipped, test.skipped)
+		}
+		if !test.skipped && err != nil {
+			t.Errorf("%dx%d with -min-dimension %d: %v", test.width, test.height, test.minDimension, err)
+		}
+	}
+}
+
+func TestDirImageDataDeterministic(t *testing.T) {
+	dir := t.TempDir()
+	imageData := map[string]*ImageData{
+		"b": {FullPath: filepath.Join(dir, "b.jpg"), ThumbPath: filepath.Join(dir, "b-thumbnail.jpg"), Width: 800, Height: 600, Tags: []string{"rome", "night"}},
+		"a": {FullPath: filepath.Join(dir, "a.png"), ThumbPath: filepath.Join(dir, "a-thumbnail.jpg"), Width: 640, Height: 480},
+		"c": {FullPath: filepath.Join(dir, "c.jpg"), ThumbPath: filepath.Join(dir, "c-thumbnail.jpg"), Width: 300, Height: 300},
+	}
+
+	var written [2][]byte
+	for i := range written {
+		writeDirImageData(dir, imageData, false)
+		jsonBytes, err := os.ReadFile(filepath.Join(dir, "images.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the run's own record, which isn't what's compared across runs
+		var envelope map[string]json.RawMessage
+		if err := json.Unmarshal(jsonBytes, &envelope); err != nil {
+			t.Fatal(err)
+		}
+		delete(envelope, "meta")
+		written[i], err = json.Marshal(envelope)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(written[0], written[1]) {
+		t.Errorf("writing the same images.json twice differs:\n%s\n%s", written[0], written[1])
+	}
+}
+
+func TestClaimAcrossFlushes(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+	defer func(saved map[string]string) { outputPaths.sources = saved }(outputPaths.sources)
+	defer func(saved *log.Logger, level logLevel) { logger.out, logger.level = saved, level }(logger.out, logger.level)
+	var logged bytes.Buffer
+	logger.out, logger.level = log.New(&logged, "", 0), levelError
+	config.DetectCollisions = true
+
+	for _, pageSize := range []int{0, 1} {
+		config.JSONPageSize = pageSize
+		outputPaths.sources = map[string]string{}
+		dir := t.TempDir()
+
+		// -batch-size flushes a directory's images.json as its images come
+		writeDirImageData(dir, map[string]*ImageData{"a": {FullPath: filepath.Join(dir, "a.jpg")}}, true)
+		writeDirImageData(dir, map[string]*ImageData{"b": {FullPath: filepath.Join(dir, "b.jpg")}}, true)
+		if logged.Len() > 0 {
+			t.Errorf("-json-page-size %d: flushing %s twice logged %q", pageSize, dir, logged.String())
+		}
+		logged.Reset()
+
+		jsonBytes, err := readDirImageData(filepath.Join(dir, dirImageDataName()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var written DirImageData
+		if err := json.Unmarshal(jsonBytes, &written); err != nil {
+			t.Fatal(err)
+		}
+		if written.Images["a"] == nil || written.Images["b"] == nil {
+			t.Errorf("-json-page-size %d: the second flush lost the first's images: %s", pageSize, jsonBytes)
+		}
+	}
+
+	// another source on the same path still collides
+	outputPaths.sources = map[string]string{}
+	outputPaths.claim("dir/photo-thumbnail.jpg", "dir/photo.jpg")
+	outputPaths.claim("dir/photo-thumbnail.jpg", "dir/photo.png")
+	if !strings.Contains(logged.String(), "collision on dir/photo-thumbnail.jpg") {
+		t.Errorf("two sources claiming a path logged %q", logged.String())
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// profileSetting is one Config field a -profile sets, named by the flag
+// that would set it otherwise so an explicit one is left be
+type profileSetting struct {
+	flag string
+	set  func(c *Config)
+}
+
+// profile is a -profile bundle of settings, applied beneath any flags given
+// explicitly or in the environment
+type profile []profileSetting
+
+// profiles are the -profile bundles:
+//
+//	web      today's defaults, small stripped renditions for browsing
+//	print    quality 92 jpeg with 3000 px display images and metadata kept
+//	archive  sources kept in their own format, quality 95 with metadata
+//	         and .dzi descriptors kept
+var profiles = map[string]profile{
+	"web": {},
+	"print": {
+		{"format", func(c *Config) { c.Format = "jpeg" }},
+		{"quality", func(c *Config) { c.Quality = 92 }},
+		{"slide-height", func(c *Config) { c.SlideHeight = 3000 }},
+		{"strip-metadata", func(c *Config) { c.StripMetadata = false }},
+	},
+	"archive": {
+		{"full-format", func(c *Config) { c.FullFormat = keepSourceFormat }},
+		{"quality", func(c *Config) { c.Quality = 95 }},
+		{"strip-metadata", func(c *Config) { c.StripMetadata = false }},
+		{"keep-dzi", func(c *Config) { c.KeepDzi = true }},
+	},
+}
+
+func profileNames() string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// applyProfile sets the config fields of profile name whose flags weren't
+// set on the command line or from the environment
+func applyProfile(name string) error {
+	p, exists := profiles[name]
+	if !exists {
+		return fmt.Errorf("-profile must be one of %s: %q", profileNames(), name)
+	}
+
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	p.apply(&config, explicit)
+	return nil
+}
+
+// apply sets c's fields for each setting whose flag isn't explicit
+func (p profile) apply(c *Config, explicit map[string]bool) {
+	for _, setting := range p {
+		if !explicit[setting.flag] {
+			setting.set(c)
+		}
+	}
+}
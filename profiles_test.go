@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"testing"
+)
+
+func TestProfileSettingFlags(t *testing.T) {
+	if flag.Lookup("profile") == nil {
+		registerFlags()
+	}
+	for name, p := range profiles {
+		for _, setting := range p {
+			if flag.Lookup(setting.flag) == nil {
+				t.Errorf("-profile %s sets -%s, which isn't a flag", name, setting.flag)
+			}
+		}
+	}
+}
+
+func TestProfileApply(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+	defaults := config
+
+	tests := []struct {
+		profile  string
+		explicit map[string]bool
+		check    func(c Config) bool
+	}{
+		{"web", nil, func(c Config) bool { return c.Quality == defaults.Quality && c.FullFormat == defaults.FullFormat }},
+		{"print", nil, func(c Config) bool {
+			return c.Format == "jpeg" && c.Quality == 92 && c.SlideHeight == 3000 && !c.StripMetadata
+		}},
+		{"print", map[string]bool{"quality": true}, func(c Config) bool { return c.Quality == defaults.Quality && c.SlideHeight == 3000 }},
+		{"archive", nil, func(c Config) bool { return c.FullFormat == keepSourceFormat && c.Quality == 95 && c.KeepDzi }},
+		{"archive", map[string]bool{"full-format": true}, func(c Config) bool { return c.FullFormat == defaults.FullFormat && c.KeepDzi }},
+	}
+	for _, test := range tests {
+		c := defaults
+		profiles[test.profile].apply(&c, test.explicit)
+		if !test.check(c) {
+			t.Errorf("-profile %s with %v explicit gave %+v", test.profile, test.explicit, c)
+		}
+	}
+}
+
+func TestFullFormatKeepsSource(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+	config.FullFormat = keepSourceFormat
+
+	tests := []struct {
+		path   string
+		format string
+	}{
+		{"a.jpg", "jpeg"},
+		{"a.PNG", "png"},
+		{"a.webp", "webp"},
+		{"a.heif", "heic"},
+		{"a.tif", "png"},
+		{"a.cr2", "png"},
+	}
+	for _, test := range tests {
+		if format := fullFormat(test.path, false); format != test.format {
+			t.Errorf("-full-format source of %s = %s, want %s", test.path, format, test.format)
+		}
+	}
+
+	config.FullFormat = "webp"
+	if format := fullFormat("a.jpg", false); format != "webp" {
+		t.Errorf("-full-format webp of a.jpg = %s", format)
+	}
+}
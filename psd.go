@@ -0,0 +1,43 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// layeredExtensions are the Photoshop sources, which libvips only reads
+// through its ImageMagick loader. That loads just the first frame, the
+// composite Photoshop saves of all layers flattened, so they go through the
+// pipeline like any single layer source.
+var layeredExtensions = map[string]string{
+	".psd": "psd",
+	".psb": "psb",
+}
+
+func isLayered(path string) bool {
+	_, layered := layeredExtensions[strings.ToLower(filepath.Ext(path))]
+	return layered
+}
+
+// layeredUnsupported reports a psd or psb source this libvips was built
+// without the magick loader for
+func layeredUnsupported(path string) bool {
+	return isLayered(path) && !vips.IsTypeSupported(vips.ImageTypeMagick)
+}
+
+// sourceType names the format imageData's source was decoded from, as vips
+// has it, but for psd and psb which vips only knows as magick
+func sourceType(imageData *ImageData, image *vips.ImageRef) string {
+	if layered, ok := layeredExtensions[strings.ToLower(filepath.Ext(imageData.path))]; ok {
+		return layered
+	}
+	if imageData.IsRaw {
+		return "raw"
+	}
+	if isSvg(imageData.path) {
+		return "svg"
+	}
+	return vips.ImageTypes[image.OriginalFormat()]
+}
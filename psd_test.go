@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLayeredRouting(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+	config.FullFormat = keepSourceFormat
+
+	tests := []struct {
+		path    string
+		layered string
+	}{
+		{"scans/poster.psd", "psd"},
+		{"scans/POSTER.PSD", "psd"},
+		{"scans/mural.psb", "psb"},
+		{"scans/photo.jpg", ""},
+		{"scans/photo.tif", ""},
+	}
+	for _, test := range tests {
+		if layered := isLayered(test.path); layered != (test.layered != "") {
+			t.Errorf("isLayered(%q) = %t", test.path, layered)
+		}
+		if reason := skipReason(test.path[strings.LastIndex(test.path, "/")+1:]); reason != "" {
+			t.Errorf("%s skipped as %s", test.path, reason)
+		}
+
+		options := loaderArg(test.path)
+		composite := strings.HasSuffix(options, "[n=1,page=0]")
+		if composite != (test.layered != "") {
+			t.Errorf("loaderArg(%q) = %q", test.path, options)
+		}
+		if test.layered == "" {
+			continue
+		}
+
+		// never served as-is, the full rendition is always converted
+		if format := sourceFormat(test.path); format != "" {
+			t.Errorf("sourceFormat(%q) = %q, want it converted", test.path, format)
+		}
+		if format := fullFormat(test.path, false); format != "png" {
+			t.Errorf("fullFormat(%q) keeping source formats = %q, want png", test.path, format)
+		}
+		if recorded := sourceType(&ImageData{path: test.path}, nil); recorded != test.layered {
+			t.Errorf("sourceType(%q) = %q, want %q", test.path, recorded, test.layered)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// rawExtensions are camera RAW formats vips can't load without a converter
+var rawExtensions = map[string]bool{
+	".nef": true,
+	".cr2": true,
+	".arw": true,
+	".dng": true,
+}
+
+var rawToolOnce sync.Once
+var rawToolFound bool
+
+func isRaw(path string) bool {
+	return rawExtensions[strings.ToLower(filepath.Ext(path))]
+}
+
+// rawToolAvailable checks for the RAW converter the first time a RAW file is
+// seen, so runs without RAW inputs don't need it installed
+func rawToolAvailable() bool {
+	rawToolOnce.Do(func() {
+		_, err := exec.LookPath(config.RawTool)
+		rawToolFound = err == nil
+		if !rawToolFound {
+			logger.Warnf("RAW converter %q not found, skipping RAW files: %s", config.RawTool, err)
+		}
+	})
+	return rawToolFound
+}
+
+// loadRawImage develops a RAW file to a TIFF with the dcraw-compatible
+// converter and loads that for the rest of the pipeline
+func loadRawImage(path string) (*vips.ImageRef, error) {
+	var stdout, stderr bytes.Buffer
+
+	// -c to stdout, -w camera white balance, -T as TIFF
+	rawCmd := exec.Command(config.RawTool, "-c", "-w", "-T", path)
+	rawCmd.Stdout = &stdout
+	rawCmd.Stderr = &stderr
+	if err := runCommand(rawCmd); err != nil {
+		return nil, fmt.Errorf("%s %s: %w: %s", config.RawTool, path, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return vips.NewImageFromBuffer(stdout.Bytes())
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// priorRuns lazily loads each directory's existing images.json entries for
+// -resume-from-json. A directory is read once, before this run rewrites it.
+type priorRuns struct {
+	sync.Mutex
+	byDir map[string]map[string]*ImageData
+}
+
+var priorImageData = priorRuns{byDir: map[string]map[string]*ImageData{}}
+
+func (p *priorRuns) lookup(dir string, name string) (*ImageData, bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	entries, loaded := p.byDir[dir]
+	if !loaded {
+		entries = readPriorImageData(filepath.Join(dir, dirImageDataName()))
+		p.byDir[dir] = entries
+	}
+
+	prior, exists := entries[name]
+	return prior, exists
+}
+
+func readPriorImageData(jsonPath string) map[string]*ImageData {
+	existingJson, err := readDirImageData(jsonPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Error(err)
+		}
+		return nil
+	}
+
+	var existing DirImageData
+	if err := json.Unmarshal(existingJson, &existing); err != nil {
+		logger.Warnf("Not resuming from unreadable %s: %s", jsonPath, err)
+		return nil
+	}
+	return existing.Images
+}
+
+// resumeImage fills imageData from its prior images.json entry, keeping the
+// recorded dimensions, hash, full rendition and tiles so that only the
+// thumbnail and display image need encoding again. It reports false when
+// there's no usable entry and the image needs processing in full.
+func resumeImage(imageData *ImageData) bool {
+	imageData.outputBase = derivativeBase(imageData)
+	prior, exists := priorImageData.lookup(imageDataKey(imageData))
+	if !exists {
+		return false
+	}
+
+	// a different full format or a missing rendition means converting again
+	format := fullFormat(imageData.path, prior.HasAlpha)
+	if prior.FullFormat != "" && prior.FullFormat != format {
+		return false
+	}
+	// an untrimmed run needs the untrimmed source back, and a changed crop
+	// sidecar a new crop
+	if prior.Trim != nil && !config.TrimBorders {
+		return false
+	}
+	if prior.Crop != nil || imageData.Crop != nil {
+		if prior.Crop == nil || imageData.Crop == nil || *prior.Crop != *imageData.Crop {
+			return false
+		}
+	}
+	// placing a focal point past a crop or trim takes the source's size
+	if imageData.Focal != nil && (prior.Crop != nil || prior.Trim != nil) {
+		return false
+	}
+	fullPath := localPath(prior.FullPath)
+	if _, err := os.Stat(fullPath); err != nil {
+		return false
+	}
+
+	logger.Infof("Resuming %s from images.json", imageData.path)
+	if err := makeDirs(filepath.Dir(imageData.outputBase)); err != nil {
+		logger.Error(err)
+		return false
+	}
+
+	imageData.HasAlpha = prior.HasAlpha
+	imageData.IsRaw = prior.IsRaw
+	imageData.PHash = prior.PHash
+	imageData.CaptureDate = prior.CaptureDate
+	imageData.SourceFormat = prior.SourceFormat
+	imageData.ThumbFormat = outputFormat(config.ThumbFormat, prior.HasAlpha)
+	imageData.DisplayFormat = outputFormat(config.DisplayFormat, prior.HasAlpha)
+	imageData.FullFormat = format
+	imageData.ThumbPath = imageData.outputBase + "-thumbnail" + formatExtensions[imageData.ThumbFormat]
+	imageData.DisplayPath = imageData.outputBase + "-display" + formatExtensions[imageData.DisplayFormat]
+	imageData.FullPath = fullPath
+	imageData.Width = prior.Width
+	imageData.Height = prior.Height
+	imageData.MaxWidth = prior.MaxWidth
+	imageData.MaxHeight = prior.MaxHeight
+	imageData.Cropped = prior.Cropped
+	imageData.Trim = prior.Trim
+	// uncropped and untrimmed, the full rendition is framed as the source
+	imageData.focus = imageData.Focal
+	imageData.PageCount = prior.PageCount
+	imageData.FrameCount = prior.FrameCount
+	for _, pagePath := range prior.PagePaths {
+		imageData.PagePaths = append(imageData.PagePaths, localPath(pagePath))
+	}
+	// the reference -tiles-ref recorded may not be a path, they're always here
+	if prior.Tiles != "" {
+		imageData.Tiles = imageData.outputBase + "_files"
+	}
+	imageData.TileLevels = prior.TileLevels
+	imageData.DziPath = localPath(prior.DziPath)
+
+	// without a display image before, the full rendition stands in again
+	if prior.DisplayPath == prior.FullPath {
+		imageData.DisplayPath = imageData.FullPath
+	}
+
+	// titles from an earlier -metadata-csv survive runs without one
+	if galleryMetadata == nil {
+		imageData.Title = prior.Title
+		imageData.Caption = prior.Caption
+		imageData.Tags = mergeTags(prior.Tags, imageData.Tags)
+	}
+
+	return true
+}
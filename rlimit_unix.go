@@ -0,0 +1,13 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+func openFileLimit() (uint64, bool) {
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+		return 0, false
+	}
+	return uint64(rlimit.Cur), true
+}
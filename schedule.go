@@ -0,0 +1,180 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// schedules are the -schedule orders images reach the workers in
+var schedules = map[string]bool{
+	"walk":          true,
+	"largest-first": true,
+}
+
+// largestFirst passes on images in descending order of estimated cost once
+// all have been walked, so the few that need tiles start first rather than
+// leaving one worker with them at the end
+func largestFirst(ctx context.Context, images <-chan *ImageData) <-chan *ImageData {
+	ordered := make(chan *ImageData)
+	go func() {
+		defer close(ordered)
+
+		var all []costedImage
+		for imageData := range images {
+			all = append(all, costedImage{imageData, processingCost(imageData)})
+		}
+		logger.Infof("Scheduling %d images largest first", len(all))
+
+		sortByCost(all)
+		for _, image := range all {
+			select {
+			case ordered <- image.imageData:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ordered
+}
+
+// costedImage is an image with its estimated processing cost
+type costedImage struct {
+	imageData *ImageData
+	cost      int64
+}
+
+// sortByCost orders images most costly first. It's stable, so equal costs
+// keep the walk's order.
+func sortByCost(images []costedImage) {
+	sort.SliceStable(images, func(i, j int) bool {
+		return images[i].cost > images[j].cost
+	})
+}
+
+// processingCost estimates how long imageData takes by its pixel count,
+// from the header alone. RAW headers need developing, so their size in bytes
+// stands in for it. Unreadable images cost nothing, they fail straight away.
+func processingCost(imageData *ImageData) int64 {
+	if isRaw(imageData.path) {
+		return fileSize(imageData.path)
+	}
+
+	// loading is lazy, this only reads the header
+	image, err := loadSource(imageData)
+	if err != nil {
+		return 0
+	}
+	defer image.Close()
+	return int64(image.Width()) * int64(image.Height())
+}
+
+// prioritySidecarSuffix names a source's priority sidecar, photo.jpg has
+// photo.priority holding an integer
+const prioritySidecarSuffix = ".priority"
+
+// readPrioritySidecar is the priority beside imageData's source, higher
+// going first, 0 when there is none or it can't be read
+func readPrioritySidecar(imageData *ImageData) int {
+	sidecarPath := strings.TrimSuffix(imageData.path, filepath.Ext(imageData.path)) + prioritySidecarSuffix
+	sidecar, err := os.ReadFile(sidecarPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Error(err)
+		}
+		return 0
+	}
+
+	priority, err := strconv.Atoi(strings.TrimSpace(string(sidecar)))
+	if err != nil {
+		logger.Warnf("Ignoring priority sidecar %s: %s", sidecarPath, err)
+		return 0
+	}
+	return priority
+}
+
+// queuedImage is an image waiting in a prioritized queue, seq being the
+// order it arrived in
+type queuedImage struct {
+	imageData *ImageData
+	priority  int
+	seq       int
+}
+
+// imageQueue is a heap of images, highest priority and then earliest first
+type imageQueue []queuedImage
+
+func (q imageQueue) Len() int { return len(q) }
+
+func (q imageQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q imageQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *imageQueue) Push(x any) { *q = append(*q, x.(queuedImage)) }
+
+func (q *imageQueue) Pop() any {
+	old := *q
+	last := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return last
+}
+
+// priorityWindow is the most images prioritized holds back at once, so a
+// huge walk isn't all queued in memory
+const priorityWindow = 1024
+
+// prioritized passes on images as the workers take them, whichever of
+// those walked so far has the highest priority sidecar first. Until a
+// sidecar turns up, images pass straight through one at a time, so without
+// them nothing is read ahead and everything keeps the order it arrived in.
+func prioritized(ctx context.Context, images <-chan *ImageData) <-chan *ImageData {
+	dispatched := make(chan *ImageData)
+	go func() {
+		defer close(dispatched)
+
+		var queue imageQueue
+		seq := 0
+		prioritizing := false
+		for images != nil || queue.Len() > 0 {
+			// only offer an image when there is one, only take more with room
+			var next chan<- *ImageData
+			var top *ImageData
+			if queue.Len() > 0 {
+				next = dispatched
+				top = queue[0].imageData
+			}
+			walked := images
+			if queue.Len() >= priorityWindow || (!prioritizing && queue.Len() > 0) {
+				walked = nil
+			}
+
+			select {
+			case imageData, ok := <-walked:
+				if !ok {
+					images = nil
+					continue
+				}
+				priority := readPrioritySidecar(imageData)
+				if priority != 0 {
+					prioritizing = true
+				}
+				heap.Push(&queue, queuedImage{imageData, priority, seq})
+				seq++
+			case next <- top:
+				heap.Pop(&queue)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return dispatched
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// workerFinishes is a heap of when each simulated worker is next free
+type workerFinishes []int64
+
+func (w workerFinishes) Len() int           { return len(w) }
+func (w workerFinishes) Less(i, j int) bool { return w[i] < w[j] }
+func (w workerFinishes) Swap(i, j int)      { w[i], w[j] = w[j], w[i] }
+func (w *workerFinishes) Push(x any)        { *w = append(*w, x.(int64)) }
+func (w *workerFinishes) Pop() any {
+	old := *w
+	last := old[len(old)-1]
+	*w = old[:len(old)-1]
+	return last
+}
+
+// makespan is when the last of workers finishes images taken in order from
+// one channel, each as soon as the worker is free
+func makespan(images []costedImage, workers int) int64 {
+	free := make(workerFinishes, workers)
+	var end int64
+	for _, image := range images {
+		finish := heap.Pop(&free).(int64) + image.cost
+		end = max(end, finish)
+		heap.Push(&free, finish)
+	}
+	return end
+}
+
+// skewedGallery is mostly small images with a few tile-sized giants
+// scattered through the walk, costed in pixels
+func skewedGallery(n int, seed int64) []costedImage {
+	random := rand.New(rand.NewSource(seed))
+	images := make([]costedImage, n)
+	for i := range images {
+		cost := int64(2+random.Intn(10)) * 1_000_000
+		if random.Intn(50) == 0 {
+			cost = int64(100+random.Intn(200)) * 1_000_000
+		}
+		images[i] = costedImage{&ImageData{name: fmt.Sprint(i)}, cost}
+	}
+	return images
+}
+
+func TestSortByCost(t *testing.T) {
+	images := []costedImage{
+		{&ImageData{name: "a"}, 5},
+		{&ImageData{name: "b"}, 9},
+		{&ImageData{name: "c"}, 5},
+		{&ImageData{name: "d"}, 0},
+		{&ImageData{name: "e"}, 9},
+	}
+	sortByCost(images)
+
+	var order string
+	for _, image := range images {
+		order += image.imageData.name
+	}
+	if order != "beacd" {
+		t.Errorf("sorted by cost to %s, want beacd", order)
+	}
+}
+
+func TestLargestFirstMakespan(t *testing.T) {
+	for seed := int64(0); seed < 20; seed++ {
+		images := skewedGallery(500, seed)
+		walked := makespan(images, 8)
+		sortByCost(images)
+		if largest := makespan(images, 8); largest > walked {
+			t.Errorf("seed %d: largest first took %d, walk order %d", seed, largest, walked)
+		}
+	}
+}
+
+// BenchmarkSchedule reports the simulated wall time of each -schedule on a
+// skewed gallery, as megapixels processed by the slowest worker
+func BenchmarkSchedule(b *testing.B) {
+	for _, schedule := range []string{"walk", "largest-first"} {
+		for _, workers := range []int{4, 16} {
+			b.Run(fmt.Sprintf("%s/%d-workers", schedule, workers), func(b *testing.B) {
+				gallery := skewedGallery(2000, 1)
+				images := make([]costedImage, len(gallery))
+				var end int64
+				for i := 0; i < b.N; i++ {
+					copy(images, gallery)
+					if schedule == "largest-first" {
+						sortByCost(images)
+					}
+					end = makespan(images, workers)
+				}
+				b.ReportMetric(float64(end)/1e6, "makespan-Mpx")
+			})
+		}
+	}
+}
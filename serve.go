@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// galleryPage lists a directory's subdirectories and its images' thumbnails,
+// each linking to the largest rendition there is
+var galleryPage = template.Must(template.New("gallery").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+.images { display: flex; flex-wrap: wrap; gap: 8px; }
+figure { margin: 0; width: 240px; }
+figure img { max-width: 240px; max-height: 240px; }
+figcaption { font-size: small; overflow-wrap: anywhere; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{if .Dirs}}<ul>{{range .Dirs}}<li><a href="{{.}}/">{{.}}</a></li>{{end}}</ul>{{end}}
+<div class="images">
+{{range .Images}}<figure><a href="{{.Link}}"><img src="{{.Thumb}}" alt="{{.Name}}" loading="lazy"></a><figcaption>{{.Name}}{{if .Title}}: {{.Title}}{{end}}</figcaption></figure>
+{{end}}</div>
+</body>
+</html>
+`))
+
+type galleryPageData struct {
+	Title  string
+	Dirs   []string
+	Images []galleryImage
+}
+
+type galleryImage struct {
+	Name, Title string
+	Thumb, Link string
+}
+
+// galleryServer serves root's files, with a gallery page in place of the
+// listing of every directory that has an images.json
+type galleryServer struct {
+	root  string
+	files http.Handler
+}
+
+// serveGallery serves the processed tree under root on addr until it fails
+func serveGallery(root string, addr string) error {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+
+	logger.Infof("Serving %s on %s", root, addr)
+	return http.ListenAndServe(addr, &galleryServer{root: absRoot, files: http.FileServer(http.Dir(absRoot))})
+}
+
+func (s *galleryServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		s.files.ServeHTTP(w, r)
+		return
+	}
+
+	dir := filepath.Join(s.root, filepath.FromSlash(path.Clean(r.URL.Path)))
+	page, ok := s.galleryPage(dir, r.URL.Path)
+	if !ok {
+		s.files.ServeHTTP(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := galleryPage.Execute(w, page); err != nil {
+		logger.Errorf("Gallery page for %s: %s", dir, err)
+	}
+}
+
+// galleryPage reads dir's images.json, or its pages, into its page, ok is false if dir has none
+func (s *galleryServer) galleryPage(dir string, title string) (galleryPageData, bool) {
+	var dirImageData DirImageData
+	found := false
+	for _, name := range []string{"images.json", "images.json.gz", dirImageIndexName, dirImageIndexName + ".gz"} {
+		jsonBytes, err := readDirImageData(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		if err := json.Unmarshal(jsonBytes, &dirImageData); err != nil {
+			logger.Errorf("Gallery page for %s: %s", dir, err)
+			continue
+		}
+		found = true
+		break
+	}
+	if !found {
+		return galleryPageData{}, false
+	}
+
+	page := galleryPageData{Title: title}
+
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasSuffix(entry.Name(), "_files") {
+			page.Dirs = append(page.Dirs, entry.Name())
+		}
+	}
+
+	names := make([]string, 0, len(dirImageData.Images))
+	for name := range dirImageData.Images {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		imageData := dirImageData.Images[name]
+		link := imageData.FullPath
+		if link == "" {
+			link = imageData.DisplayPath
+		}
+		page.Images = append(page.Images, galleryImage{
+			Name:  name,
+			Title: imageData.Title,
+			Thumb: s.url(imageData.ThumbPath),
+			Link:  s.url(link),
+		})
+	}
+
+	return page, true
+}
+
+// url is where a path recorded in images.json is served, empty if it is
+// outside the root
+func (s *galleryServer) url(recorded string) string {
+	if recorded == "" {
+		return ""
+	}
+
+	absPath, err := filepath.Abs(localPath(recorded))
+	if err != nil {
+		return ""
+	}
+	relPath, err := filepath.Rel(s.root, absPath)
+	if err != nil || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return ""
+	}
+
+	return (&url.URL{Path: "/" + filepath.ToSlash(relPath)}).String()
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// namedSize is one -size, a named width display images are also made at
+type namedSize struct {
+	Name  string `json:"name"`
+	Width int    `json:"width"`
+}
+
+// SizedImage is the rendition made for a -size
+type SizedImage struct {
+	Path   string `json:"path"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// sizedMap holds an image's -size renditions by name
+type sizedMap map[string]SizedImage
+
+var sizeNamePattern = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// sizeList is the repeatable -size flag, name:width
+type sizeList []namedSize
+
+func (l *sizeList) String() string {
+	sizes := make([]string, len(*l))
+	for i, size := range *l {
+		sizes[i] = fmt.Sprintf("%s:%d", size.Name, size.Width)
+	}
+	return strings.Join(sizes, ",")
+}
+
+func (l *sizeList) Set(value string) error {
+	name, width, found := strings.Cut(value, ":")
+	if !found {
+		return fmt.Errorf("size must be name:width: %q", value)
+	}
+	if !sizeNamePattern.MatchString(name) {
+		return fmt.Errorf("size name must be lowercase letters, digits and underscores: %q", name)
+	}
+	// the name ends the file name, where it mustn't pass for another derivative
+	for _, suffix := range derivativeSuffixes {
+		if "-"+name == suffix {
+			return fmt.Errorf("size name %q is taken by a derivative", name)
+		}
+	}
+	for _, size := range *l {
+		if size.Name == name {
+			return fmt.Errorf("size name %q given twice", name)
+		}
+	}
+	pixels, err := strconv.Atoi(width)
+	if err != nil || pixels < 1 {
+		return fmt.Errorf("size width must be a positive number of pixels: %q", value)
+	}
+	*l = append(*l, namedSize{Name: name, Width: pixels})
+	return nil
+}
+
+// sizedPath is where the -size name of imageData is written
+func sizedPath(imageData *ImageData, name string) string {
+	return imageData.outputBase + "-" + name + formatExtensions[imageData.DisplayFormat]
+}
+
+// sizedName reports whether the file name is a -size rendition of this run
+func sizedName(name string) bool {
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	for _, size := range config.Sizes {
+		if strings.HasSuffix(base, "-"+size.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// generateSizes writes a display image for each -size, never wider than the
+// full rendition
+func generateSizes(imageData *ImageData) error {
+	sizes := make(sizedMap, len(config.Sizes))
+	for _, size := range config.Sizes {
+		// only the width constrains a size
+		sized, err := loadThumbnail(imageData.FullPath, min(size.Width, imageData.MaxWidth), math.MaxInt16, vips.InterestingNone)
+		if err != nil {
+			return fmt.Errorf("%s: %w", size.Name, err)
+		}
+
+		if err := whiteBalance(sized, imageData.whiteGains); err != nil {
+			sized.Close()
+			return fmt.Errorf("%s: %w", size.Name, err)
+		}
+		if config.AutoLevels {
+			if err := autoLevels(sized); err != nil {
+				sized.Close()
+				return fmt.Errorf("%s: %w", size.Name, err)
+			}
+		}
+		sizedBytes, err := exportImage(sized, imageData.DisplayFormat, renditionQuality(config.DisplayQuality, imageData.DisplayFormat, sized))
+		width, height := sized.Width(), sized.Height()
+		sized.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", size.Name, err)
+		}
+
+		path := sizedPath(imageData, size.Name)
+		outputPaths.claim(path, imageData.path)
+		if err := writeVerified(path, sizedBytes, width, height); err != nil {
+			return err
+		}
+		sizes[size.Name] = SizedImage{Path: path, Width: width, Height: height}
+	}
+	imageData.Sizes = sizes
+	return nil
+}
+
+// standInSizes points the thumbnail at the smallest -size and the display
+// image at the largest, for -sizes-only
+func standInSizes(imageData *ImageData) {
+	var smallest, largest SizedImage
+	for _, sized := range imageData.Sizes {
+		if smallest.Path == "" || sized.Width < smallest.Width {
+			smallest = sized
+		}
+		if sized.Width > largest.Width {
+			largest = sized
+		}
+	}
+	imageData.ThumbPath = smallest.Path
+	imageData.ThumbWidth = smallest.Width
+	imageData.ThumbHeight = smallest.Height
+	imageData.DisplayPath = largest.Path
+	imageData.Width = largest.Width
+	imageData.Height = largest.Height
+	imageData.DisplayWidth = largest.Width
+	imageData.DisplayHeight = largest.Height
+}
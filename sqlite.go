@@ -0,0 +1,121 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteSchema is the -sqlite index, one row per processed image. Paths are
+// recorded as in images.json, tags as a JSON array.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS images (
+	path         TEXT PRIMARY KEY,
+	dir          TEXT NOT NULL,
+	name         TEXT NOT NULL,
+	full_path    TEXT NOT NULL,
+	thumb_path   TEXT NOT NULL,
+	display_path TEXT NOT NULL,
+	tiles        TEXT,
+	width        INTEGER NOT NULL,
+	height       INTEGER NOT NULL,
+	max_width    INTEGER NOT NULL,
+	max_height   INTEGER NOT NULL,
+	capture_date TEXT,
+	title        TEXT,
+	caption      TEXT,
+	tags         TEXT
+);
+CREATE INDEX IF NOT EXISTS images_capture_date ON images (capture_date);
+`
+
+const sqliteInsert = `
+INSERT OR REPLACE INTO images (
+	path, dir, name, full_path, thumb_path, display_path, tiles,
+	width, height, max_width, max_height, capture_date, title, caption, tags
+) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+`
+
+// sqliteIndex inserts images from a single writer goroutine, sqlite only
+// allowing one writer at a time, in one transaction for the run
+type sqliteIndex struct {
+	db     *sql.DB
+	images chan *ImageData
+	done   chan error
+}
+
+func openSQLiteIndex(dbPath string) (*sqliteIndex, error) {
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	index := &sqliteIndex{db: db, images: make(chan *ImageData, 100), done: make(chan error, 1)}
+	go func() {
+		index.done <- index.write()
+	}()
+
+	return index, nil
+}
+
+// add queues imageData for insertion
+func (s *sqliteIndex) add(imageData *ImageData) {
+	s.images <- imageData
+}
+
+// close inserts what's still queued and commits
+func (s *sqliteIndex) close() error {
+	close(s.images)
+	err := <-s.done
+	if closeErr := s.db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (s *sqliteIndex) write() error {
+	err := s.insertAll()
+	// keep taking images so the results loop never blocks on a failed index
+	for range s.images {
+	}
+	return err
+}
+
+func (s *sqliteIndex) insertAll() error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	insert, err := tx.Prepare(sqliteInsert)
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+
+	for imageData := range s.images {
+		tags, err := json.Marshal(imageData.Tags)
+		if err != nil {
+			return err
+		}
+
+		dir, name := imageDataKey(imageData)
+		_, err = insert.Exec(
+			recordedPath(imageData.path), recordedPath(dir), name,
+			recordedPath(imageData.FullPath), recordedPath(imageData.ThumbPath), recordedPath(imageData.DisplayPath), tilesRef(dir, imageData),
+			imageData.Width, imageData.Height, imageData.MaxWidth, imageData.MaxHeight,
+			imageData.CaptureDate, imageData.Title, imageData.Caption, string(tags),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// processSummary is what processImage produced for one image
+type processSummary struct {
+	path                        string
+	thumbWidth, thumbHeight     int
+	thumbBytes                  int
+	displayWidth, displayHeight int
+	displayBytes                int
+	fullWidth, fullHeight       int
+	fullBytes                   int
+	tiled                       bool
+	elapsed                     time.Duration
+}
+
+func newProcessSummary(imageData *ImageData, elapsed time.Duration) processSummary {
+	summary := processSummary{
+		path:          imageData.path,
+		thumbWidth:    imageData.ThumbWidth,
+		thumbHeight:   imageData.ThumbHeight,
+		thumbBytes:    imageData.thumbBytes,
+		displayWidth:  imageData.Width,
+		displayHeight: imageData.Height,
+		displayBytes:  imageData.displayBytes,
+		fullWidth:     imageData.MaxWidth,
+		fullHeight:    imageData.MaxHeight,
+		fullBytes:     imageData.fullBytes,
+		tiled:         imageData.Tiles != "",
+		elapsed:       elapsed,
+	}
+
+	// sources served as-is weren't written, so weren't counted
+	if summary.fullBytes == 0 {
+		if info, err := os.Stat(imageData.FullPath); err == nil {
+			summary.fullBytes = int(info.Size())
+		}
+	}
+
+	return summary
+}
+
+func (s processSummary) String() string {
+	var summary strings.Builder
+
+	fmt.Fprintf(&summary, "%s in %s: thumbnail %dx%d %dB", s.path, s.elapsed.Round(time.Millisecond), s.thumbWidth, s.thumbHeight, s.thumbBytes)
+	if s.displayBytes > 0 {
+		fmt.Fprintf(&summary, ", display %dx%d %dB", s.displayWidth, s.displayHeight, s.displayBytes)
+	}
+	fmt.Fprintf(&summary, ", full %dx%d %dB", s.fullWidth, s.fullHeight, s.fullBytes)
+	if s.tiled {
+		summary.WriteString(", tiled")
+	}
+
+	return summary.String()
+}
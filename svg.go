@@ -0,0 +1,49 @@
+package main
+
+import (
+	"math"
+	"path/filepath"
+	"strings"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// svgDefaultWidth is the width svg sources are rasterized at without
+// -svg-width or -svg-dpi, since they have no pixel size of their own
+const svgDefaultWidth = 2048
+
+func isSvg(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".svg" || ext == ".svgz"
+}
+
+// svgUnsupported reports an svg source this libvips was built without the
+// librsvg loader for
+func svgUnsupported(path string) bool {
+	return isSvg(path) && !vips.IsTypeSupported(vips.ImageTypeSVG)
+}
+
+// svgRasterWidth is the width the source at path is rasterized at, 0 when
+// it isn't an svg or -svg-dpi sizes it instead
+func svgRasterWidth(path string) int {
+	switch {
+	case !isSvg(path):
+		return 0
+	case config.SvgWidth > 0:
+		return config.SvgWidth
+	case config.SvgDpi > 0:
+		return 0
+	}
+	return svgDefaultWidth
+}
+
+// loadSvg rasterizes imageData's svg source width px wide, keeping its
+// aspect ratio. vips renders the vector at that size rather than scaling
+// pixels, so it's as sharp as at any dpi.
+func loadSvg(imageData *ImageData, width int) (*vips.ImageRef, error) {
+	params := loaderParams(imageData.path)
+	if imageData.source != nil {
+		return vips.LoadThumbnailFromBuffer(imageData.source, width, math.MaxInt16, vips.InterestingNone, vips.SizeBoth, params)
+	}
+	return vips.LoadThumbnailFromFile(imageData.path, width, math.MaxInt16, vips.InterestingNone, vips.SizeBoth, params)
+}
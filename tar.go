@@ -0,0 +1,171 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// isTarArchive reports whether the input is a tar archive instead of a
+// directory to walk
+func isTarArchive(input string) bool {
+	lower := strings.ToLower(input)
+	return strings.HasSuffix(lower, ".tar") || strings.HasSuffix(lower, ".tar.gz") || strings.HasSuffix(lower, ".tgz")
+}
+
+// buildTarImageList streams the image entries of archive with their bytes
+// held in memory, named as if walked from a copy of the archive unpacked
+// into config.root. Entries are read one at a time as processors take them.
+func buildTarImageList(ctx context.Context, archive string) (<-chan *ImageData, <-chan error) {
+	images := make(chan *ImageData)
+	errc := make(chan error, 1)
+
+	go func() {
+		defer close(images)
+		errc <- readTarImages(ctx, archive, images)
+	}()
+
+	return images, errc
+}
+
+func readTarImages(ctx context.Context, archive string, images chan<- *ImageData) error {
+	archiveFile, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer archiveFile.Close()
+
+	var archiveReader io.Reader = archiveFile
+	if !strings.HasSuffix(strings.ToLower(archive), ".tar") {
+		gzipReader, err := gzip.NewReader(archiveFile)
+		if err != nil {
+			return err
+		}
+		defer gzipReader.Close()
+		archiveReader = gzipReader
+	}
+
+	var modifiedAfter time.Time
+	if config.Since > 0 {
+		modifiedAfter = time.Now().Add(-config.Since)
+	}
+
+	entries := tar.NewReader(archiveReader)
+	for {
+		header, err := entries.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		entry := path.Clean(strings.TrimPrefix(header.Name, "./"))
+		if path.IsAbs(entry) || entry == ".." || strings.HasPrefix(entry, "../") {
+			logger.Warnf("Skipping %s, it points outside the archive", header.Name)
+			continue
+		}
+
+		// RAW needs a file for the converter, so only what vips decodes itself
+		base := path.Base(entry)
+		if sourceFormat(base) == "" || skippedName(base) || (config.inputGlob != nil && !config.inputGlob.matches(entry)) {
+			continue
+		}
+		if !modifiedAfter.IsZero() && header.ModTime.Before(modifiedAfter) {
+			continue
+		}
+
+		source, err := io.ReadAll(entries)
+		if err != nil {
+			return err
+		}
+
+		imagePath := filepath.Join(config.root, filepath.FromSlash(entry))
+		name := strings.TrimSuffix(base, path.Ext(base))
+		var imageData = ImageData{
+			path:   imagePath,
+			name:   name,
+			source: source,
+		}
+
+		if config.SlugifyNames {
+			imageData.OriginalName = base
+			imageData.Slug = slugs.assign(filepath.Dir(imagePath), name)
+			imageData.name = imageData.Slug
+		}
+		if keep, err := sourceNames.resolve(&imageData); err != nil {
+			return err
+		} else if !keep {
+			continue
+		}
+
+		select {
+		case images <- &imageData:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// loadSource opens imageData's source from its archived bytes or its file.
+// svg sources come rasterized at -svg-width.
+func loadSource(imageData *ImageData) (*vips.ImageRef, error) {
+	if width := svgRasterWidth(imageData.path); width > 0 {
+		return loadSvg(imageData, width)
+	}
+	if imageData.source != nil {
+		return vips.LoadImageFromBuffer(imageData.source, loaderParams(imageData.path))
+	}
+	return vips.LoadImageFromFile(imageData.path, loaderParams(imageData.path))
+}
+
+// sourceEmpty reports whether imageData's source has no bytes at all
+func sourceEmpty(imageData *ImageData) bool {
+	if imageData.source != nil {
+		return len(imageData.source) == 0
+	}
+	info, err := os.Stat(imageData.path)
+	return err == nil && info.Size() == 0
+}
+
+// writeSource puts an archived source that is served as-is in place as its
+// own full rendition
+func writeSource(imageData *ImageData) error {
+	if err := makeDirs(filepath.Dir(imageData.path)); err != nil {
+		return err
+	}
+	outputPaths.claim(imageData.path, imageData.path)
+	if err := writeFile(imageData.path, imageData.source); err != nil {
+		return err
+	}
+	checksums.record(imageData.path, imageData.source)
+	return nil
+}
+
+// stageSource writes an archived source out to a temp file for tools that
+// can only read files, the caller removing it
+func stageSource(imageData *ImageData) (string, error) {
+	staged, err := os.CreateTemp("", "source-*"+filepath.Ext(imageData.path))
+	if err != nil {
+		return "", err
+	}
+	defer staged.Close()
+
+	if _, err := staged.Write(imageData.source); err != nil {
+		os.Remove(staged.Name())
+		return "", err
+	}
+	return staged.Name(), nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestSourceEmpty(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty.jpg")
+	photo := filepath.Join(dir, "photo.jpg")
+	if err := os.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(photo, []byte("jpeg"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		imageData *ImageData
+		empty     bool
+	}{
+		{"empty file", &ImageData{path: empty}, true},
+		{"file", &ImageData{path: photo}, false},
+		{"missing file", &ImageData{path: filepath.Join(dir, "missing.jpg")}, false},
+		{"empty archived source", &ImageData{path: filepath.Join(dir, "archived.jpg"), source: []byte{}}, true},
+		{"archived source", &ImageData{path: filepath.Join(dir, "archived.jpg"), source: []byte("jpeg")}, false},
+		// an archived source is judged by its bytes, not what's on disk
+		{"archived over empty file", &ImageData{path: empty, source: []byte("jpeg")}, false},
+	}
+	for _, test := range tests {
+		if got := sourceEmpty(test.imageData); got != test.empty {
+			t.Errorf("%s: sourceEmpty = %t, want %t", test.name, got, test.empty)
+		}
+	}
+}
+
+// writeTestTar writes a tar of the files named in modified, each holding its
+// name and last modified at the given time
+func writeTestTar(t *testing.T, modified map[string]time.Time) string {
+	t.Helper()
+	archive := filepath.Join(t.TempDir(), "sources.tar")
+	archiveFile, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archiveFile.Close()
+
+	entries := tar.NewWriter(archiveFile)
+	for name, modTime := range modified {
+		header := &tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: int64(len(name)), ModTime: modTime}
+		if err := entries.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := entries.Write([]byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := entries.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return archive
+}
+
+func TestTarImageListSince(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+
+	old := time.Now().Add(-48 * time.Hour)
+	archive := writeTestTar(t, map[string]time.Time{"old.jpg": old, "./new.jpg": time.Now(), "b/old.png": old, "b/new.png": time.Now()})
+
+	tests := []struct {
+		since  time.Duration
+		images []string
+	}{
+		{0, []string{"b/new.png", "b/old.png", "new.jpg", "old.jpg"}},
+		{24 * time.Hour, []string{"b/new.png", "new.jpg"}},
+		{72 * time.Hour, []string{"b/new.png", "b/old.png", "new.jpg", "old.jpg"}},
+	}
+	for _, test := range tests {
+		config.root = t.TempDir()
+		config.Since = test.since
+		sourceNames = nameRegistry{taken: map[string]map[string]string{}}
+		images, errc := buildTarImageList(context.Background(), archive)
+		var read []string
+		for imageData := range images {
+			relPath, _ := filepath.Rel(config.root, imageData.path)
+			read = append(read, filepath.ToSlash(relPath))
+		}
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(read)
+		if !slices.Equal(read, test.images) {
+			t.Errorf("-since %s: read %v from the archive, want %v", test.since, read, test.images)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/xml"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// tileDescriptor is where the .dzi is kept inside the tiles directory
+// without -keep-dzi. dzsave writes the descriptor last, so either copy
+// existing means the pyramid finished.
+const tileDescriptor = "pyramid.dzi"
+
+// dziImage is the part of a .dzi read back to check a pyramid or describe
+// it to OpenSeadragon
+type dziImage struct {
+	XMLName  xml.Name
+	Format   string `xml:"Format,attr"`
+	Overlap  int    `xml:"Overlap,attr"`
+	TileSize int    `xml:"TileSize,attr"`
+	Size     struct {
+		Width  int `xml:"Width,attr"`
+		Height int `xml:"Height,attr"`
+	} `xml:"Size"`
+}
+
+// existingTiles reports the dimensions of a complete tile pyramid already at
+// imageBaseDir, one with a descriptor newer than source and every level
+// directory the descriptor implies
+func existingTiles(imageBaseDir string, source string) (int, int, bool) {
+	tilesDir := imageBaseDir + "_files"
+
+	descriptorPath := imageBaseDir + ".dzi"
+	if _, err := os.Stat(descriptorPath); err != nil {
+		descriptorPath = filepath.Join(tilesDir, tileDescriptor)
+	}
+	descriptorInfo, err := os.Stat(descriptorPath)
+	if err != nil {
+		return 0, 0, false
+	}
+	if sourceInfo, err := os.Stat(source); err != nil || sourceInfo.ModTime().After(descriptorInfo.ModTime()) {
+		return 0, 0, false
+	}
+
+	descriptor, err := os.ReadFile(descriptorPath)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	var dzi dziImage
+	if err := xml.Unmarshal(descriptor, &dzi); err != nil || dzi.Size.Width < 1 || dzi.Size.Height < 1 {
+		return 0, 0, false
+	}
+
+	if tileLevels(tilesDir) != pyramidLevels(dzi.Size.Width, dzi.Size.Height) {
+		return 0, 0, false
+	}
+
+	return dzi.Size.Width, dzi.Size.Height, true
+}
+
+// pyramidLevels is how many levels dzsave makes for width by height px, from
+// 0, a single pixel, up to the full size
+func pyramidLevels(width int, height int) int {
+	return int(math.Ceil(math.Log2(float64(max(width, height))))) + 1
+}
+
+// tileLevels counts the level directories in tilesDir that have tiles, in
+// order from level 0
+func tileLevels(tilesDir string) int {
+	levels := 0
+	for {
+		tiles, err := os.ReadDir(filepath.Join(tilesDir, strconv.Itoa(levels)))
+		if err != nil || len(tiles) == 0 {
+			return levels
+		}
+		levels++
+	}
+}
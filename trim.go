@@ -0,0 +1,68 @@
+package main
+
+import (
+	"math"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// TrimBox is the area of the source -trim-borders kept, in source px
+type TrimBox struct {
+	Left   int `json:"left"`
+	Top    int `json:"top"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// trimMinKeep is the least fraction of each dimension -trim-borders keeps,
+// a "border" taking more than that is likelier dark content, e.g. night sky
+const trimMinKeep = 0.5
+
+// trimBorders crops a uniform border off imageData's loaded image, one
+// whose four corners all match within -trim-tolerance. It returns the area
+// kept, nil when there is no border or it isn't clearly one.
+func trimBorders(imageData *ImageData, image *vips.ImageRef) (*TrimBox, error) {
+	if err := image.ToColorSpace(vips.InterpretationSRGB); err != nil {
+		return nil, err
+	}
+	width, height := image.Width(), image.Height()
+
+	background, err := image.GetPoint(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, corner := range [][2]int{{width - 1, 0}, {0, height - 1}, {width - 1, height - 1}} {
+		point, err := image.GetPoint(corner[0], corner[1])
+		if err != nil {
+			return nil, err
+		}
+		for band := 0; band < 3; band++ {
+			if math.Abs(point[band]-background[band]) > config.TrimTolerance {
+				return nil, nil
+			}
+		}
+	}
+
+	left, top, trimmedWidth, trimmedHeight, err := image.FindTrim(config.TrimThreshold, &vips.Color{
+		R: uint8(math.Round(background[0])),
+		G: uint8(math.Round(background[1])),
+		B: uint8(math.Round(background[2])),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if trimmedWidth < 1 || trimmedHeight < 1 || (trimmedWidth == width && trimmedHeight == height) {
+		return nil, nil
+	}
+	if float64(trimmedWidth) < trimMinKeep*float64(width) || float64(trimmedHeight) < trimMinKeep*float64(height) {
+		logger.Warnf("Not trimming %s to %dx%d of %dx%d, too much for a border", imageData.path, trimmedWidth, trimmedHeight, width, height)
+		return nil, nil
+	}
+
+	logger.Infof("Trimming %s from %dx%d to %dx%d at %d,%d", imageData.path, width, height, trimmedWidth, trimmedHeight, left, top)
+	if err := image.ExtractArea(left, top, trimmedWidth, trimmedHeight); err != nil {
+		return nil, err
+	}
+
+	return &TrimBox{Left: left, Top: top, Width: trimmedWidth, Height: trimmedHeight}, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// unverifiedOutputs counts the renditions that failed -verify-outputs even
+// after being rewritten
+var unverifiedOutputs atomic.Int64
+
+// writeVerified is writeFile for a rendition of width by height, read back
+// with -verify-outputs
+func writeVerified(path string, data []byte, width int, height int) error {
+	err := verified(path, width, height, func() error {
+		return writeFile(path, data)
+	})
+	if err != nil {
+		return err
+	}
+	checksums.record(path, data)
+	return nil
+}
+
+// verified runs write, which makes the rendition at path, and with
+// -verify-outputs reads it back, running write once more if it doesn't
+// decode to width by height
+func verified(path string, width int, height int, write func() error) error {
+	if err := write(); err != nil {
+		return err
+	}
+	if !config.VerifyOutputs {
+		return nil
+	}
+
+	err := verifyOutput(path, width, height)
+	if err == nil {
+		return nil
+	}
+	logger.Warnf("-verify-outputs %s: %s, rewriting it", path, err)
+	if err := write(); err != nil {
+		return err
+	}
+	if err := verifyOutput(path, width, height); err != nil {
+		unverifiedOutputs.Add(1)
+		return fmt.Errorf("-verify-outputs: %w", err)
+	}
+	return nil
+}
+
+// verifyOutput decodes the whole of the image at path, which fails on a
+// truncated or corrupt file, and checks it is width by height. Animated
+// images are checked by their first page.
+func verifyOutput(path string, width int, height int) error {
+	image, err := vips.LoadImageFromFile(path, vips.NewImportParams())
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+
+	if image.Width() != width || image.Height() != height {
+		return fmt.Errorf("read back as %dx%d, written as %dx%d", image.Width(), image.Height(), width, height)
+	}
+	// loading only read the header
+	if _, err := image.Average(); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyOutput(t *testing.T) {
+	dir := t.TempDir()
+	good := testJpeg(t, 64, 48)
+
+	tests := []struct {
+		name   string
+		data   []byte
+		width  int
+		height int
+		failed bool
+	}{
+		{"good", good, 64, 48, false},
+		{"truncated", good[:len(good)/2], 64, 48, true},
+		{"corrupt", append(append([]byte{}, good[:len(good)-64]...), make([]byte, 64)...), 64, 48, true},
+		{"not an image", []byte("not an image"), 64, 48, true},
+		{"wrong size", good, 48, 64, true},
+	}
+	for _, test := range tests {
+		path := filepath.Join(dir, test.name+".jpg")
+		if err := os.WriteFile(path, test.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := verifyOutput(path, test.width, test.height); (err != nil) != test.failed {
+			t.Errorf("%s: verifyOutput = %v, want failed %t", test.name, err, test.failed)
+		}
+	}
+}
+
+func TestVerified(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+	config.VerifyOutputs = true
+	path := filepath.Join(t.TempDir(), "photo.jpg")
+	good := testJpeg(t, 64, 48)
+	truncated := good[:len(good)/2]
+
+	tests := []struct {
+		name       string
+		writes     [][]byte
+		failed     bool
+		unverified int64
+	}{
+		{"good", [][]byte{good}, false, 0},
+		{"rewritten", [][]byte{truncated, good}, false, 0},
+		{"still truncated", [][]byte{truncated, truncated}, true, 1},
+	}
+	for _, test := range tests {
+		writes := 0
+		before := unverifiedOutputs.Load()
+		err := verified(path, 64, 48, func() error {
+			data := test.writes[min(writes, len(test.writes)-1)]
+			writes++
+			return os.WriteFile(path, data, 0644)
+		})
+		if (err != nil) != test.failed {
+			t.Errorf("%s: verified = %v, want failed %t", test.name, err, test.failed)
+		}
+		if writes != len(test.writes) {
+			t.Errorf("%s: written %d times, want %d", test.name, writes, len(test.writes))
+		}
+		if counted := unverifiedOutputs.Load() - before; counted != test.unverified {
+			t.Errorf("%s: counted %d unverified outputs, want %d", test.name, counted, test.unverified)
+		}
+	}
+}
+
+func TestVerifiedOff(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+	config.VerifyOutputs = false
+	path := filepath.Join(t.TempDir(), "photo.jpg")
+
+	// nothing is read back, so a file that isn't an image passes
+	writes := 0
+	err := verified(path, 64, 48, func() error {
+		writes++
+		return os.WriteFile(path, []byte("not an image"), 0644)
+	})
+	if err != nil || writes != 1 {
+		t.Errorf("without -verify-outputs: %v after %d writes, want one", err, writes)
+	}
+}
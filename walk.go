@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// walkDirConcurrently is filepath.WalkDir with subdirectories listed by up to
+// workers goroutines at once, so slow stats on network mounts overlap. visit
+// may be called from several goroutines and entries arrive in no fixed order.
+// The first error returned by visit stops the walk and is returned.
+func walkDirConcurrently(root string, workers int, visit fs.WalkDirFunc) error {
+	info, err := os.Lstat(root)
+	if err != nil {
+		// as WalkDir, an unreadable root is visited with no entry
+		err = visit(root, nil, err)
+	} else {
+		err = visit(root, fs.FileInfoToDirEntry(info), nil)
+	}
+	if errors.Is(err, filepath.SkipDir) || errors.Is(err, filepath.SkipAll) {
+		return nil
+	}
+	if err != nil || info == nil || !info.IsDir() {
+		return err
+	}
+
+	var (
+		wg       sync.WaitGroup
+		sem      = make(chan struct{}, workers)
+		errOnce  sync.Once
+		firstErr error
+		stopped  = make(chan struct{})
+	)
+
+	stop := func(err error) {
+		errOnce.Do(func() {
+			if !errors.Is(err, filepath.SkipAll) {
+				firstErr = err
+			}
+			close(stopped)
+		})
+	}
+
+	var walkDir func(dir string, d fs.DirEntry)
+	walkDir = func(dir string, d fs.DirEntry) {
+		defer wg.Done()
+
+		sem <- struct{}{}
+		defer func() { <-sem }()
+
+		select {
+		case <-stopped:
+			return
+		default:
+		}
+
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			// same as WalkDir, the directory is revisited with the read error
+			if err = visit(dir, d, err); err != nil && !errors.Is(err, filepath.SkipDir) {
+				stop(err)
+			}
+			return
+		}
+
+		for _, entry := range entries {
+			path := filepath.Join(dir, entry.Name())
+			err := visit(path, entry, nil)
+			if errors.Is(err, filepath.SkipDir) {
+				if entry.IsDir() {
+					continue
+				}
+				// skipping from a file skips the rest of its directory
+				return
+			}
+			if err != nil {
+				stop(err)
+				return
+			}
+
+			if entry.IsDir() {
+				wg.Add(1)
+				go walkDir(path, entry)
+			}
+		}
+	}
+
+	wg.Add(1)
+	go walkDir(root, fs.FileInfoToDirEntry(info))
+	wg.Wait()
+
+	return firstErr
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestBuildImageListWalk(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+
+	root := t.TempDir()
+	for _, name := range []string{"a.jpg", "b/c.jpg", "b/d/e.png", "b/d/e-thumbnail.jpg", "f_files/0/0_0.jpg"} {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		root    string
+		workers int
+		images  int
+		failed  bool
+	}{
+		{root, 1, 3, false},
+		{root, 4, 3, false},
+		{filepath.Join(root, "missing"), 1, 0, true},
+		{filepath.Join(root, "missing"), 4, 0, true},
+	}
+	for _, test := range tests {
+		config.root = test.root
+		config.WalkConcurrency = test.workers
+		sourceNames = nameRegistry{taken: map[string]map[string]string{}}
+		images, errc := buildImageList(context.Background(), test.root)
+		count := 0
+		for range images {
+			count++
+		}
+		err := <-errc
+		if count != test.images || (err != nil) != test.failed {
+			t.Errorf("%s with %d walkers: %d images, error %v; want %d, failed %t", test.root, test.workers, count, err, test.images, test.failed)
+		}
+	}
+}
+
+func TestBuildImageListSince(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+
+	root := t.TempDir()
+	old := time.Now().Add(-48 * time.Hour)
+	for name, modified := range map[string]time.Time{"old.jpg": old, "new.jpg": time.Now(), "b/old.jpg": old, "b/new.jpg": time.Now()} {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		since   time.Duration
+		workers int
+		images  []string
+	}{
+		{0, 1, []string{"b/new.jpg", "b/old.jpg", "new.jpg", "old.jpg"}},
+		{24 * time.Hour, 1, []string{"b/new.jpg", "new.jpg"}},
+		{24 * time.Hour, 4, []string{"b/new.jpg", "new.jpg"}},
+		{72 * time.Hour, 1, []string{"b/new.jpg", "b/old.jpg", "new.jpg", "old.jpg"}},
+	}
+	for _, test := range tests {
+		config.root = root
+		config.Since = test.since
+		config.WalkConcurrency = test.workers
+		sourceNames = nameRegistry{taken: map[string]map[string]string{}}
+		images, errc := buildImageList(context.Background(), root)
+		var walked []string
+		for imageData := range images {
+			relPath, _ := filepath.Rel(root, imageData.path)
+			walked = append(walked, filepath.ToSlash(relPath))
+		}
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(walked)
+		if !slices.Equal(walked, test.images) {
+			t.Errorf("-since %s with %d walkers: walked %v, want %v", test.since, test.workers, walked, test.images)
+		}
+	}
+}
+
+func TestBuildImageListSymlinkCycle(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+
+	root := t.TempDir()
+	for _, name := range []string{"a.jpg", "b/c.jpg", "b/d/e.jpg"} {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// each loops back to a directory above it
+	if err := os.Symlink("..", filepath.Join(root, "b", "d", "up")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(root, filepath.Join(root, "b", "root")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, workers := range []int{1, 4} {
+		config.root = root
+		config.FollowSymlinks = true
+		config.WalkConcurrency = workers
+		sourceNames = nameRegistry{taken: map[string]map[string]string{}}
+
+		walked := map[string]int{}
+		done := make(chan error)
+		go func() {
+			images, errc := buildImageList(context.Background(), root)
+			for imageData := range images {
+				target, err := filepath.EvalSymlinks(imageData.path)
+				if err != nil {
+					t.Error(err)
+					continue
+				}
+				walked[target]++
+			}
+			done <- <-errc
+		}()
+
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("%d walkers: %s", workers, err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%d walkers: the walk is still going round the symlink loop", workers)
+		}
+		if len(walked) != 3 {
+			t.Errorf("%d walkers: walked %v, want the 3 images", workers, walked)
+		}
+		for target, visits := range walked {
+			if visits != 1 {
+				t.Errorf("%d walkers: %s visited %d times", workers, target, visits)
+			}
+		}
+	}
+}
+
+func TestBuildImageListCollisionOrder(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+
+	root := t.TempDir()
+	for _, name := range []string{"photo.tif", "photo.jpg", "photo.png", "b/photo.webp", "b/photo.jpg"} {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := map[string]string{"photo.jpg": "photo", "photo.png": "photo-2", "photo.tif": "photo-3", "b/photo.jpg": "photo", "b/photo.webp": "photo-2"}
+
+	// the same names every time, whichever walker and however it's scheduled
+	for _, workers := range []int{1, 4, 4, 4} {
+		config.root = root
+		config.RenameOnCollision = "suffix"
+		config.WalkConcurrency = workers
+		sourceNames = nameRegistry{taken: map[string]map[string]string{}}
+		images, errc := buildImageList(context.Background(), root)
+		named := map[string]string{}
+		for imageData := range images {
+			relPath, _ := filepath.Rel(root, imageData.path)
+			named[filepath.ToSlash(relPath)] = imageData.name
+		}
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+		if !maps.Equal(named, want) {
+			t.Errorf("%d walkers named %v, want %v", workers, named, want)
+		}
+	}
+}
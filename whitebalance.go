@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// whiteBalances are the -auto-wb corrections for a colour cast
+var whiteBalances = map[string]bool{
+	"none":        true,
+	"gray-world":  true,
+	"white-patch": true,
+}
+
+// whiteBalanceMaxGain caps how far a channel is scaled either way, so the
+// correction only takes the edge off a cast. Strongly toned images, a sunset
+// or tungsten lit on purpose, would otherwise be neutralized.
+const whiteBalanceMaxGain = 1.3
+
+// whitePatchClip is the fraction of each channel's brightest pixels taken as
+// specular highlights rather than the white the channel is scaled to
+const whitePatchClip = 0.005
+
+// whiteBalanceSampleSize is the box a full rendition is shrunk into on load
+// to measure its cast, when the source itself is too big to decode
+const whiteBalanceSampleSize = 1024
+
+// whiteBalanceGains measures image's colour cast once for all its renditions,
+// as -auto-wb has it: the gains scaling its channels so they average the
+// same with gray-world, or so their brightest pixels, bar whitePatchClip of
+// them, match with white-patch. It's nil for greyscale images and those
+// -auto-wb leaves be.
+func whiteBalanceGains(image *vips.ImageRef) ([]float64, error) {
+	if config.AutoWB == "none" {
+		return nil, nil
+	}
+
+	// measured as the renditions are written
+	srgb, err := image.Copy()
+	if err != nil {
+		return nil, err
+	}
+	defer srgb.Close()
+	if err := srgb.ToColorSpace(vips.InterpretationSRGB); err != nil {
+		return nil, err
+	}
+	if colourBands(srgb) != 3 {
+		return nil, nil
+	}
+	if format := srgb.BandFormat(); format != vips.BandFormatUchar && format != vips.BandFormatUshort {
+		return nil, nil
+	}
+
+	levels := make([]float64, 3)
+	for band := range levels {
+		counts, err := bandHistogram(srgb, band)
+		if err != nil {
+			return nil, err
+		}
+		if config.AutoWB == "white-patch" {
+			levels[band] = whitePoint(counts)
+		} else {
+			levels[band] = meanLevel(counts)
+		}
+	}
+	return gainsFromLevels(levels), nil
+}
+
+// sampledWhiteBalanceGains is whiteBalanceGains of the full rendition at
+// path, shrunk on load to whiteBalanceSampleSize
+func sampledWhiteBalanceGains(path string) ([]float64, error) {
+	if config.AutoWB == "none" {
+		return nil, nil
+	}
+	sample, err := loadThumbnail(path, whiteBalanceSampleSize, whiteBalanceSampleSize, vips.InterestingNone)
+	if err != nil {
+		return nil, err
+	}
+	defer sample.Close()
+	return whiteBalanceGains(sample)
+}
+
+// gainsFromLevels scales the three colour levels to meet, at their average
+// or with white-patch at the brightest white, rather than at full scale, so
+// overall brightness is kept. Each gain is capped at whiteBalanceMaxGain.
+func gainsFromLevels(levels []float64) []float64 {
+	for _, level := range levels {
+		if level <= 0 {
+			return nil
+		}
+	}
+
+	target := (levels[0] + levels[1] + levels[2]) / 3
+	if config.AutoWB == "white-patch" {
+		target = max(levels[0], levels[1], levels[2])
+	}
+	gains := make([]float64, len(levels))
+	for band, level := range levels {
+		gains[band] = min(max(target/level, 1/whiteBalanceMaxGain), whiteBalanceMaxGain)
+	}
+	return gains
+}
+
+// whiteBalance scales a rendition's colour channels by gains, as
+// whiteBalanceGains measured them on its image. nil gains leave it be.
+func whiteBalance(image *vips.ImageRef, gains []float64) error {
+	if gains == nil || colourBands(image) != len(gains) {
+		return nil
+	}
+
+	a := make([]float64, image.Bands())
+	b := make([]float64, image.Bands())
+	for band := range a {
+		a[band] = 1
+	}
+	copy(a, gains)
+
+	format := image.BandFormat()
+	if err := image.Linear(a, b); err != nil {
+		return err
+	}
+	return image.Cast(format)
+}
+
+// colourBands is how many of image's bands are colour rather than alpha
+func colourBands(image *vips.ImageRef) int {
+	if image.HasAlpha() {
+		return image.Bands() - 1
+	}
+	return image.Bands()
+}
+
+// bandHistogram counts the pixels of image at each value of band
+func bandHistogram(image *vips.ImageRef, band int) ([]uint64, error) {
+	channel, err := image.Copy()
+	if err != nil {
+		return nil, err
+	}
+	defer channel.Close()
+
+	if err := channel.ExtractBand(band, 1); err != nil {
+		return nil, err
+	}
+	if err := channel.HistogramFind(); err != nil {
+		return nil, err
+	}
+
+	// one uint count per value
+	histogram, err := channel.ToBytes()
+	if err != nil {
+		return nil, err
+	}
+	if len(histogram) == 0 || len(histogram)%4 != 0 {
+		return nil, fmt.Errorf("unexpected %d byte histogram", len(histogram))
+	}
+	counts := make([]uint64, len(histogram)/4)
+	for value := range counts {
+		counts[value] = uint64(binary.NativeEndian.Uint32(histogram[4*value:]))
+	}
+	return counts, nil
+}
+
+// meanLevel is the average value counted in counts
+func meanLevel(counts []uint64) float64 {
+	var sum, total float64
+	for value, count := range counts {
+		sum += float64(value) * float64(count)
+		total += float64(count)
+	}
+	if total == 0 {
+		return 0
+	}
+	return sum / total
+}
+
+// whitePoint is the value above which whitePatchClip of counts lie
+func whitePoint(counts []uint64) float64 {
+	var total uint64
+	for _, count := range counts {
+		total += count
+	}
+
+	clip := uint64(float64(total) * whitePatchClip)
+	high := len(counts) - 1
+	for seen := counts[high]; seen <= clip && high > 0; seen += counts[high] {
+		high--
+	}
+	return float64(high)
+}
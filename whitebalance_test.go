@@ -0,0 +1,54 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestGainsFromLevels(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+
+	tests := []struct {
+		autoWB string
+		levels []float64
+		gains  []float64
+	}{
+		{"gray-world", []float64{100, 100, 100}, []float64{1, 1, 1}},
+		{"gray-world", []float64{120, 100, 80}, []float64{100.0 / 120, 1, 100.0 / 80}},
+		{"gray-world", []float64{200, 100, 30}, []float64{1 / whiteBalanceMaxGain, 1.1, whiteBalanceMaxGain}},
+		{"white-patch", []float64{250, 240, 200}, []float64{1, 250.0 / 240, 1.25}},
+		{"gray-world", []float64{100, 0, 100}, nil},
+	}
+	for _, test := range tests {
+		config.AutoWB = test.autoWB
+		gains := gainsFromLevels(test.levels)
+		if len(gains) != len(test.gains) {
+			t.Errorf("%s gains of %v = %v, want %v", test.autoWB, test.levels, gains, test.gains)
+			continue
+		}
+		for band := range gains {
+			if math.Abs(gains[band]-test.gains[band]) > 1e-9 {
+				t.Errorf("%s gains of %v = %v, want %v", test.autoWB, test.levels, gains, test.gains)
+				break
+			}
+		}
+	}
+}
+
+func TestHistogramLevels(t *testing.T) {
+	counts := make([]uint64, 256)
+	counts[10] = 500
+	counts[200] = 499
+	counts[255] = 1
+
+	if mean := meanLevel(counts); math.Abs(mean-(10*500+200*499+255)/1000.0) > 1e-9 {
+		t.Errorf("meanLevel = %f", mean)
+	}
+	// the one pixel at 255 is within whitePatchClip, a specular highlight
+	if white := whitePoint(counts); white != 200 {
+		t.Errorf("whitePoint = %f, want 200", white)
+	}
+	if mean := meanLevel(make([]uint64, 256)); mean != 0 {
+		t.Errorf("meanLevel of nothing = %f", mean)
+	}
+}